@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/telanflow/mps/cert"
+)
+
+// Generate a root CA and export it for browsers and devices
+func main() {
+	commonName := flag.String("cn", "mps", "CA common name")
+	ecdsa := flag.Bool("ecdsa", false, "generate an ECDSA key instead of RSA")
+	password := flag.String("password", "mps", "PKCS#12 password")
+	flag.Parse()
+
+	opts := cert.CAOptions{
+		Subject: pkix.Name{CommonName: *commonName, Organization: []string{"mps"}},
+	}
+	if *ecdsa {
+		opts.KeyType = cert.KeyTypeECDSA
+	}
+
+	// ca.crt and ca.key are reused if they exist
+	ca, err := cert.LoadOrGenerateCA("ca.crt", "ca.key", opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// ca.cer for Windows and Android
+	if err = os.WriteFile("ca.cer", cert.ExportDER(ca), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	// ca.p12 contains the private key
+	p12, err := cert.ExportPKCS12(ca, *password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = os.WriteFile("ca.p12", p12, 0600); err != nil {
+		log.Fatal(err)
+	}
+
+	// ca.mobileconfig for iOS and macOS
+	profile, err := cert.ExportMobileConfig(ca, "mps root CA")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = os.WriteFile("ca.mobileconfig", profile, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[INFO] CA %s generated", ca.Leaf.Subject.CommonName)
+}
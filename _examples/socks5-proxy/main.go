@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/telanflow/mps"
+	"github.com/telanflow/mps/middleware"
+)
+
+// A SOCKS5 proxy server sharing the middlewares of the http proxy server
+func main() {
+	// create a http proxy server
+	proxy := mps.NewHttpProxy()
+	proxy.Use(middleware.BasicAuth("mps_realm", func(username, password string) bool {
+		return username == "mps" && password == "mps"
+	}))
+	proxy.UseFunc(func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		log.Printf("[INFO] middleware -- %s %s", req.Method, req.URL)
+		return ctx.Next(req)
+	})
+
+	// The SOCKS5 CONNECT requests pass through the same middlewares
+	// eg: curl --socks5-hostname mps:mps@localhost:1080 https://www.example.com
+	socks5 := mps.NewSocks5HandlerWithContext(proxy.Ctx)
+	socks5.ConnectHandler = proxy.HandleConnect
+	go func() {
+		log.Printf("Socks5Proxy started listen: socks5://localhost:1080")
+		log.Fatal(socks5.ListenAndServe("localhost:1080"))
+	}()
+
+	log.Printf("HttpProxy started listen: http://localhost:8080")
+	log.Fatal(http.ListenAndServe("localhost:8080", proxy))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/telanflow/mps"
+)
+
+// A transparent proxy server on a linux gateway.
+// The traffic of the clients is redirected with iptables, eg:
+//
+//	iptables -t nat -A PREROUTING -i eth1 -p tcp --dport 80 -j REDIRECT --to-ports 8080
+//	iptables -t nat -A PREROUTING -i eth1 -p tcp --dport 443 -j REDIRECT --to-ports 8080
+func main() {
+	proxy := mps.NewHttpProxy()
+	proxy.UseFunc(func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		log.Printf("[INFO] middleware -- %s %s", req.Method, req.URL)
+		return ctx.Next(req)
+	})
+
+	// TLS connections are tunneled, use a MitmHandler to decrypt them
+	transparent := mps.NewTransparentHandlerWithContext(proxy.Ctx)
+	transparent.ConnectHandler = proxy.HandleConnect
+	transparent.HttpHandler = proxy
+
+	log.Printf("TransparentProxy started listen: %s", ":8080")
+	log.Fatal(transparent.ListenAndServe(":8080"))
+}
@@ -0,0 +1,390 @@
+package mps
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BandwidthQuotaExceededErr is returned when the daily quota of a client, user or host is exhausted
+var BandwidthQuotaExceededErr = errors.New("bandwidth quota exceeded")
+
+const (
+	// bandwidthChunkSize is the largest amount of bytes shaped at once
+	bandwidthChunkSize = 32 * 1024
+	// bandwidthSweepInterval is how often the unused buckets and quotas are removed
+	bandwidthSweepInterval = time.Minute
+)
+
+// BandwidthLimit is the limit of a client IP, an user or a destination host
+type BandwidthLimit struct {
+	// Rate is the number of bytes per second, both directions included.
+	// If zero, the bandwidth is unlimited.
+	Rate int64
+
+	// Burst is the number of bytes that can be sent at once, Rate by default
+	Burst int64
+
+	// DailyQuota is the number of bytes per day, both directions included.
+	// If zero, there is no quota.
+	DailyQuota int64
+}
+
+// BandwidthLimiter shapes the proxied traffic with token buckets per client IP,
+// per authenticated user and per destination host, and enforces daily byte quotas.
+// The requests are answered with 429 Too Many Requests once a quota is exhausted,
+// the tunnels are closed. Set it on the Context shared by the handlers.
+type BandwidthLimiter struct {
+	// Client is the limit of each client IP
+	Client BandwidthLimit
+
+	// User is the limit of each authenticated user
+	User BandwidthLimit
+
+	// Host is the limit of each destination host
+	Host BandwidthLimit
+
+	// UserFunc returns the authenticated user of the request.
+	// If nil, the username of the Proxy-Authorization Basic credentials is used.
+	UserFunc func(req *http.Request) string
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	quotas    map[string]*dailyQuota
+	lastSweep time.Time
+}
+
+// NewBandwidthLimiter Create a BandwidthLimiter
+func NewBandwidthLimiter() *BandwidthLimiter {
+	return &BandwidthLimiter{}
+}
+
+// Usage returns the number of bytes used today by the key, one of
+// "client:<ip>", "user:<name>" or "host:<host>"
+func (l *BandwidthLimiter) Usage(key string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if q, ok := l.quotas[key]; ok && q.day == today(time.Now()) {
+		return q.used
+	}
+	return 0
+}
+
+// limits returns the limits applying to the request, nil without limit
+func (l *BandwidthLimiter) limits(ctx context.Context, req *http.Request) *bandwidthLimits {
+	if l == nil {
+		return nil
+	}
+
+	keys := make([]bandwidthKey, 0, 3)
+	add := func(key string, limit BandwidthLimit) {
+		if limit.Rate > 0 || limit.DailyQuota > 0 {
+			keys = append(keys, bandwidthKey{key: key, limit: limit})
+		}
+	}
+	if ip := clientIP(req); ip != "" {
+		add("client:"+ip, l.Client)
+	}
+	if user := l.user(req); user != "" {
+		add("user:"+user, l.User)
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if host != "" {
+		add("host:"+stripPort(host), l.Host)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return &bandwidthLimits{ctx: ctx, limiter: l, keys: keys}
+}
+
+// user returns the authenticated user of the request
+func (l *BandwidthLimiter) user(req *http.Request) string {
+	if l.UserFunc != nil {
+		return l.UserFunc(req)
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return ""
+	}
+	// parse the credentials with the standard Authorization parser
+	r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	username, _, _ := r.BasicAuth()
+	return username
+}
+
+// exhausted reports whether a daily quota of the keys is exhausted
+func (l *BandwidthLimiter) exhausted(keys []bandwidthKey) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		if k.limit.DailyQuota <= 0 {
+			continue
+		}
+		if q, ok := l.quotas[k.key]; ok && q.day == today(now) && q.used >= k.limit.DailyQuota {
+			return true
+		}
+	}
+	return false
+}
+
+// consume records n bytes for the keys, it returns how long to wait before sending them.
+// BandwidthQuotaExceededErr is returned if a daily quota is exceeded.
+func (l *BandwidthLimiter) consume(keys []bandwidthKey, n int) (wait time.Duration, err error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	for _, k := range keys {
+		if k.limit.DailyQuota > 0 {
+			if l.quotas == nil {
+				l.quotas = make(map[string]*dailyQuota)
+			}
+			q, ok := l.quotas[k.key]
+			if !ok || q.day != today(now) {
+				q = &dailyQuota{day: today(now)}
+				l.quotas[k.key] = q
+			}
+			q.used += int64(n)
+			if q.used > k.limit.DailyQuota {
+				err = BandwidthQuotaExceededErr
+			}
+		}
+		if k.limit.Rate > 0 {
+			if l.buckets == nil {
+				l.buckets = make(map[string]*tokenBucket)
+			}
+			b, ok := l.buckets[k.key]
+			if !ok {
+				b = newTokenBucket(k.limit, now)
+				l.buckets[k.key] = b
+			}
+			if d := b.reserve(now, n); d > wait {
+				wait = d
+			}
+		}
+	}
+	return
+}
+
+// sweep removes the full buckets and the quotas of the previous days
+func (l *BandwidthLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bandwidthSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	day := today(now)
+	for key, q := range l.quotas {
+		if q.day != day {
+			delete(l.quotas, key)
+		}
+	}
+}
+
+// bandwidthKey is a key of the BandwidthLimiter with its limit
+type bandwidthKey struct {
+	key   string
+	limit BandwidthLimit
+}
+
+// bandwidthLimits are the limits of a request, or of a tunnel
+type bandwidthLimits struct {
+	ctx     context.Context
+	limiter *BandwidthLimiter
+	keys    []bandwidthKey
+}
+
+// exhausted reports whether a daily quota is exhausted
+func (bl *bandwidthLimits) exhausted() bool {
+	return bl != nil && bl.limiter.exhausted(bl.keys)
+}
+
+// wait records n bytes, and waits until they can be sent
+func (bl *bandwidthLimits) wait(n int) error {
+	d, err := bl.limiter.consume(bl.keys, n)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-bl.ctx.Done():
+		return bl.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// chunkSize returns the number of bytes shaped at once, at most the smallest burst
+func (bl *bandwidthLimits) chunkSize() int {
+	size := int64(bandwidthChunkSize)
+	for _, k := range bl.keys {
+		if burst := k.limit.burst(); burst > 0 && burst < size {
+			size = burst
+		}
+	}
+	return int(size)
+}
+
+// conn shapes the bytes read from and written to conn
+func (bl *bandwidthLimits) conn(conn net.Conn) net.Conn {
+	if bl == nil {
+		return conn
+	}
+	return &limitedConn{Conn: conn, limits: bl}
+}
+
+// readCloser shapes the bytes read from rc
+func (bl *bandwidthLimits) readCloser(rc io.ReadCloser) io.ReadCloser {
+	if bl == nil {
+		return rc
+	}
+	return &limitedReadCloser{ReadCloser: rc, limits: bl}
+}
+
+// read from r at the allowed rate
+func (bl *bandwidthLimits) read(r io.Reader, b []byte) (int, error) {
+	if size := bl.chunkSize(); len(b) > size {
+		b = b[:size]
+	}
+	n, err := r.Read(b)
+	if n > 0 {
+		if werr := bl.wait(n); werr != nil {
+			return 0, werr
+		}
+	}
+	return n, err
+}
+
+// limitedConn is a connection whose traffic is shaped by bandwidthLimits
+type limitedConn struct {
+	net.Conn
+	limits *bandwidthLimits
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	return c.limits.read(c.Conn, b)
+}
+
+func (c *limitedConn) Write(b []byte) (n int, err error) {
+	size := c.limits.chunkSize()
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if err = c.limits.wait(len(chunk)); err != nil {
+			return
+		}
+		var m int
+		m, err = c.Conn.Write(chunk)
+		n += m
+		if err != nil {
+			return
+		}
+		b = b[m:]
+	}
+	return
+}
+
+// NetConn returns the underlying connection
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// limitedReadCloser is a body whose reads are shaped by bandwidthLimits
+type limitedReadCloser struct {
+	io.ReadCloser
+	limits *bandwidthLimits
+}
+
+func (r *limitedReadCloser) Read(b []byte) (int, error) {
+	return r.limits.read(r.ReadCloser, b)
+}
+
+// tokenBucket holds the bytes that can be sent, refilled at the rate of the limit
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit BandwidthLimit, now time.Time) *tokenBucket {
+	burst := float64(limit.burst())
+	return &tokenBucket{
+		rate:   float64(limit.Rate),
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes n tokens, it returns how long to wait until they are available
+func (b *tokenBucket) reserve(now time.Time, n int) time.Duration {
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has been refilled completely
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// dailyQuota is the number of bytes used by a key on a day
+type dailyQuota struct {
+	day  string
+	used int64
+}
+
+func (limit BandwidthLimit) burst() int64 {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return limit.Rate
+}
+
+func today(now time.Time) string {
+	return now.Format("2006-01-02")
+}
+
+// clientIP returns the IP address of the client of the request
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,124 @@
+package mps
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(BandwidthLimit{Rate: 1000, Burst: 500}, now)
+
+	asserts := assert.New(t)
+	asserts.Equal(time.Duration(0), b.reserve(now, 500), "the burst is available at once")
+	asserts.Equal(500*time.Millisecond, b.reserve(now, 500))
+	asserts.Equal(time.Duration(0), b.reserve(now.Add(time.Second), 500))
+	asserts.False(b.full(now.Add(time.Second)))
+	asserts.True(b.full(now.Add(2 * time.Second)))
+}
+
+func TestBandwidthLimiter_TunnelRate(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	proxy := NewHttpProxy()
+	proxy.Ctx.BandwidthLimiter = &BandwidthLimiter{
+		Client: BandwidthLimit{Rate: 256 * 1024, Burst: 32 * 1024},
+	}
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	conn, br := connectTunnel(t, proxySrv.Listener.Addr().String(), echoSrv.Addr().String())
+	defer conn.Close()
+
+	// 128KB are sent and received, 96KB beyond the burst
+	payload := bytes.Repeat([]byte("x"), 64*1024)
+	start := time.Now()
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+	received := make([]byte, len(payload))
+	_, err := io.ReadFull(br, received)
+
+	asserts := assert.New(t)
+	asserts.NoError(err)
+	asserts.Equal(payload, received)
+	asserts.GreaterOrEqual(time.Since(start), 300*time.Millisecond)
+	asserts.Equal(int64(0), proxy.Ctx.BandwidthLimiter.Usage("client:127.0.0.1"), "there is no quota")
+}
+
+func TestBandwidthLimiter_TunnelQuota(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	proxy := NewHttpProxy()
+	proxy.Ctx.BandwidthLimiter = &BandwidthLimiter{
+		Host: BandwidthLimit{DailyQuota: 1000},
+	}
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	conn, br := connectTunnel(t, proxySrv.Listener.Addr().String(), echoSrv.Addr().String())
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	message := string(bytes.Repeat([]byte("x"), 400))
+	reply, err := echo(conn, br, message)
+	asserts.NoError(err)
+	asserts.Equal(message, reply)
+	// The tunnel established response is counted as well
+	asserts.Equal(int64(800+len(HttpTunnelOk)), proxy.Ctx.BandwidthLimiter.Usage("host:127.0.0.1"))
+
+	// The quota is exceeded, the tunnel is closed
+	_, err = echo(conn, br, message)
+	asserts.Error(err)
+
+	// The next tunnels are refused
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+echoSrv.Addr().String(), nil)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	asserts.Equal(http.StatusTooManyRequests, rw.Code)
+}
+
+func TestBandwidthLimiter_ForwardQuota(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	proxy := NewHttpProxy()
+	proxy.Ctx.BandwidthLimiter = &BandwidthLimiter{
+		User: BandwidthLimit{DailyQuota: int64(len("hello world"))},
+	}
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	proxyURL := func(r *http.Request) (*url.URL, error) {
+		u, _ := url.Parse(proxySrv.URL)
+		u.User = url.UserPassword("alice", "secret")
+		return u, nil
+	}
+
+	resp, err := HttpGet(srv.URL, proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal("hello world", string(body))
+	asserts.Equal(int64(len(body)), proxy.Ctx.BandwidthLimiter.Usage("user:alice"))
+
+	resp, err = HttpGet(srv.URL, proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	asserts.Equal(http.StatusTooManyRequests, resp.StatusCode)
+}
@@ -0,0 +1,200 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// KeyType is the key algorithm of a generated CA
+type KeyType int
+
+const (
+	KeyTypeRSA KeyType = iota
+	KeyTypeECDSA
+)
+
+const (
+	// DefaultCAValidity is the default validity of a generated CA
+	DefaultCAValidity = 10 * 365 * 24 * time.Hour
+	// DefaultRSABits is the default size of a generated RSA key
+	DefaultRSABits = 2048
+)
+
+// CAOptions the options of GenerateCA
+type CAOptions struct {
+	// Subject of the CA, the CommonName and Organization default to "mps"
+	Subject pkix.Name
+
+	// KeyType of the CA, use RSA by default
+	KeyType KeyType
+
+	// RSABits is the size of the RSA key, DefaultRSABits by default
+	RSABits int
+
+	// Curve is the curve of the ECDSA key, P-256 by default
+	Curve elliptic.Curve
+
+	// Validity of the CA, DefaultCAValidity by default
+	Validity time.Duration
+}
+
+// GenerateCA Generate a self-signed root CA
+func GenerateCA(opts CAOptions) (tls.Certificate, error) {
+	var (
+		pk  crypto.Signer
+		err error
+	)
+	switch opts.KeyType {
+	case KeyTypeRSA:
+		bits := opts.RSABits
+		if bits <= 0 {
+			bits = DefaultRSABits
+		}
+		pk, err = rsa.GenerateKey(rand.Reader, bits)
+	case KeyTypeECDSA:
+		curve := opts.Curve
+		if curve == nil {
+			curve = elliptic.P256()
+		}
+		pk, err = ecdsa.GenerateKey(curve, rand.Reader)
+	default:
+		err = fmt.Errorf("unsupported key type %d", opts.KeyType)
+	}
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	subject := opts.Subject
+	if subject.CommonName == "" {
+		subject.CommonName = "mps"
+	}
+	if len(subject.Organization) == 0 {
+		subject.Organization = []string{"mps"}
+	}
+	validity := opts.Validity
+	if validity <= 0 {
+		validity = DefaultCAValidity
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(pk.Public())
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyId := sha1.Sum(pubKey)
+
+	// tolerate the clock skew of the clients
+	now := time.Now()
+	tpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          keyId[:],
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, pk.Public(), pk)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  pk,
+		Leaf:        leaf,
+	}, nil
+}
+
+// SaveCA Save the CA certificate and private key as PEM files.
+// The private key file is only readable by the owner.
+func SaveCA(ca tls.Certificate, certFile, keyFile string) error {
+	if len(ca.Certificate) == 0 {
+		return errors.New("empty certificate")
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err = writeFile(certFile, ExportPEM(ca), 0644); err != nil {
+		return err
+	}
+	return writeFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)
+}
+
+// LoadCA Load the CA certificate and private key from PEM files
+func LoadCA(certFile, keyFile string) (tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return ca, err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return ca, err
+	}
+	if !ca.Leaf.IsCA {
+		return ca, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	return ca, nil
+}
+
+// LoadOrGenerateCA Load the CA from the PEM files,
+// or generate a CA with opts and save it when the files don't exist.
+func LoadOrGenerateCA(certFile, keyFile string, opts CAOptions) (tls.Certificate, error) {
+	ca, err := LoadCA(certFile, keyFile)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return ca, err
+	}
+	ca, err = GenerateCA(opts)
+	if err != nil {
+		return ca, err
+	}
+	return ca, SaveCA(ca, certFile, keyFile)
+}
+
+// write the file atomically, creating the parent directory if needed
+func writeFile(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
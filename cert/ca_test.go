@@ -0,0 +1,117 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateCA(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CAOptions
+		key  func(t *testing.T, key interface{})
+	}{
+		{
+			name: "rsa",
+			opts: CAOptions{RSABits: 1024},
+			key: func(t *testing.T, key interface{}) {
+				pk, ok := key.(*rsa.PrivateKey)
+				if assert.True(t, ok, "%T", key) {
+					assert.Equal(t, 1024, pk.N.BitLen())
+				}
+			},
+		},
+		{
+			name: "ecdsa",
+			opts: CAOptions{KeyType: KeyTypeECDSA, Curve: elliptic.P384()},
+			key: func(t *testing.T, key interface{}) {
+				pk, ok := key.(*ecdsa.PrivateKey)
+				if assert.True(t, ok, "%T", key) {
+					assert.Equal(t, elliptic.P384(), pk.Curve)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, err := GenerateCA(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.key(t, ca.PrivateKey)
+
+			asserts := assert.New(t)
+			asserts.NotNil(ca.Leaf)
+			asserts.True(ca.Leaf.IsCA)
+			asserts.Equal("mps", ca.Leaf.Subject.CommonName)
+			asserts.Equal([]string{"mps"}, ca.Leaf.Subject.Organization)
+			asserts.NoError(ca.Leaf.CheckSignatureFrom(ca.Leaf), "the CA should be self-signed")
+			asserts.True(ca.Leaf.NotBefore.Before(time.Now()))
+			asserts.WithinDuration(time.Now().Add(DefaultCAValidity), ca.Leaf.NotAfter, time.Minute)
+		})
+	}
+}
+
+func TestGenerateCA_Options(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{
+		KeyType:  KeyTypeECDSA,
+		Subject:  pkix.Name{CommonName: "test CA", Organization: []string{"test"}},
+		Validity: 24 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asserts := assert.New(t)
+	asserts.Equal("test CA", ca.Leaf.Subject.CommonName)
+	asserts.Equal([]string{"test"}, ca.Leaf.Subject.Organization)
+	asserts.WithinDuration(time.Now().Add(24*time.Hour), ca.Leaf.NotAfter, time.Minute)
+
+	_, err = GenerateCA(CAOptions{KeyType: KeyType(42)})
+	asserts.Error(err)
+}
+
+func TestLoadOrGenerateCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca", "ca.crt")
+	keyFile := filepath.Join(dir, "ca", "ca.key")
+
+	first, err := LoadOrGenerateCA(certFile, keyFile, CAOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asserts := assert.New(t)
+	asserts.FileExists(certFile)
+	asserts.FileExists(keyFile)
+
+	// the second call loads the saved CA instead of generating a new one
+	second, err := LoadOrGenerateCA(certFile, keyFile, CAOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asserts.Equal(first.Certificate, second.Certificate)
+	asserts.True(second.Leaf.IsCA)
+
+	loaded, err := LoadCA(certFile, keyFile)
+	asserts.NoError(err)
+	asserts.Equal(first.Certificate, loaded.Certificate)
+
+	// a leaf certificate is not accepted as a CA
+	leafFile := filepath.Join(dir, "leaf.pem")
+	data, err := EncodeCertificate(newTestLeaf(t, first, "a.com", time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeFile(leafFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadOrGenerateCA(leafFile, leafFile, CAOptions{})
+	asserts.Error(err)
+}
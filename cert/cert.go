@@ -1,6 +1,11 @@
 package cert
 
-import "crypto/tls"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+)
 
 const CertPEM = `-----BEGIN CERTIFICATE-----
 MIIF7jCCA9agAwIBAgIJAP/+a5pIA2lJMA0GCSqGSIb3DQEBCwUAMIGLMQswCQYD
@@ -91,3 +96,24 @@ MJQxyIWYaidDHJzHy1MiZBZ5dpC2hwqNSjLq/OoDEV2cAYHEMnLnXCiz7ZulUA==
 
 // default certificate
 var DefaultCertificate, _ = tls.X509KeyPair([]byte(CertPEM), []byte(KeyPEM))
+
+// Leaf returns the parsed leaf certificate of cert
+func Leaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// IsExpired reports whether the leaf certificate is no longer valid
+func IsExpired(cert *tls.Certificate) bool {
+	leaf, err := Leaf(cert)
+	if err != nil {
+		return true
+	}
+	now := time.Now()
+	return now.After(leaf.NotAfter) || now.Before(leaf.NotBefore)
+}
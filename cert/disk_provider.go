@@ -0,0 +1,159 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskProvider A certificate storage that persists the certificates as PEM files keyed by host.
+// The certificates are cached in a LRUProvider, and reloaded from the disk on restart.
+// The files that are expired or were signed by a different CA are discarded.
+type DiskProvider struct {
+	dir   string
+	ca    *x509.Certificate
+	cache *LRUProvider
+}
+
+// NewDiskProvider Create a DiskProvider storing the certificates signed by ca in dir.
+// The invalid certificates of the directory are removed.
+func NewDiskProvider(dir string, ca tls.Certificate) (*DiskProvider, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, fmt.Errorf("missing CA certificate")
+	}
+	x509ca, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	p := &DiskProvider{
+		dir:   dir,
+		ca:    x509ca,
+		cache: NewLRUProvider(DefaultLRUCapacity, DefaultLRUTTL),
+	}
+	if err = p.purge(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Get the certificate for the Host from the cache or the disk
+func (p *DiskProvider) Get(host string) (*tls.Certificate, error) {
+	host = strings.TrimSpace(host)
+	if cert, err := p.cache.Get(host); err == nil {
+		return cert, nil
+	}
+
+	filename := p.filename(host)
+	cert, err := p.load(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// discard the invalid certificate
+			_ = os.Remove(filename)
+		}
+		return nil, fmt.Errorf("cert not exist")
+	}
+	_ = p.cache.Set(host, cert)
+	return cert, nil
+}
+
+// Set the Host certificate to the cache and the disk
+func (p *DiskProvider) Set(host string, cert *tls.Certificate) error {
+	host = strings.TrimSpace(host)
+	data, err := EncodeCertificate(cert)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it, the readers never see a partial file
+	if err = writeFile(p.filename(host), data, 0600); err != nil {
+		return err
+	}
+	return p.cache.Set(host, cert)
+}
+
+// Delete the Host certificate from the cache and the disk
+func (p *DiskProvider) Delete(host string) error {
+	host = strings.TrimSpace(host)
+	_ = p.cache.Delete(host)
+	err := os.Remove(p.filename(host))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// load and validate a certificate file
+func (p *DiskProvider) load(filename string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := Leaf(&cert)
+	if err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("cert expired")
+	}
+	if err = leaf.CheckSignatureFrom(p.ca); err != nil {
+		return nil, fmt.Errorf("cert signed by a different CA: %v", err)
+	}
+	return &cert, nil
+}
+
+// purge removes the invalid certificates of the directory
+func (p *DiskProvider) purge() error {
+	files, err := filepath.Glob(filepath.Join(p.dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, filename := range files {
+		if _, err = p.load(filename); err != nil {
+			_ = os.Remove(filename)
+		}
+	}
+	return nil
+}
+
+// filename returns the file of the Host certificate
+func (p *DiskProvider) filename(host string) string {
+	name := strings.NewReplacer(
+		"*", "_wildcard",
+		":", "_",
+		"/", "_",
+		"\\", "_",
+	).Replace(strings.ToLower(host))
+	return filepath.Join(p.dir, name+".pem")
+}
+
+// EncodeCertificate encodes the certificate chain and the private key in PEM format
+func EncodeCertificate(cert *tls.Certificate) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, der := range cert.Certificate {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+			return nil, err
+		}
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if err = pem.Encode(&buf, &pem.Block{Type: "PRIVATE KEY", Bytes: key}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
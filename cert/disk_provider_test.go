@@ -0,0 +1,89 @@
+package cert
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskProvider_Reload(t *testing.T) {
+	dir := t.TempDir()
+	asserts := assert.New(t)
+
+	p, err := NewDiskProvider(dir, DefaultCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt := newTestLeaf(t, DefaultCertificate, "*.example.com", time.Now().Add(time.Hour))
+	asserts.NoError(p.Set("*.example.com", crt))
+	asserts.FileExists(filepath.Join(dir, "_wildcard.example.com.pem"))
+
+	// a new provider reloads the certificate from the disk after a restart
+	p, err = NewDiskProvider(dir, DefaultCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Get("*.example.com")
+	asserts.NoError(err)
+	if asserts.NotNil(got) {
+		asserts.Equal(crt.Certificate, got.Certificate)
+	}
+
+	asserts.NoError(p.Delete("*.example.com"))
+	asserts.NoFileExists(filepath.Join(dir, "_wildcard.example.com.pem"))
+	_, err = p.Get("*.example.com")
+	asserts.Error(err)
+	asserts.NoError(p.Delete("*.example.com"), "deleting a missing certificate is not an error")
+}
+
+func TestDiskProvider_DiscardInvalid(t *testing.T) {
+	dir := t.TempDir()
+	otherCA, err := GenerateCA(CAOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(host string, data []byte) string {
+		filename := filepath.Join(dir, host+".pem")
+		if err := os.WriteFile(filename, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	encode := func(host string, ca tls.Certificate, notAfter time.Time) []byte {
+		data, err := EncodeCertificate(newTestLeaf(t, ca, host, notAfter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	valid := write("valid.com", encode("valid.com", DefaultCertificate, time.Now().Add(time.Hour)))
+	expired := write("expired.com", encode("expired.com", DefaultCertificate, time.Now().Add(-time.Minute)))
+	foreign := write("foreign.com", encode("foreign.com", otherCA, time.Now().Add(time.Hour)))
+	corrupted := write("corrupted.com", []byte("not a certificate"))
+
+	p, err := NewDiskProvider(dir, DefaultCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asserts := assert.New(t)
+	asserts.FileExists(valid)
+	asserts.NoFileExists(expired, "the expired certificates should be discarded")
+	asserts.NoFileExists(foreign, "the certificates of a different CA should be discarded")
+	asserts.NoFileExists(corrupted)
+	_, err = p.Get("valid.com")
+	asserts.NoError(err)
+	_, err = p.Get("foreign.com")
+	asserts.Error(err)
+
+	// a certificate of a different CA written after the start is discarded on Get
+	foreign = write("foreign.com", encode("foreign.com", otherCA, time.Now().Add(time.Hour)))
+	_, err = p.Get("foreign.com")
+	asserts.Error(err)
+	asserts.NoFileExists(foreign)
+}
@@ -0,0 +1,146 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"text/template"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ExportPEM exports the certificate in PEM format, e.g. ca.crt or ca.pem
+func ExportPEM(cert tls.Certificate) []byte {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+}
+
+// ExportDER exports the certificate in DER format, e.g. ca.cer for Windows and Android
+func ExportDER(cert tls.Certificate) []byte {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+	return append([]byte(nil), cert.Certificate[0]...)
+}
+
+// ExportPKCS12 exports the certificate and its private key as a PKCS#12 bundle (.p12) protected by password.
+// The legacy encryption is used, as it is the only one supported by all the browsers and devices.
+func ExportPKCS12(cert tls.Certificate, password string) ([]byte, error) {
+	leaf, err := Leaf(&cert)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	for _, der := range cert.Certificate[1:] {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+	return pkcs12.Legacy.Encode(cert.PrivateKey, leaf, chain, password)
+}
+
+// ExportMobileConfig exports the certificate as an Apple configuration profile (.mobileconfig),
+// which installs it as a root certificate on iOS and macOS.
+// The private key is not included.
+func ExportMobileConfig(cert tls.Certificate, displayName string) ([]byte, error) {
+	leaf, err := Leaf(&cert)
+	if err != nil {
+		return nil, err
+	}
+	if !leaf.IsCA {
+		return nil, errors.New("not a CA certificate")
+	}
+	if displayName == "" {
+		displayName = leaf.Subject.CommonName
+	}
+
+	profileUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	payloadUUID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = mobileConfigTpl.Execute(&buf, map[string]string{
+		"DisplayName": displayName,
+		"CommonName":  leaf.Subject.CommonName,
+		"Content":     base64.StdEncoding.EncodeToString(leaf.Raw),
+		"ProfileUUID": profileUUID,
+		"PayloadUUID": payloadUUID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+var mobileConfigTpl = template.Must(template.New("mobileconfig").Funcs(template.FuncMap{
+	"xml": func(s string) string {
+		var buf bytes.Buffer
+		_ = xml.EscapeText(&buf, []byte(s))
+		return buf.String()
+	},
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>{{xml .CommonName}}.cer</string>
+			<key>PayloadContent</key>
+			<data>{{.Content}}</data>
+			<key>PayloadDescription</key>
+			<string>Adds a CA root certificate</string>
+			<key>PayloadDisplayName</key>
+			<string>{{xml .CommonName}}</string>
+			<key>PayloadIdentifier</key>
+			<string>com.apple.security.root.{{.PayloadUUID}}</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.PayloadUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{xml .DisplayName}}</string>
+	<key>PayloadIdentifier</key>
+	<string>io.github.mps.{{.ProfileUUID}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,123 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExportPEM(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(ExportPEM(ca))
+	asserts := assert.New(t)
+	if asserts.NotNil(block) {
+		asserts.Equal("CERTIFICATE", block.Type)
+		asserts.Equal(ca.Certificate[0], block.Bytes)
+	}
+	asserts.Empty(rest)
+}
+
+func TestExportDER(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(ExportDER(ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, crt.Equal(ca.Leaf))
+}
+
+func TestExportPKCS12(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := newTestLeaf(t, ca, "a.com", time.Now().Add(time.Hour))
+
+	data, err := ExportPKCS12(*leaf, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, crt, chain, err := pkcs12.DecodeChain(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	asserts := assert.New(t)
+	asserts.Equal(leaf.Certificate[0], crt.Raw)
+	asserts.Equal(leaf.PrivateKey, key)
+	if asserts.Len(chain, 1) {
+		asserts.True(chain[0].Equal(ca.Leaf))
+	}
+
+	_, _, _, err = pkcs12.DecodeChain(data, "wrong")
+	asserts.Error(err, "the bundle should be protected by the password")
+}
+
+func TestExportMobileConfig(t *testing.T) {
+	ca, err := GenerateCA(CAOptions{KeyType: KeyTypeECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ExportMobileConfig(ca, "mps <test> & co")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the profile must be a well-formed plist
+	var (
+		strs  []string
+		datas []string
+		elem  string
+	)
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			elem = tok.Name.Local
+		case xml.CharData:
+			switch elem {
+			case "string":
+				strs = append(strs, string(tok))
+			case "data":
+				datas = append(datas, string(tok))
+			}
+		case xml.EndElement:
+			elem = ""
+		}
+	}
+
+	asserts := assert.New(t)
+	asserts.Contains(strs, "mps <test> & co")
+	asserts.Contains(strs, "com.apple.security.root")
+	if asserts.Len(datas, 1) {
+		der, err := base64.StdEncoding.DecodeString(datas[0])
+		asserts.NoError(err)
+		asserts.Equal(ca.Certificate[0], der)
+	}
+	asserts.NotContains(string(data), "PRIVATE KEY")
+
+	// only a CA can be installed as a root certificate
+	_, err = ExportMobileConfig(*newTestLeaf(t, ca, "a.com", time.Now().Add(time.Hour)), "")
+	asserts.Error(err)
+}
@@ -0,0 +1,113 @@
+package cert
+
+import (
+	"container/list"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultLRUCapacity is the default number of certificates kept by a LRUProvider
+	DefaultLRUCapacity = 1024
+	// DefaultLRUTTL is the default duration a certificate is kept by a LRUProvider
+	DefaultLRUTTL = 24 * time.Hour
+)
+
+// LRUProvider A bounded in-memory certificate cache.
+// The least recently used certificates are evicted when the capacity is reached,
+// and the certificates expire after the TTL or when the leaf certificate is no longer valid.
+type LRUProvider struct {
+	capacity int
+	ttl      time.Duration
+	mu       sync.Mutex
+	ll       *list.List
+	cache    map[string]*list.Element
+}
+
+type lruEntry struct {
+	host     string
+	cert     *tls.Certificate
+	expireAt time.Time
+}
+
+// NewLRUProvider Create a LRUProvider.
+// A capacity <= 0 means no limit, a ttl <= 0 means the certificates only expire with the leaf certificate.
+func NewLRUProvider(capacity int, ttl time.Duration) *LRUProvider {
+	return &LRUProvider{
+		capacity: capacity,
+		ttl:      ttl,
+		ll:       list.New(),
+		cache:    make(map[string]*list.Element),
+	}
+}
+
+// Get the certificate for the Host from the cache
+func (p *LRUProvider) Get(host string) (*tls.Certificate, error) {
+	host = strings.TrimSpace(host)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	el, ok := p.cache[host]
+	if !ok {
+		return nil, fmt.Errorf("cert not exist")
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expireAt) {
+		p.removeElement(el)
+		return nil, fmt.Errorf("cert expired")
+	}
+	p.ll.MoveToFront(el)
+	return entry.cert, nil
+}
+
+// Set the Host certificate to the cache
+func (p *LRUProvider) Set(host string, cert *tls.Certificate) error {
+	host = strings.TrimSpace(host)
+
+	leaf, err := Leaf(cert)
+	if err != nil {
+		return err
+	}
+	expireAt := leaf.NotAfter
+	if p.ttl > 0 && time.Now().Add(p.ttl).Before(expireAt) {
+		expireAt = time.Now().Add(p.ttl)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if el, ok := p.cache[host]; ok {
+		el.Value = &lruEntry{host: host, cert: cert, expireAt: expireAt}
+		p.ll.MoveToFront(el)
+		return nil
+	}
+	p.cache[host] = p.ll.PushFront(&lruEntry{host: host, cert: cert, expireAt: expireAt})
+	if p.capacity > 0 && p.ll.Len() > p.capacity {
+		p.removeElement(p.ll.Back())
+	}
+	return nil
+}
+
+// Delete the Host certificate from the cache
+func (p *LRUProvider) Delete(host string) error {
+	p.mu.Lock()
+	if el, ok := p.cache[strings.TrimSpace(host)]; ok {
+		p.removeElement(el)
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// Len returns the number of certificates in the cache
+func (p *LRUProvider) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ll.Len()
+}
+
+func (p *LRUProvider) removeElement(el *list.Element) {
+	p.ll.Remove(el)
+	delete(p.cache, el.Value.(*lruEntry).host)
+}
@@ -0,0 +1,93 @@
+package cert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestLeaf issues a leaf certificate for host signed by ca, valid until notAfter
+func newTestLeaf(t *testing.T, ca tls.Certificate, host string, notAfter time.Time) *tls.Certificate {
+	t.Helper()
+	caLeaf, err := Leaf(&ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notAfter.Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, caLeaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, ca.Certificate[0]}, PrivateKey: key}
+}
+
+func TestLRUProvider_Eviction(t *testing.T) {
+	p := NewLRUProvider(2, 0)
+	notAfter := time.Now().Add(time.Hour)
+	a := newTestLeaf(t, DefaultCertificate, "a.com", notAfter)
+	b := newTestLeaf(t, DefaultCertificate, "b.com", notAfter)
+	c := newTestLeaf(t, DefaultCertificate, "c.com", notAfter)
+
+	asserts := assert.New(t)
+	asserts.NoError(p.Set("a.com", a))
+	asserts.NoError(p.Set("b.com", b))
+	// a.com becomes the most recently used
+	got, err := p.Get("a.com")
+	asserts.NoError(err)
+	asserts.Same(a, got)
+
+	asserts.NoError(p.Set("c.com", c))
+	asserts.Equal(2, p.Len())
+	_, err = p.Get("b.com")
+	asserts.Error(err, "the least recently used certificate should be evicted")
+	_, err = p.Get("a.com")
+	asserts.NoError(err)
+	_, err = p.Get("c.com")
+	asserts.NoError(err)
+
+	asserts.NoError(p.Delete("a.com"))
+	_, err = p.Get("a.com")
+	asserts.Error(err)
+	asserts.Equal(1, p.Len())
+}
+
+func TestLRUProvider_TTL(t *testing.T) {
+	p := NewLRUProvider(0, 50*time.Millisecond)
+	asserts := assert.New(t)
+	asserts.NoError(p.Set("a.com", newTestLeaf(t, DefaultCertificate, "a.com", time.Now().Add(time.Hour))))
+	_, err := p.Get("a.com")
+	asserts.NoError(err)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = p.Get("a.com")
+	asserts.Error(err, "the certificate should expire after the TTL")
+	asserts.Equal(0, p.Len())
+}
+
+func TestLRUProvider_ExpiredLeaf(t *testing.T) {
+	p := NewLRUProvider(0, time.Hour)
+	asserts := assert.New(t)
+	asserts.NoError(p.Set("a.com", newTestLeaf(t, DefaultCertificate, "a.com", time.Now().Add(-time.Minute))))
+	_, err := p.Get("a.com")
+	asserts.Error(err, "the certificate should expire with the leaf")
+}
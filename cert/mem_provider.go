@@ -12,22 +12,25 @@ var DefaultMemProvider = NewMemProvider()
 // MemProvider A simple in-memory certificate cache
 type MemProvider struct {
 	cache map[string]*tls.Certificate
-	rw sync.RWMutex
+	rw    sync.RWMutex
 }
 
 // Create a MemProvider
 func NewMemProvider() *MemProvider {
 	return &MemProvider{
 		cache: make(map[string]*tls.Certificate),
-		rw: sync.RWMutex{},
+		rw:    sync.RWMutex{},
 	}
 }
 
 // Get the certificate for the Host from the cache
 func (m *MemProvider) Get(host string) (cert *tls.Certificate, err error) {
 	var ok bool
+	m.rw.RLock()
 	cert, ok = m.cache[strings.TrimSpace(host)]
-	if !ok {
+	m.rw.RUnlock()
+	if !ok || IsExpired(cert) {
+		cert = nil
 		err = fmt.Errorf("cert not exist")
 	}
 	return
@@ -0,0 +1,301 @@
+package mps
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnKind is the kind of a hijacked connection
+type ConnKind int
+
+const (
+	// ConnTunnel is a connection tunneled by the TunnelHandler
+	ConnTunnel ConnKind = iota
+	// ConnMitm is a connection decrypted by the MitmHandler
+	ConnMitm
+	// ConnWebsocket is a connection relayed by the WebsocketHandler
+	ConnWebsocket
+)
+
+// shutdownPollInterval is how often the ConnTracker checks for idle connections during Shutdown
+const shutdownPollInterval = 100 * time.Millisecond
+
+// ConnStats is the number of active hijacked connections
+type ConnStats struct {
+	Tunnels    int64
+	Mitm       int64
+	Websockets int64
+}
+
+// ConnTracker tracks the connections hijacked by the handlers,
+// which are invisible to http.Server.Shutdown.
+// Set it on the Context shared by the handlers.
+type ConnTracker struct {
+	// QuietPeriod is the duration without traffic after which a tunnel or a websocket
+	// is considered idle during Shutdown. Their exchanges are opaque, so with a zero
+	// QuietPeriod they are only closed when the context of Shutdown is done.
+	QuietPeriod time.Duration
+
+	mu           sync.Mutex
+	conns        map[*trackedConn]struct{}
+	counters     [3]atomic.Int64
+	shuttingDown atomic.Bool
+}
+
+// NewConnTracker Create a ConnTracker
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		conns: make(map[*trackedConn]struct{}),
+	}
+}
+
+// Track registers a hijacked connection, it is untracked when closed.
+// The returned connection must be used instead of conn.
+func (t *ConnTracker) Track(conn net.Conn, kind ConnKind) net.Conn {
+	return t.track(conn, kind)
+}
+
+func (t *ConnTracker) track(conn net.Conn, kind ConnKind) *trackedConn {
+	tc := &trackedConn{Conn: conn, tracker: t, kind: kind}
+	// The exchange is in-flight until the handler says otherwise
+	tc.active.Store(1)
+	tc.lastActive.Store(time.Now().UnixNano())
+	t.mu.Lock()
+	t.conns[tc] = struct{}{}
+	t.mu.Unlock()
+	t.counters[kind].Add(1)
+	return tc
+}
+
+// Stats returns the number of active connections of each kind
+func (t *ConnTracker) Stats() ConnStats {
+	return ConnStats{
+		Tunnels:    t.counters[ConnTunnel].Load(),
+		Mitm:       t.counters[ConnMitm].Load(),
+		Websockets: t.counters[ConnWebsocket].Load(),
+	}
+}
+
+// Len returns the number of active connections
+func (t *ConnTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+// ShuttingDown reports whether Shutdown has been called
+func (t *ConnTracker) ShuttingDown() bool {
+	return t.shuttingDown.Load()
+}
+
+// Shutdown closes the idle connections, and waits for the in-flight exchanges to complete.
+// The HTTP/2 MITM connections are sent a GOAWAY frame and closed once their streams are done.
+// The tunnels and the websockets are closed after QuietPeriod without traffic.
+// When ctx is done, the remaining connections are closed and ctx.Err() is returned.
+func (t *ConnTracker) Shutdown(ctx context.Context) error {
+	t.shuttingDown.Store(true)
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if t.closeIdle() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			t.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close force-closes all the connections
+func (t *ConnTracker) Close() {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for tc := range t.conns {
+		conns = append(conns, tc)
+	}
+	t.mu.Unlock()
+	for _, tc := range conns {
+		_ = tc.Close()
+	}
+}
+
+// closeIdle closes the idle connections, it reports whether all the connections are closed
+func (t *ConnTracker) closeIdle() bool {
+	t.mu.Lock()
+	var idle, draining []*trackedConn
+	for tc := range t.conns {
+		if tc.drainer() != nil {
+			draining = append(draining, tc)
+		} else if tc.idle() {
+			idle = append(idle, tc)
+		}
+	}
+	empty := len(t.conns) == len(idle)
+	t.mu.Unlock()
+
+	// The draining connections close themselves when their exchanges are done
+	for _, tc := range draining {
+		tc.drainOnce.Do(tc.drainer())
+	}
+	for _, tc := range idle {
+		_ = tc.Close()
+	}
+	return empty
+}
+
+func (t *ConnTracker) untrack(tc *trackedConn) {
+	t.mu.Lock()
+	_, ok := t.conns[tc]
+	delete(t.conns, tc)
+	t.mu.Unlock()
+	if ok {
+		t.counters[tc.kind].Add(-1)
+	}
+}
+
+// trackedConn is a hijacked connection registered with a ConnTracker
+type trackedConn struct {
+	net.Conn
+	tracker *ConnTracker
+	kind    ConnKind
+	// active is the number of in-flight exchanges, the connection is idle when zero
+	active atomic.Int32
+	// lastActive is the time of the last read or write, in nanoseconds
+	lastActive atomic.Int64
+
+	mu     sync.Mutex
+	peers  []io.Closer
+	closed bool
+	// drain stops the connection gracefully on Shutdown, instead of closing it when idle
+	drain     func()
+	drainOnce sync.Once
+}
+
+func (tc *trackedConn) Read(b []byte) (n int, err error) {
+	n, err = tc.Conn.Read(b)
+	if n > 0 {
+		tc.lastActive.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+func (tc *trackedConn) Write(b []byte) (n int, err error) {
+	n, err = tc.Conn.Write(b)
+	if n > 0 {
+		tc.lastActive.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+// begin marks the start of an exchange
+func (tc *trackedConn) begin() {
+	if tc != nil {
+		tc.active.Add(1)
+	}
+}
+
+// end marks the end of an exchange
+func (tc *trackedConn) end() {
+	if tc != nil {
+		tc.active.Add(-1)
+	}
+}
+
+// shuttingDown reports whether the connection should not start new exchanges
+func (tc *trackedConn) shuttingDown() bool {
+	return tc != nil && tc.tracker.ShuttingDown()
+}
+
+func (tc *trackedConn) idle() bool {
+	if tc.active.Load() <= 0 {
+		return true
+	}
+	// The exchanges of the tunnels and the websockets are unknown, they are idle without traffic
+	quiet := tc.tracker.QuietPeriod
+	return quiet > 0 && tc.kind != ConnMitm &&
+		time.Since(time.Unix(0, tc.lastActive.Load())) >= quiet
+}
+
+// onShutdown sets the function stopping the connection gracefully on Shutdown,
+// e.g. sending a GOAWAY frame on a HTTP/2 connection
+func (tc *trackedConn) onShutdown(drain func()) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	tc.drain = drain
+	tc.mu.Unlock()
+}
+
+func (tc *trackedConn) drainer() func() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.drain
+}
+
+// attach a peer connection, e.g. the upstream connection, which is closed with the connection
+func (tc *trackedConn) attach(peer io.Closer) {
+	if tc == nil {
+		return
+	}
+	tc.mu.Lock()
+	closed := tc.closed
+	if !closed {
+		tc.peers = append(tc.peers, peer)
+	}
+	tc.mu.Unlock()
+	if closed {
+		_ = peer.Close()
+	}
+}
+
+// NetConn returns the underlying connection
+func (tc *trackedConn) NetConn() net.Conn {
+	return tc.Conn
+}
+
+func (tc *trackedConn) Close() error {
+	tc.mu.Lock()
+	if tc.closed {
+		tc.mu.Unlock()
+		return nil
+	}
+	tc.closed = true
+	peers := tc.peers
+	tc.peers = nil
+	tc.mu.Unlock()
+
+	tc.tracker.untrack(tc)
+	err := tc.Conn.Close()
+	for _, peer := range peers {
+		_ = peer.Close()
+	}
+	return err
+}
+
+// trackConn registers the hijacked connection with the ConnTracker of the Context, if any
+func (ctx *Context) trackConn(conn net.Conn, kind ConnKind) net.Conn {
+	if ctx.ConnTracker == nil {
+		return conn
+	}
+	return ctx.ConnTracker.track(conn, kind)
+}
+
+// trackedOf returns the tracked connection underlying conn, or nil
+func trackedOf(conn net.Conn) *trackedConn {
+	switch c := conn.(type) {
+	case *trackedConn:
+		return c
+	case connWrapper:
+		return trackedOf(c.NetConn())
+	}
+	return nil
+}
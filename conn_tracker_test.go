@@ -0,0 +1,263 @@
+package mps
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps/cert"
+	"golang.org/x/net/http2"
+)
+
+// create a test TCP server that echoes every connection
+func newTestEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// serve the proxy on a local listener
+func newTestProxyServer(t *testing.T, proxy *HttpProxy) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = proxy.Serve(l)
+	}()
+	return l
+}
+
+// open a CONNECT tunnel to target through the proxy
+func connectTunnel(t *testing.T, proxyAddr, target string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+target, nil)
+	req.Host = target
+	_ = req.Write(conn)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	return conn, br
+}
+
+func echo(conn net.Conn, br *bufio.Reader, message string) (string, error) {
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, len(message))
+	_, err := io.ReadFull(br, buf)
+	return string(buf), err
+}
+
+func TestHttpProxy_Shutdown(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	proxy := NewHttpProxy()
+	l := newTestProxyServer(t, proxy)
+
+	conn, br := connectTunnel(t, l.Addr().String(), echoSrv.Addr().String())
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(ConnStats{Tunnels: 1}, proxy.ConnStats())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.Shutdown(ctx)
+	}()
+
+	// The in-flight tunnel is drained, no more connections are accepted
+	time.Sleep(2 * shutdownPollInterval)
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the tunnel was closed: %v", err)
+	default:
+	}
+	reply, err := echo(conn, br, "ping")
+	asserts.NoError(err)
+	asserts.Equal("ping", reply)
+	_, err = net.Dial("tcp", l.Addr().String())
+	asserts.Error(err, "the listener should be closed")
+
+	_ = conn.Close()
+	select {
+	case err = <-done:
+		asserts.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown didn't return when the tunnel was closed")
+	}
+	asserts.Equal(ConnStats{}, proxy.ConnStats())
+	asserts.ErrorIs(proxy.Serve(l), http.ErrServerClosed)
+}
+
+func TestHttpProxy_ShutdownDeadline(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	proxy := NewHttpProxy()
+	l := newTestProxyServer(t, proxy)
+
+	conn, br := connectTunnel(t, l.Addr().String(), echoSrv.Addr().String())
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*shutdownPollInterval)
+	defer cancel()
+	err := proxy.Shutdown(ctx)
+
+	asserts := assert.New(t)
+	asserts.ErrorIs(err, context.DeadlineExceeded)
+	asserts.Equal(ConnStats{}, proxy.ConnStats())
+
+	// The tunnel has been force-closed
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = br.ReadByte()
+	asserts.ErrorIs(err, io.EOF)
+}
+
+func TestHttpProxy_ShutdownIdleMitm(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello mitm"))
+	}))
+	defer srv.Close()
+
+	proxy := NewHttpProxy()
+	proxy.Transport().TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.ConnectDecision = func(req *http.Request) ConnectAction {
+		return ConnectMitm
+	}
+	l := newTestProxyServer(t, proxy)
+
+	client := newMitmTestClient("http://" + l.Addr().String())
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal("hello mitm", string(body))
+	asserts.Equal(ConnStats{Mitm: 1}, proxy.ConnStats())
+
+	// The kept-alive connection is idle, it is closed right away
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	asserts.NoError(proxy.Shutdown(ctx))
+	asserts.Less(time.Since(start), time.Second)
+	asserts.Equal(ConnStats{}, proxy.ConnStats())
+}
+
+func TestHttpProxy_ShutdownQuietTunnel(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	proxy := NewHttpProxy()
+	proxy.Ctx.ConnTracker.QuietPeriod = 2 * shutdownPollInterval
+	l := newTestProxyServer(t, proxy)
+
+	conn, br := connectTunnel(t, l.Addr().String(), echoSrv.Addr().String())
+	defer conn.Close()
+	reply, err := echo(conn, br, "ping")
+
+	asserts := assert.New(t)
+	asserts.NoError(err)
+	asserts.Equal("ping", reply)
+
+	// The tunnel without traffic is closed before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	asserts.NoError(proxy.Shutdown(ctx))
+	asserts.Less(time.Since(start), time.Second)
+	asserts.Equal(ConnStats{}, proxy.ConnStats())
+}
+
+func TestHttpProxy_ShutdownHTTP2Mitm(t *testing.T) {
+	proxy := NewHttpProxy()
+	proxy.MitmHandler.(*MitmHandler).EnableHTTP2 = true
+	proxy.ConnectDecision = func(req *http.Request) ConnectAction {
+		return ConnectMitm
+	}
+	l := newTestProxyServer(t, proxy)
+
+	conn, _ := connectTunnel(t, l.Addr().String(), "example.com:443")
+	defer conn.Close()
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(cert.CertPEM))
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    pool,
+		NextProtos: []string{http2.NextProtoTLS},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = tlsConn.Write([]byte(http2.ClientPreface))
+	framer := http2.NewFramer(tlsConn, tlsConn)
+	_ = framer.WriteSettings()
+	// The server is ready once it has sent its settings
+	if _, err := framer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.Shutdown(ctx)
+	}()
+
+	// The client is told to stop opening streams before the connection is closed
+	var goAway *http2.GoAwayFrame
+	_ = tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for goAway == nil {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("connection closed without GOAWAY: %v", err)
+		}
+		if f, ok := frame.(*http2.SettingsFrame); ok && !f.IsAck() {
+			_ = framer.WriteSettingsAck()
+		}
+		goAway, _ = frame.(*http2.GoAwayFrame)
+	}
+
+	asserts := assert.New(t)
+	asserts.Equal(http2.ErrCodeNo, goAway.ErrCode)
+	_ = tlsConn.Close()
+	asserts.NoError(<-done)
+	asserts.Equal(ConnStats{}, proxy.ConnStats())
+}
@@ -0,0 +1,131 @@
+package mps
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// connectResponseWriter is the http.ResponseWriter of a synthesized CONNECT request,
+// for the clients which don't speak HTTP (e.g. SOCKS5, transparent proxy).
+// The HTTP response of the ConnectHandler is converted by the reply function.
+type connectResponseWriter struct {
+	conn        *connectConn
+	header      http.Header
+	wroteHeader bool
+	hijacked    bool
+}
+
+// newConnectResponseWriter returns a connectResponseWriter for the client connection.
+// reply is called once with the status code of the CONNECT response.
+func newConnectResponseWriter(conn net.Conn, reply func(conn net.Conn, statusCode int) error) *connectResponseWriter {
+	return &connectResponseWriter{
+		conn:   &connectConn{Conn: conn, replyFunc: reply},
+		header: make(http.Header),
+	}
+}
+
+func (rw *connectResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *connectResponseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	_ = rw.conn.reply(statusCode)
+}
+
+func (rw *connectResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	// The response body can't be delivered to the client
+	return len(b), nil
+}
+
+func (rw *connectResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.wroteHeader {
+		return nil, nil, http.ErrHijacked
+	}
+	rw.hijacked = true
+	brw := bufio.NewReadWriter(bufio.NewReader(rw.conn), bufio.NewWriter(rw.conn))
+	return rw.conn, brw, nil
+}
+
+// replied reports whether the reply has been sent to the client
+func (rw *connectResponseWriter) replied() bool {
+	rw.conn.mu.Lock()
+	defer rw.conn.mu.Unlock()
+	return rw.conn.replied
+}
+
+// connectConn converts the HTTP tunnel response written by the ConnectHandler
+// (e.g. "HTTP/1.0 200 Connection Established") with the reply function.
+type connectConn struct {
+	net.Conn
+	mu        sync.Mutex
+	replyFunc func(conn net.Conn, statusCode int) error
+	replied   bool
+	// the partial HTTP response header
+	head []byte
+}
+
+func (c *connectConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.head = append(c.head, b...)
+	end := bytes.Index(c.head, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(c.head) > 4096 {
+			return 0, fmt.Errorf("tunnel response header too long")
+		}
+		return len(b), nil
+	}
+
+	// status line: HTTP/1.1 200 Connection Established
+	statusCode := 0
+	if line := bytes.Fields(c.head[:end]); len(line) >= 2 {
+		statusCode, _ = strconv.Atoi(string(line[1]))
+	}
+	if err := c.replyLocked(statusCode); err != nil {
+		return 0, err
+	}
+	if statusCode < 200 || statusCode > 299 {
+		_ = c.Conn.Close()
+		return 0, fmt.Errorf("tunnel failed with status %d", statusCode)
+	}
+
+	// the remaining bytes belong to the tunnel
+	if rest := c.head[end+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.head = nil
+	return len(b), nil
+}
+
+// reply sends the reply matching the status code to the client
+func (c *connectConn) reply(statusCode int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.replyLocked(statusCode)
+}
+
+func (c *connectConn) replyLocked(statusCode int) error {
+	if c.replied {
+		return nil
+	}
+	c.replied = true
+	return c.replyFunc(c.Conn, statusCode)
+}
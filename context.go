@@ -4,8 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 )
 
@@ -16,6 +19,8 @@ var (
 	MethodNotSupportErr = errors.New("request method not support")
 	// http request is websocket
 	RequestWebsocketUpgradeErr = errors.New("websocket upgrade")
+	// the middleware asks to reset the client connection
+	ConnectionResetErr = errors.New("connection reset")
 )
 
 // Context for the request
@@ -44,6 +49,28 @@ type Context struct {
 	// present in the http.Response before proxying
 	KeepDestinationHeaders bool
 
+	// BufferResponse indicates that the handler should read the whole response body
+	// before writing it to the client, and reset the Content-Length.
+	// By default, the response body is streamed to the client as it arrives.
+	// A middleware that needs the full body can set it on the request Context.
+	BufferResponse bool
+
+	// ConnTracker tracks the connections hijacked by the handlers, for a graceful shutdown.
+	// If nil, the connections are not tracked.
+	ConnTracker *ConnTracker
+
+	// BandwidthLimiter shapes the traffic and enforces the daily quotas.
+	// If nil, the bandwidth is unlimited.
+	BandwidthLimiter *BandwidthLimiter
+
+	// values are the values of the request set by the middlewares
+	valuesMu sync.RWMutex
+	values   map[string]interface{}
+
+	// upstreamBody is the response body returned by the Transport.
+	// It is used to detect whether a middleware has replaced the response body.
+	upstreamBody io.ReadCloser
+
 	// middlewares ACTS on Request and Response.
 	// It's going to be reused by the Context
 	// mi is the index subscript of the middlewares traversal
@@ -75,6 +102,7 @@ func NewContext() *Context {
 		KeepProxyHeaders:       false,
 		KeepClientHeaders:      false,
 		KeepDestinationHeaders: false,
+		BufferResponse:         false,
 		mi:                     -1,
 		middlewares:            make([]Middleware, 0),
 	}
@@ -138,7 +166,11 @@ func (ctx *Context) Next(req *http.Request) (*http.Response, error) {
 			// explicitly discard request body to avoid data races in certain RoundTripper implementations
 			// see https://github.com/golang/go/issues/61596#issuecomment-1652345131
 			defer req.Body.Close()
-			return ctx.RoundTrip(req)
+			resp, err := ctx.RoundTrip(req)
+			if err == nil {
+				ctx.upstreamBody = resp.Body
+			}
+			return resp, err
 		}()
 	}
 
@@ -167,10 +199,27 @@ func (ctx *Context) RoundTrip(req *http.Request) (*http.Response, error) {
 		RemoveProxyHeaders(req)
 	}
 
-	if ctx.Transport != nil {
-		return ctx.Transport.RoundTrip(req)
+	tr := ctx.Transport
+	if tr == nil {
+		tr = DefaultTransport
 	}
-	return DefaultTransport.RoundTrip(req)
+
+	var u *url.URL
+	if tr.Proxy != nil {
+		var err error
+		if u, err = tr.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+	if dst, ok := originalDstOf(req); ok {
+		// The requests of a transparent connection go to its original destination
+		tr = originalDstTransport(tr, u, dst)
+	} else if u != nil && isSocksProxy(u) {
+		// The SOCKS upstream proxy is dialed by mps,
+		// http.Transport only knows the HTTP proxies.
+		tr = socksTransport(tr, u)
+	}
+	return tr.RoundTrip(req)
 }
 
 // WithRequest get the Context of the request
@@ -182,12 +231,63 @@ func (ctx *Context) WithRequest(req *http.Request) *Context {
 		KeepProxyHeaders:       ctx.KeepProxyHeaders,
 		KeepClientHeaders:      ctx.KeepClientHeaders,
 		KeepDestinationHeaders: ctx.KeepDestinationHeaders,
+		BufferResponse:         ctx.BufferResponse,
 		Transport:              ctx.Transport,
+		ConnTracker:            ctx.ConnTracker,
+		BandwidthLimiter:       ctx.BandwidthLimiter,
 		mi:                     -1,
 		middlewares:            ctx.middlewares,
 	}
 }
 
+// Set stores a value in the Context of the request, e.g. for the logging middlewares
+func (ctx *Context) Set(key string, value interface{}) {
+	ctx.valuesMu.Lock()
+	defer ctx.valuesMu.Unlock()
+	if ctx.values == nil {
+		ctx.values = make(map[string]interface{})
+	}
+	ctx.values[key] = value
+}
+
+// Get returns the value stored in the Context of the request
+func (ctx *Context) Get(key string) (value interface{}, ok bool) {
+	ctx.valuesMu.RLock()
+	defer ctx.valuesMu.RUnlock()
+	value, ok = ctx.values[key]
+	return
+}
+
+// WrapResponseBody replaces resp.Body with the body returned by wrap.
+// The wrapper must not change the length of the body, so that the response
+// can still be streamed to the client with its original Content-Length.
+// Middleware that replaces the body with different content should assign
+// resp.Body directly instead, the handler then buffers it to reset the Content-Length.
+func (ctx *Context) WrapResponseBody(resp *http.Response, wrap func(body io.ReadCloser) io.ReadCloser) {
+	trusted := resp.Body == ctx.upstreamBody
+	resp.Body = wrap(resp.Body)
+	if trusted {
+		ctx.upstreamBody = resp.Body
+	}
+}
+
+// TrustResponseBody declares that the body set by the middleware matches resp.ContentLength,
+// e.g. a response served from a cache, so that it is streamed to the client instead of being buffered.
+func (ctx *Context) TrustResponseBody(resp *http.Response) {
+	ctx.upstreamBody = resp.Body
+}
+
+// shouldBuffer reports whether the response body must be read completely
+// before it is written to the client.
+func (ctx *Context) shouldBuffer(resp *http.Response) bool {
+	if ctx.BufferResponse {
+		return true
+	}
+	// A middleware has replaced the response body,
+	// the Content-Length may no longer match the body.
+	return resp.Body != ctx.upstreamBody && resp.ContentLength >= 0
+}
+
 // ResetClientHeaders These Headers must be reset when a client Request is issued to reuse a Request
 func ResetClientHeaders(r *http.Request) {
 	// this must be reset when serving a request with the client
@@ -1,11 +1,9 @@
 package mps
 
 import (
-	"bytes"
-	"io"
+	"errors"
 	"net/http"
 	"net/http/httputil"
-	"strconv"
 
 	"github.com/telanflow/mps/pool"
 )
@@ -34,35 +32,35 @@ func NewForwardHandlerWithContext(ctx *Context) *ForwardHandler {
 
 // Standard net/http function. You can use it alone
 func (forward *ForwardHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	limits := forward.Ctx.BandwidthLimiter.limits(req.Context(), req)
+	if limits.exhausted() {
+		http.Error(rw, BandwidthQuotaExceededErr.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if req.ContentLength != 0 {
+		req.Body = limits.readCloser(req.Body)
+	}
+
 	// Copying a Context preserves the Transport, Middleware
 	ctx := forward.Ctx.WithRequest(req)
 	resp, err := ctx.Next(req)
+	if errors.Is(err, ConnectionResetErr) {
+		resetClient(rw)
+		return
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), 502)
 		return
 	}
 	defer resp.Body.Close()
+	ctx.WrapResponseBody(resp, limits.readCloser)
 
-	var (
-		// Body buffer
-		buffer = new(bytes.Buffer)
-		// Body size
-		bufferSize int64
-	)
-
-	buf := forward.buffer().Get()
-	bufferSize, err = io.CopyBuffer(buffer, resp.Body, buf)
-	forward.buffer().Put(buf)
+	err = writeResponse(rw, resp, ctx, forward.buffer())
 	if err != nil {
-		http.Error(rw, err.Error(), 502)
-		return
+		// The response has been partially written, abort the connection
+		// so that the client does not mistake it for a complete response.
+		panic(http.ErrAbortHandler)
 	}
-
-	resp.ContentLength = bufferSize
-	resp.Header.Set("Content-Length", strconv.Itoa(int(bufferSize)))
-	copyHeaders(rw.Header(), resp.Header, forward.Ctx.KeepDestinationHeaders)
-	rw.WriteHeader(resp.StatusCode)
-	_, err = buffer.WriteTo(rw)
 }
 
 // Use registers an Middleware to proxy
@@ -1,12 +1,15 @@
 package mps
 
 import (
+	"bytes"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,3 +39,201 @@ func TestNewForwardHandler_ContentLength(t *testing.T) {
 	asserts.Equal(bodySize, contentLength, "Content-Length should be equal "+strconv.Itoa(bodySize))
 	asserts.Equal(int64(bodySize), resp.ContentLength)
 }
+
+func TestForwardHandler_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		_, _ = rw.Write([]byte("data: second\n\n"))
+		rw.Header().Set("X-Checksum", "mps")
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	forwardHandler := NewForwardHandler()
+	proxySrv := httptest.NewServer(forwardHandler)
+	defer proxySrv.Close()
+
+	resp, err := HttpGet(srv.URL, func(r *http.Request) (*url.URL, error) {
+		return url.Parse(proxySrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(int64(-1), resp.ContentLength)
+
+	// The first event must arrive before the upstream finishes the response
+	first := make([]byte, len("data: first\n\n"))
+	_, err = io.ReadFull(resp.Body, first)
+	asserts.NoError(err)
+	asserts.Equal("data: first\n\n", string(first))
+
+	release <- struct{}{}
+	rest, err := io.ReadAll(resp.Body)
+	asserts.NoError(err)
+	asserts.Equal("data: second\n\n", string(rest))
+	asserts.Equal("mps", resp.Trailer.Get("X-Checksum"))
+}
+
+func TestForwardHandler_BufferResponse(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	forwardHandler := NewForwardHandler()
+	forwardHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		ctx.BufferResponse = true
+		return ctx.Next(req)
+	})
+	proxySrv := httptest.NewServer(forwardHandler)
+	defer proxySrv.Close()
+
+	resp, err := HttpGet(srv.URL+"?text=buffered", func(r *http.Request) (*url.URL, error) {
+		return url.Parse(proxySrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	asserts := assert.New(t)
+	asserts.Equal("buffered", string(body))
+	asserts.Equal(int64(len(body)), resp.ContentLength)
+}
+
+func TestForwardHandler_TrustResponseBody(t *testing.T) {
+	// The end of the body is only written once the client has received the beginning
+	head := bytes.Repeat([]byte("x"), 16*1024)
+	pr, pw := io.Pipe()
+	timer := time.AfterFunc(2*time.Second, func() {
+		_ = pw.CloseWithError(errors.New("the response is buffered"))
+	})
+	defer timer.Stop()
+
+	forwardHandler := NewForwardHandler()
+	forwardHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		size := len(head) + 5
+		resp := &http.Response{
+			StatusCode:    200,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Length": []string{strconv.Itoa(size)}},
+			Body:          io.NopCloser(io.MultiReader(bytes.NewReader(head), pr)),
+			ContentLength: int64(size),
+			Request:       req,
+		}
+		ctx.TrustResponseBody(resp)
+		return resp, nil
+	})
+	proxySrv := httptest.NewServer(forwardHandler)
+	defer proxySrv.Close()
+
+	resp, err := HttpGet("http://example.com/", func(r *http.Request) (*url.URL, error) {
+		return url.Parse(proxySrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	_, _ = pw.Write([]byte("hello"))
+	_ = pw.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	asserts := assert.New(t)
+	asserts.NoError(err)
+	asserts.Equal(len(head)+5, len(body))
+	asserts.Equal(int64(len(head)+5), resp.ContentLength)
+}
+
+func TestForwardHandler_ContextValues(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	var logged interface{}
+	forwardHandler := NewForwardHandler()
+	// The first middleware reads the value set by the next one
+	forwardHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		resp, err := ctx.Next(req)
+		logged, _ = ctx.Get("fault")
+		return resp, err
+	})
+	forwardHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		ctx.Set("fault", "latency")
+		return ctx.Next(req)
+	})
+	proxySrv := httptest.NewServer(forwardHandler)
+	defer proxySrv.Close()
+
+	resp, err := HttpGet(srv.URL, func(r *http.Request) (*url.URL, error) {
+		return url.Parse(proxySrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("latency", logged)
+
+	// The values are not shared between the requests
+	_, ok := forwardHandler.Ctx.Get("fault")
+	asserts.False(ok)
+}
+
+// failingReader returns its data, then fails
+type failingReader struct {
+	io.ReadCloser
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestForwardHandler_TruncatedBody(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	forwardHandler := NewForwardHandler()
+	forwardHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		resp, err := ctx.Next(req)
+		if err != nil {
+			return resp, err
+		}
+		ctx.WrapResponseBody(resp, func(body io.ReadCloser) io.ReadCloser {
+			return &failingReader{ReadCloser: body, data: []byte("part")}
+		})
+		return resp, nil
+	})
+	proxySrv := httptest.NewServer(forwardHandler)
+	defer proxySrv.Close()
+
+	resp, err := HttpGet(srv.URL, func(r *http.Request) (*url.URL, error) {
+		return url.Parse(proxySrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The part of the body read before the failure reaches the client
+	body, err := io.ReadAll(resp.Body)
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("part", string(body))
+	asserts.ErrorIs(err, io.ErrUnexpectedEOF)
+}
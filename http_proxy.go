@@ -1,10 +1,23 @@
 package mps
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnectAction is the handling of a CONNECT request chosen by HttpProxy.ConnectDecision
+type ConnectAction int
+
+const (
+	// ConnectTunnel handles the CONNECT request with HandleConnect
+	ConnectTunnel ConnectAction = iota
+	// ConnectMitm handles the CONNECT request with MitmHandler
+	ConnectMitm
 )
 
 // The basic proxy type. Implements http.Handler.
@@ -12,6 +25,17 @@ type HttpProxy struct {
 	// Handles Connect requests use the TunnelHandler by default
 	HandleConnect http.Handler
 
+	// Handles Connect requests when ConnectDecision returns ConnectMitm,
+	// use the MitmHandler by default
+	MitmHandler http.Handler
+
+	// ConnectDecision chooses the handler of each CONNECT request.
+	// If nil, all the CONNECT requests are handled by HandleConnect.
+	ConnectDecision func(req *http.Request) ConnectAction
+
+	// Websocket upgrade requests use the WebsocketHandler by default
+	WebsocketHandler http.Handler
+
 	// HTTP requests use the ForwardHandler by default
 	HttpHandler http.Handler
 
@@ -20,11 +44,17 @@ type HttpProxy struct {
 
 	// Client request Context
 	Ctx *Context
+
+	mu         sync.Mutex
+	servers    map[*http.Server]struct{}
+	inShutdown atomic.Bool
 }
 
 func NewHttpProxy() *HttpProxy {
 	// default Context with Proxy
 	ctx := NewContext()
+	// track the hijacked connections for Shutdown
+	ctx.ConnTracker = NewConnTracker()
 	return &HttpProxy{
 		Ctx: ctx,
 		// default handles Connect method
@@ -33,16 +63,30 @@ func NewHttpProxy() *HttpProxy {
 		HttpHandler: &ForwardHandler{Ctx: ctx},
 		// default Reverse proxy
 		ReverseHandler: &ReverseHandler{Ctx: ctx},
+		// default handles the decrypted Connect method
+		MitmHandler: NewMitmHandlerWithContext(ctx),
+		// default handles Websocket upgrade
+		WebsocketHandler: &WebsocketHandler{Ctx: ctx},
 	}
 }
 
 // Standard net/http function.
 func (proxy *HttpProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodConnect {
+		if proxy.ConnectDecision != nil && proxy.ConnectDecision(req) == ConnectMitm {
+			proxy.mitmHandler().ServeHTTP(rw, req)
+			return
+		}
 		proxy.HandleConnect.ServeHTTP(rw, req)
 		return
 	}
 
+	// websocket upgrade request, the handshake and the frames are relayed as-is
+	if isWebSocketRequest(req) {
+		proxy.websocketHandler().ServeHTTP(rw, req)
+		return
+	}
+
 	// reverse proxy http request for example:
 	//		GET / HTTP/1.1
 	//		Host: www.example.com
@@ -61,6 +105,81 @@ func (proxy *HttpProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// ListenAndServe listens on the TCP network address addr and serves the proxy
+func (proxy *HttpProxy) ListenAndServe(addr string) error {
+	if proxy.inShutdown.Load() {
+		return http.ErrServerClosed
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return proxy.Serve(l)
+}
+
+// Serve accepts incoming connections on the Listener l and serves the proxy.
+// It always returns a non-nil error, http.ErrServerClosed after Shutdown.
+func (proxy *HttpProxy) Serve(l net.Listener) error {
+	srv := &http.Server{Handler: proxy}
+
+	proxy.mu.Lock()
+	if proxy.inShutdown.Load() {
+		proxy.mu.Unlock()
+		_ = l.Close()
+		return http.ErrServerClosed
+	}
+	if proxy.servers == nil {
+		proxy.servers = make(map[*http.Server]struct{})
+	}
+	proxy.servers[srv] = struct{}{}
+	proxy.mu.Unlock()
+
+	defer func() {
+		proxy.mu.Lock()
+		delete(proxy.servers, srv)
+		proxy.mu.Unlock()
+	}()
+	return srv.Serve(l)
+}
+
+// Shutdown gracefully shuts down the proxy: it stops accepting connections,
+// closes the idle connections and waits for the in-flight exchanges, including
+// the tunnels tracked by the ConnTracker of the Context. When ctx is done,
+// the remaining connections are closed and ctx.Err() is returned.
+func (proxy *HttpProxy) Shutdown(ctx context.Context) error {
+	proxy.mu.Lock()
+	proxy.inShutdown.Store(true)
+	servers := make([]*http.Server, 0, len(proxy.servers))
+	for srv := range proxy.servers {
+		servers = append(servers, srv)
+	}
+	proxy.mu.Unlock()
+
+	// The hijacked connections are tracked once the HTTP exchanges are complete
+	var err error
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil {
+			// force-close the connections which are still active
+			_ = srv.Close()
+			err = e
+		}
+	}
+	if tracker := proxy.Ctx.ConnTracker; tracker != nil {
+		if e := tracker.Shutdown(ctx); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ConnStats returns the number of active hijacked connections
+func (proxy *HttpProxy) ConnStats() ConnStats {
+	if proxy.Ctx.ConnTracker == nil {
+		return ConnStats{}
+	}
+	return proxy.Ctx.ConnTracker.Stats()
+}
+
 // Use registers an Middleware to proxy
 func (proxy *HttpProxy) Use(middleware ...Middleware) {
 	proxy.Ctx.Use(middleware...)
@@ -86,6 +205,22 @@ func (proxy *HttpProxy) Transport() *http.Transport {
 	return proxy.Ctx.Transport
 }
 
+// get the MitmHandler
+func (proxy *HttpProxy) mitmHandler() http.Handler {
+	if proxy.MitmHandler != nil {
+		return proxy.MitmHandler
+	}
+	return NewMitmHandlerWithContext(proxy.Ctx)
+}
+
+// get the WebsocketHandler
+func (proxy *HttpProxy) websocketHandler() http.Handler {
+	if proxy.WebsocketHandler != nil {
+		return proxy.WebsocketHandler
+	}
+	return NewWebsocketHandlerWithContext(proxy.Ctx)
+}
+
 // hijacker an HTTP handler to take over the connection.
 func hijacker(rw http.ResponseWriter) (conn net.Conn, err error) {
 	hij, ok := rw.(http.Hijacker)
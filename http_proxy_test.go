@@ -2,6 +2,8 @@ package mps
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +11,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps/cert"
 )
 
 func newTestServer() *httptest.Server {
@@ -100,3 +103,57 @@ func TestMiddlewareFunc(t *testing.T) {
 	asserts.Equal(int64(len(body)), resp.ContentLength)
 	asserts.Equal(string(body), "middleware")
 }
+
+func TestHttpProxy_ConnectDecision(t *testing.T) {
+	mitmSrv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello mitm"))
+	}))
+	defer mitmSrv.Close()
+	tunnelSrv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello tunnel"))
+	}))
+	defer tunnelSrv.Close()
+
+	var decrypted []string
+	proxy := NewHttpProxy()
+	proxy.Transport().TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.ConnectDecision = func(req *http.Request) ConnectAction {
+		if req.URL.Host == mitmSrv.Listener.Addr().String() {
+			return ConnectMitm
+		}
+		return ConnectTunnel
+	}
+	proxy.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		if req.Method != http.MethodConnect {
+			decrypted = append(decrypted, req.URL.String())
+		}
+		return ctx.Next(req)
+	})
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	// trust the MITM CA and the certificate of the tunneled server
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM([]byte(cert.CertPEM))
+	certPool.AddCert(tunnelSrv.Certificate())
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse(proxySrv.URL)
+			},
+			TLSClientConfig: &tls.Config{RootCAs: certPool},
+		},
+	}
+
+	asserts := assert.New(t)
+	for _, srv := range []*httptest.Server{mitmSrv, tunnelSrv} {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		asserts.Equal(200, resp.StatusCode)
+	}
+	asserts.Equal([]string{mitmSrv.URL + "/"}, decrypted, "only the MITM request should be decrypted")
+}
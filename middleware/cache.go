@@ -0,0 +1,777 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telanflow/mps"
+)
+
+// CacheContextKey is the key of the CacheStatus in the Context of the request
+const CacheContextKey = "cache"
+
+// CacheStatus tells how the Cache answered a request
+type CacheStatus string
+
+const (
+	// CacheHit is a fresh stored response
+	CacheHit CacheStatus = "HIT"
+	// CacheStale is a stale stored response, served while revalidating or because the origin failed
+	CacheStale CacheStatus = "STALE"
+	// CacheRevalidated is a stored response validated by the origin
+	CacheRevalidated CacheStatus = "REVALIDATED"
+	// CacheMiss is a response of the origin
+	CacheMiss CacheStatus = "MISS"
+	// CacheBypass is a request the Cache doesn't handle
+	CacheBypass CacheStatus = "BYPASS"
+)
+
+const (
+	// cacheStatusHeader is the response header telling the CacheStatus
+	cacheStatusHeader = "X-Cache"
+	// the default size of the MemoryCacheStore
+	defaultCacheStoreSize = 64 << 20
+	// the default size of the largest stored body
+	defaultCacheMaxEntrySize = 16 << 20
+	// the heuristic freshness is a fraction of the time since the last modification, at most a day
+	cacheHeuristicFraction = 10
+	cacheHeuristicMaxAge   = 24 * time.Hour
+)
+
+// the status codes cacheable without explicit freshness, RFC 9110 section 15.1
+var cacheHeuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// CacheOptions is the configuration of the Cache middleware
+type CacheOptions struct {
+	// Store holds the responses, a MemoryCacheStore of 64 MiB by default
+	Store CacheStore
+
+	// MaxEntrySize is the largest body stored, 16 MiB by default.
+	// The bodies are streamed to the Store, the DiskCacheStore doesn't hold them in memory.
+	MaxEntrySize int64
+}
+
+// Cache is a shared HTTP cache following RFC 9111.
+// The responses of the GET requests are stored according to Cache-Control and Expires,
+// the stale responses are revalidated with conditional requests
+// and served while revalidating in the background when stale-while-revalidate allows it.
+// The responses with Set-Cookie are not stored, nor the Range requests.
+// It caches the decrypted HTTPS requests of the MitmHandler as well.
+// The CacheStatus is recorded in the Context of the request and the X-Cache response header.
+type Cache struct {
+	opts CacheOptions
+
+	mu           sync.Mutex
+	revalidating map[string]struct{}
+}
+
+// cacheRevalidationKey marks the background revalidations in the request context
+type cacheRevalidationKey struct{}
+
+// NewCache Create a Cache middleware
+func NewCache(opts CacheOptions) *Cache {
+	if opts.Store == nil {
+		opts.Store = NewMemoryCacheStore(defaultCacheStoreSize)
+	}
+	if opts.MaxEntrySize <= 0 {
+		opts.MaxEntrySize = defaultCacheMaxEntrySize
+	}
+	return &Cache{
+		opts:         opts,
+		revalidating: make(map[string]struct{}),
+	}
+}
+
+// Purge removes the stored responses of the absolute URL
+func (c *Cache) Purge(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("cache: purge %q: absolute URL required", rawURL)
+	}
+	return c.opts.Store.Delete(cacheKey(u))
+}
+
+// Clear removes all the stored responses
+func (c *Cache) Clear() error {
+	return c.opts.Store.Clear()
+}
+
+// Handle implements mps.Middleware
+func (c *Cache) Handle(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	if req.Context().Value(cacheRevalidationKey{}) != nil {
+		// the background revalidation of a stale response
+		return ctx.Next(req)
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		ctx.Set(CacheContextKey, CacheBypass)
+		resp, err := ctx.Next(req)
+		if err == nil && isUnsafeMethod(req.Method) && resp.StatusCode < 400 {
+			c.invalidate(req, resp)
+		}
+		return resp, err
+	}
+
+	reqCC := requestCacheControl(req.Header)
+	if reqCC.has("no-store") || req.Header.Get("Range") != "" {
+		ctx.Set(CacheContextKey, CacheBypass)
+		return ctx.Next(req)
+	}
+
+	key := cacheKey(requestURL(req))
+	entries, _ := c.opts.Store.Get(key)
+	entry := selectVariant(entries, req.Header)
+	if entry == nil {
+		if reqCC.has("only-if-cached") {
+			return gatewayTimeoutResponse(req), nil
+		}
+		return c.fetch(req, ctx, key)
+	}
+
+	respCC := parseCacheControl(entry.Header)
+	lifetime, age := freshness(entry, respCC, time.Now())
+	if !reqCC.has("no-cache") && !respCC.has("no-cache") {
+		if isFresh(lifetime, age, reqCC) {
+			if resp, err := c.serve(req, ctx, entry, CacheHit); err == nil {
+				return resp, nil
+			}
+			return c.fetch(req, ctx, key)
+		}
+
+		staleness := age - lifetime
+		if mayServeStale(respCC) {
+			maxStale, ok := reqCC["max-stale"]
+			d, valid := reqCC.duration("max-stale")
+			serveStale := ok && (maxStale == "" || valid && staleness <= d)
+			if swr, ok := respCC.duration("stale-while-revalidate"); ok && staleness <= swr {
+				serveStale = true
+				c.revalidateInBackground(req, ctx, entry)
+			}
+			if serveStale {
+				if resp, err := c.serve(req, ctx, entry, CacheStale); err == nil {
+					return resp, nil
+				}
+				return c.fetch(req, ctx, key)
+			}
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		return gatewayTimeoutResponse(req), nil
+	}
+	return c.revalidate(req, ctx, key, entry, reqCC)
+}
+
+// fetch forwards the request to the origin and stores the response
+func (c *Cache) fetch(req *http.Request, ctx *mps.Context, key string) (*http.Response, error) {
+	// the Transport removes some headers of the request, they may be nominated by Vary
+	reqHeader := req.Header.Clone()
+	requestTime := time.Now()
+	resp, err := ctx.Next(req)
+	if err != nil {
+		return resp, err
+	}
+	c.store(req, reqHeader, resp, ctx, key, requestTime)
+	resp.Header.Set(cacheStatusHeader, string(CacheMiss))
+	ctx.Set(CacheContextKey, CacheMiss)
+	return resp, nil
+}
+
+// revalidate validates the stored response with a conditional request
+func (c *Cache) revalidate(req *http.Request, ctx *mps.Context, key string, entry *CacheEntry, reqCC cacheControl) (*http.Response, error) {
+	if entry.Header.Get("ETag") == "" && entry.Header.Get("Last-Modified") == "" {
+		return c.fetch(req, ctx, key)
+	}
+
+	reqHeader := req.Header.Clone()
+	condReq := req.Clone(req.Context())
+	setConditionals(condReq.Header, entry)
+	requestTime := time.Now()
+	resp, err := ctx.Next(condReq)
+	if err != nil || resp.StatusCode >= 500 {
+		if c.mayServeOnError(entry, reqCC) {
+			if resp != nil {
+				_ = resp.Body.Close()
+			}
+			return c.serve(req, ctx, entry, CacheStale)
+		}
+		return resp, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		return c.serve(req, ctx, c.refresh(entry, resp, requestTime), CacheRevalidated)
+	}
+
+	// the response of the origin replaces the stored one
+	c.store(condReq, reqHeader, resp, ctx, key, requestTime)
+	resp.Header.Set(cacheStatusHeader, string(CacheMiss))
+	ctx.Set(CacheContextKey, CacheMiss)
+	return resp, nil
+}
+
+// revalidateInBackground validates the stale response served to the client.
+// The request goes through the middlewares again, the Cache lets it pass.
+func (c *Cache) revalidateInBackground(req *http.Request, ctx *mps.Context, entry *CacheEntry) {
+	id := entry.Key + "\n" + entry.Variant
+	c.mu.Lock()
+	if _, ok := c.revalidating[id]; ok {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[id] = struct{}{}
+	c.mu.Unlock()
+
+	// the revalidation outlives the request of the client
+	bgReq := req.Clone(context.WithValue(context.Background(), cacheRevalidationKey{}, true))
+	bgReq.Method = http.MethodGet
+	bgReq.Body = http.NoBody
+	bgReq.ContentLength = 0
+	reqHeader := bgReq.Header.Clone()
+	setConditionals(bgReq.Header, entry)
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, id)
+			c.mu.Unlock()
+		}()
+
+		bgCtx := ctx.WithRequest(bgReq)
+		requestTime := time.Now()
+		resp, err := bgCtx.Next(bgReq)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotModified:
+			c.refresh(entry, resp, requestTime)
+		case resp.StatusCode < 500:
+			c.store(bgReq, reqHeader, resp, bgCtx, entry.Key, requestTime)
+			// the response is stored once its body has been read
+			_, _ = io.Copy(io.Discard, resp.Body)
+		}
+	}()
+}
+
+// serve answers the request with the stored response
+func (c *Cache) serve(req *http.Request, ctx *mps.Context, entry *CacheEntry, status CacheStatus) (*http.Response, error) {
+	body, err := c.opts.Store.Open(entry)
+	if err != nil {
+		return nil, err
+	}
+	_, age := freshness(entry, parseCacheControl(entry.Header), time.Now())
+
+	header := entry.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	header.Set(cacheStatusHeader, string(status))
+	resp := &http.Response{
+		StatusCode: entry.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header:     header,
+	}
+	ctx.Set(CacheContextKey, status)
+
+	if entry.StatusCode == http.StatusOK && notModified(req.Header, entry.Header) {
+		// the client already has the response
+		_ = body.Close()
+		header.Del("Content-Length")
+		resp.StatusCode = http.StatusNotModified
+		resp.Body = http.NoBody
+		resp.ContentLength = -1
+		return resp, nil
+	}
+
+	header.Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	resp.ContentLength = entry.Size
+	resp.Body = body
+	if req.Method == http.MethodHead {
+		_ = body.Close()
+		resp.Body = http.NoBody
+	}
+	// The stored body matches its Content-Length, it is streamed to the client
+	ctx.TrustResponseBody(resp)
+	return resp, nil
+}
+
+// store saves the response while its body is read, it is stored once the body has been read completely
+func (c *Cache) store(req *http.Request, reqHeader http.Header, resp *http.Response, ctx *mps.Context, key string, requestTime time.Time) {
+	respCC := parseCacheControl(resp.Header)
+	if !c.storable(req, reqHeader, resp, respCC) {
+		return
+	}
+
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	header.Del(cacheStatusHeader)
+	entry := &CacheEntry{
+		Key:          key,
+		Variant:      variantOf(varyNames(resp.Header), reqHeader),
+		StatusCode:   resp.StatusCode,
+		Header:       header,
+		RequestTime:  requestTime,
+		ResponseTime: time.Now(),
+	}
+	w, err := c.opts.Store.Set(entry)
+	if err != nil {
+		return
+	}
+	ctx.WrapResponseBody(resp, func(body io.ReadCloser) io.ReadCloser {
+		return &cacheBody{
+			ReadCloser: body,
+			w:          w,
+			limit:      c.opts.MaxEntrySize,
+			length:     resp.ContentLength,
+		}
+	})
+}
+
+// storable reports whether the response can be stored by a shared cache, RFC 9111 section 3
+func (c *Cache) storable(req *http.Request, reqHeader http.Header, resp *http.Response, respCC cacheControl) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	if resp.StatusCode < 200 || resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	if respCC.has("no-store") || respCC.has("private") || requestCacheControl(reqHeader).has("no-store") {
+		return false
+	}
+	if reqHeader.Get("Authorization") != "" &&
+		!respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate") {
+		return false
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if resp.ContentLength > c.opts.MaxEntrySize {
+		return false
+	}
+
+	explicit := respCC.has("s-maxage") || respCC.has("max-age") || respCC.has("public") ||
+		resp.Header.Get("Expires") != ""
+	if explicit {
+		return true
+	}
+	// without explicit freshness, the response is only useful if it can be revalidated
+	validators := resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+	return cacheHeuristicStatus[resp.StatusCode] && validators
+}
+
+// refresh updates the stored response with the header of the 304 Not Modified response
+func (c *Cache) refresh(entry *CacheEntry, resp *http.Response, requestTime time.Time) *CacheEntry {
+	updated := entry.clone()
+	// the Age of the stored response no longer applies
+	updated.Header.Del("Age")
+	header := resp.Header.Clone()
+	removeHopHeaders(header)
+	header.Del("Content-Length")
+	header.Del(cacheStatusHeader)
+	for k, vs := range header {
+		updated.Header[k] = vs
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = time.Now()
+	_ = c.opts.Store.Update(updated)
+	return updated
+}
+
+// mayServeOnError reports whether the stale response can be served when the origin fails
+func (c *Cache) mayServeOnError(entry *CacheEntry, reqCC cacheControl) bool {
+	respCC := parseCacheControl(entry.Header)
+	if !mayServeStale(respCC) {
+		return false
+	}
+	lifetime, age := freshness(entry, respCC, time.Now())
+	for _, cc := range []cacheControl{reqCC, respCC} {
+		if d, ok := cc.duration("stale-if-error"); ok && age-lifetime <= d {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate removes the responses of the URLs changed by an unsafe request, RFC 9111 section 4.4
+func (c *Cache) invalidate(req *http.Request, resp *http.Response) {
+	target := requestURL(req)
+	_ = c.opts.Store.Delete(cacheKey(target))
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		u, err := target.Parse(value)
+		if err == nil && strings.EqualFold(u.Host, target.Host) {
+			_ = c.opts.Store.Delete(cacheKey(u))
+		}
+	}
+}
+
+// gatewayTimeoutResponse answers the only-if-cached requests without stored response,
+// RFC 9111 section 5.2.1.7
+func gatewayTimeoutResponse(req *http.Request) *http.Response {
+	msg := "504 " + http.StatusText(http.StatusGatewayTimeout)
+	return &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(strings.NewReader(msg)),
+		ContentLength: int64(len(msg)),
+	}
+}
+
+// cacheBody writes a copy of the body to the CacheWriter, the response is stored
+// at the end of the body. An incomplete or too large body is discarded.
+type cacheBody struct {
+	io.ReadCloser
+	w       CacheWriter
+	limit   int64
+	written int64
+	// length is the Content-Length of the body, -1 if unknown
+	length int64
+	done   bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.done {
+		b.written += int64(n)
+		if b.written > b.limit {
+			// too large, the body is not stored
+			b.abort()
+		} else if _, werr := b.w.Write(p[:n]); werr != nil {
+			b.abort()
+		}
+	}
+	switch {
+	case err == io.EOF:
+		b.commit()
+	case err != nil:
+		b.abort()
+	}
+	return n, err
+}
+
+// Close stores the response if the whole body has been read, e.g. the empty body of a 204 response
+func (b *cacheBody) Close() error {
+	if b.length >= 0 && b.written == b.length {
+		b.commit()
+	}
+	b.abort()
+	return b.ReadCloser.Close()
+}
+
+func (b *cacheBody) commit() {
+	if !b.done {
+		b.done = true
+		_ = b.w.Close()
+	}
+}
+
+func (b *cacheBody) abort() {
+	if !b.done {
+		b.done = true
+		_ = b.w.Abort()
+	}
+}
+
+// cacheControl holds the directives of the Cache-Control header
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range splitDirectives(value) {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// requestCacheControl returns the directives of the request, Pragma: no-cache included
+func requestCacheControl(header http.Header) cacheControl {
+	cc := parseCacheControl(header)
+	if len(header.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+// splitDirectives splits the directives on the commas outside of the quoted strings
+func splitDirectives(value string) []string {
+	var (
+		directives []string
+		quoted     bool
+		start      int
+	)
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				directives = append(directives, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(directives, value[start:])
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// duration returns the delta-seconds of the directive, an invalid value is zero
+func (cc cacheControl) duration(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	const maxSeconds = int64(1<<63-1) / int64(time.Second)
+	if seconds > maxSeconds {
+		seconds = maxSeconds
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// freshness returns the freshness lifetime and the current age of the stored response, RFC 9111 section 4.2
+func freshness(entry *CacheEntry, cc cacheControl, now time.Time) (lifetime, age time.Duration) {
+	date, err := http.ParseTime(entry.Header.Get("Date"))
+	if err != nil {
+		date = entry.ResponseTime
+	}
+
+	if d, ok := cc.duration("s-maxage"); ok {
+		lifetime = d
+	} else if d, ok := cc.duration("max-age"); ok {
+		lifetime = d
+	} else if expires := entry.Header.Get("Expires"); expires != "" {
+		// an invalid date is already expired
+		if t, err := http.ParseTime(expires); err == nil && t.After(date) {
+			lifetime = t.Sub(date)
+		}
+	} else if cacheHeuristicStatus[entry.StatusCode] || cc.has("public") {
+		if lm, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+			lifetime = date.Sub(lm) / cacheHeuristicFraction
+			if lifetime > cacheHeuristicMaxAge {
+				lifetime = cacheHeuristicMaxAge
+			}
+		}
+	}
+
+	apparentAge := entry.ResponseTime.Sub(date)
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	var ageValue time.Duration
+	if seconds, err := strconv.ParseInt(entry.Header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		ageValue = time.Duration(seconds) * time.Second
+	}
+	correctedAge := ageValue + entry.ResponseTime.Sub(entry.RequestTime)
+	if apparentAge > correctedAge {
+		correctedAge = apparentAge
+	}
+	age = correctedAge + now.Sub(entry.ResponseTime)
+	return
+}
+
+// isFresh reports whether the response is fresh enough for the request directives
+func isFresh(lifetime, age time.Duration, reqCC cacheControl) bool {
+	if age >= lifetime {
+		return false
+	}
+	if maxAge, ok := reqCC.duration("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.duration("min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	return true
+}
+
+// mayServeStale reports whether the response can be served stale by a shared cache
+func mayServeStale(respCC cacheControl) bool {
+	// s-maxage implies proxy-revalidate
+	return !respCC.has("must-revalidate") && !respCC.has("proxy-revalidate") && !respCC.has("s-maxage")
+}
+
+// notModified evaluates the conditional request against the stored response
+func notModified(reqHeader, header http.Header) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			// weak comparison
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := reqHeader.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lm, err := http.ParseTime(header.Get("Last-Modified"))
+		return err == nil && !lm.After(since)
+	}
+	return false
+}
+
+// setConditionals replaces the conditionals of the request by the validators of the stored response
+func setConditionals(reqHeader http.Header, entry *CacheEntry) {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		reqHeader.Del(name)
+	}
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		reqHeader.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		reqHeader.Set("If-Modified-Since", lm)
+	}
+}
+
+// varyNames returns the sorted request headers nominated by Vary
+func varyNames(header http.Header) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "*" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			if name != "" && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// variantOf returns the Variant of the request headers nominated by Vary
+func variantOf(names []string, reqHeader http.Header) string {
+	var b strings.Builder
+	for _, name := range names {
+		var values []string
+		for _, value := range reqHeader.Values(name) {
+			for _, v := range strings.Split(value, ",") {
+				values = append(values, strings.TrimSpace(v))
+			}
+		}
+		b.WriteString(name)
+		b.WriteString(": ")
+		b.WriteString(strings.Join(values, ","))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// selectVariant returns the most recent response matching the request headers nominated by its Vary
+func selectVariant(entries []*CacheEntry, reqHeader http.Header) *CacheEntry {
+	var selected *CacheEntry
+	for _, entry := range entries {
+		if variantOf(varyNames(entry.Header), reqHeader) != entry.Variant {
+			continue
+		}
+		if selected == nil || entry.ResponseTime.After(selected.ResponseTime) {
+			selected = entry
+		}
+	}
+	return selected
+}
+
+// requestURL returns the absolute URL of the request
+func requestURL(req *http.Request) *url.URL {
+	u := *req.URL
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	return &u
+}
+
+// cacheKey returns the normalized URL, the key of the stored responses
+func cacheKey(u *url.URL) string {
+	key := *u
+	key.Scheme = strings.ToLower(key.Scheme)
+	key.Host = strings.ToLower(key.Host)
+	if port := key.Port(); (key.Scheme == "http" && port == "80") || (key.Scheme == "https" && port == "443") {
+		key.Host = key.Hostname()
+	}
+	if key.Path == "" && key.RawPath == "" {
+		key.Path = "/"
+	}
+	key.User = nil
+	key.Fragment = ""
+	key.RawFragment = ""
+	return key.String()
+}
+
+// removeHopHeaders removes the hop-by-hop headers, they are not stored
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+		"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		header.Del(name)
+	}
+}
+
+// isUnsafeMethod reports whether the method may change the resource
+func isUnsafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,715 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// CacheEntryNotFoundErr is returned when the stored response no longer exists
+	CacheEntryNotFoundErr = errors.New("cache entry not found")
+	// CacheEntryTooLargeErr is returned when the response is larger than the store
+	CacheEntryTooLargeErr = errors.New("cache entry too large")
+)
+
+// CacheEntry is a response stored by the Cache
+type CacheEntry struct {
+	// Key is the URL of the response
+	Key string `json:"key"`
+
+	// Variant identifies the response among the responses of the Key,
+	// from the values of the request headers nominated by Vary
+	Variant string `json:"variant,omitempty"`
+
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+
+	// RequestTime is the time the request was sent to the origin
+	RequestTime time.Time `json:"requestTime"`
+
+	// ResponseTime is the time the response was received
+	ResponseTime time.Time `json:"responseTime"`
+
+	// Size is the number of bytes of the body
+	Size int64 `json:"size"`
+
+	// Version identifies the stored response, it is set by the CacheStore
+	// and changes when the response of the Key and Variant is replaced
+	Version string `json:"version"`
+}
+
+func (e *CacheEntry) clone() *CacheEntry {
+	c := *e
+	c.Header = e.Header.Clone()
+	return &c
+}
+
+// size returns the approximate number of bytes held by the entry
+func (e *CacheEntry) size() int64 {
+	size := int64(len(e.Key)+len(e.Variant)) + e.Size
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	return size
+}
+
+// CacheStore holds the responses of the Cache.
+// Implement it to share the cache between several proxies.
+type CacheStore interface {
+	// Get returns the responses stored for the key, one per variant
+	Get(key string) ([]*CacheEntry, error)
+
+	// Open returns the body of a stored response,
+	// CacheEntryNotFoundErr if another Version of the response has been stored since
+	Open(entry *CacheEntry) (io.ReadCloser, error)
+
+	// Set returns the writer of the body of a response. The response is stored when the writer
+	// is closed, replacing the response of the same Key and Variant.
+	Set(entry *CacheEntry) (CacheWriter, error)
+
+	// Update replaces the header of a stored response, after it has been revalidated.
+	// It returns CacheEntryNotFoundErr if another Version of the response has been stored since.
+	Update(entry *CacheEntry) error
+
+	// Delete removes the responses of the key
+	Delete(key string) error
+
+	// Clear removes all the responses
+	Clear() error
+}
+
+// CacheWriter writes the body of a response to the CacheStore.
+// Close stores the response, Abort discards it. Write fails with
+// CacheEntryTooLargeErr when the body doesn't fit in the store.
+type CacheWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// MemoryCacheStore is a CacheStore in memory, the least recently used responses
+// are evicted once the size of the store exceeds its limit
+type MemoryCacheStore struct {
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	items   map[string]map[string]*list.Element
+	size    int64
+	version uint64
+}
+
+type memoryCacheItem struct {
+	entry *CacheEntry
+	body  []byte
+	size  int64
+}
+
+// NewMemoryCacheStore Create a MemoryCacheStore holding at most maxSize bytes.
+// If maxSize is zero, the size is unlimited.
+func NewMemoryCacheStore(maxSize int64) *MemoryCacheStore {
+	return &MemoryCacheStore{
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]map[string]*list.Element),
+	}
+}
+
+// Get implements CacheStore
+func (s *MemoryCacheStore) Get(key string) ([]*CacheEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	variants := s.items[key]
+	entries := make([]*CacheEntry, 0, len(variants))
+	for _, el := range variants {
+		entries = append(entries, el.Value.(*memoryCacheItem).entry.clone())
+	}
+	return entries, nil
+}
+
+// Open implements CacheStore
+func (s *MemoryCacheStore) Open(entry *CacheEntry) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[entry.Key][entry.Variant]
+	if !ok {
+		return nil, CacheEntryNotFoundErr
+	}
+	item := el.Value.(*memoryCacheItem)
+	if item.entry.Version != entry.Version {
+		// the response has been replaced
+		return nil, CacheEntryNotFoundErr
+	}
+	s.lru.MoveToFront(el)
+	return io.NopCloser(bytes.NewReader(item.body)), nil
+}
+
+// Set implements CacheStore
+func (s *MemoryCacheStore) Set(entry *CacheEntry) (CacheWriter, error) {
+	return &memoryCacheWriter{store: s, entry: entry.clone()}, nil
+}
+
+// set stores the response with its body
+func (s *MemoryCacheStore) set(entry *CacheEntry, body []byte) error {
+	item := &memoryCacheItem{entry: entry, body: body}
+	item.entry.Size = int64(len(body))
+	item.size = item.entry.size()
+	if s.maxSize > 0 && item.size > s.maxSize {
+		return CacheEntryTooLargeErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version++
+	item.entry.Version = strconv.FormatUint(s.version, 10)
+	s.remove(entry.Key, entry.Variant)
+	variants, ok := s.items[entry.Key]
+	if !ok {
+		variants = make(map[string]*list.Element)
+		s.items[entry.Key] = variants
+	}
+	variants[entry.Variant] = s.lru.PushFront(item)
+	s.size += item.size
+
+	// evict the least recently used responses
+	for s.maxSize > 0 && s.size > s.maxSize {
+		oldest := s.lru.Back().Value.(*memoryCacheItem)
+		s.remove(oldest.entry.Key, oldest.entry.Variant)
+	}
+	return nil
+}
+
+// Update implements CacheStore
+func (s *MemoryCacheStore) Update(entry *CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[entry.Key][entry.Variant]
+	if !ok {
+		return CacheEntryNotFoundErr
+	}
+	item := el.Value.(*memoryCacheItem)
+	if item.entry.Version != entry.Version {
+		return CacheEntryNotFoundErr
+	}
+	updated := entry.clone()
+	updated.Size = int64(len(item.body))
+	s.size -= item.size
+	item.entry = updated
+	item.size = updated.size()
+	s.size += item.size
+	return nil
+}
+
+// Delete implements CacheStore
+func (s *MemoryCacheStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for variant := range s.items[key] {
+		s.remove(key, variant)
+	}
+	return nil
+}
+
+// Clear implements CacheStore
+func (s *MemoryCacheStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.Init()
+	s.items = make(map[string]map[string]*list.Element)
+	s.size = 0
+	return nil
+}
+
+// Len returns the number of responses
+func (s *MemoryCacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Size returns the number of bytes held by the responses
+func (s *MemoryCacheStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryCacheStore) remove(key, variant string) {
+	variants := s.items[key]
+	el, ok := variants[variant]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	s.size -= el.Value.(*memoryCacheItem).size
+	delete(variants, variant)
+	if len(variants) == 0 {
+		delete(s.items, key)
+	}
+}
+
+// memoryCacheWriter buffers the body, the response is stored when it is closed
+type memoryCacheWriter struct {
+	store *MemoryCacheStore
+	entry *CacheEntry
+	buf   bytes.Buffer
+	err   error
+}
+
+func (w *memoryCacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.store.maxSize > 0 && int64(w.buf.Len()+len(p)) > w.store.maxSize {
+		_ = w.Abort()
+		w.err = CacheEntryTooLargeErr
+		return 0, w.err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryCacheWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = os.ErrClosed
+	return w.store.set(w.entry, w.buf.Bytes())
+}
+
+func (w *memoryCacheWriter) Abort() error {
+	w.buf = bytes.Buffer{}
+	w.err = os.ErrClosed
+	return nil
+}
+
+// DiskCacheStore is a CacheStore in a directory, the least recently used responses
+// are evicted once the size of the store exceeds its limit.
+// Each response is stored in <dir>/<key hash>/<variant hash>.json, its body in
+// <variant hash>.<version>.body. The bodies are streamed to temporary files, they are not held in memory.
+type DiskCacheStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	size  int64
+}
+
+type diskCacheItem struct {
+	// name is <key hash>/<variant hash>
+	name    string
+	version string
+	size    int64
+}
+
+// NewDiskCacheStore Create a DiskCacheStore holding at most maxSize bytes in dir.
+// The responses already stored in dir are reused. If maxSize is zero, the size is unlimited.
+func NewDiskCacheStore(dir string, maxSize int64) (*DiskCacheStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &DiskCacheStore{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		items:   make(map[string]*list.Element),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.evict()
+	s.mu.Unlock()
+	return s, nil
+}
+
+// load indexes the stored responses, the least recently used ones first
+func (s *DiskCacheStore) load() error {
+	// the bodies being written when the process stopped
+	temps, err := filepath.Glob(filepath.Join(s.dir, "*", ".tmp-*"))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		_ = os.Remove(temp)
+	}
+
+	metas, err := filepath.Glob(filepath.Join(s.dir, "*", "*.json"))
+	if err != nil {
+		return err
+	}
+	type storedItem struct {
+		item    *diskCacheItem
+		modTime time.Time
+	}
+	stored := make([]storedItem, 0, len(metas))
+	bodies := make(map[string]bool, len(metas))
+	for _, meta := range metas {
+		rel, err := filepath.Rel(s.dir, meta)
+		if err != nil {
+			continue
+		}
+		name := filepath.ToSlash(strings.TrimSuffix(rel, ".json"))
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		entry := new(CacheEntry)
+		if err = json.Unmarshal(data, entry); err != nil {
+			_ = os.Remove(meta)
+			continue
+		}
+		body := s.bodyPath(name, entry.Version)
+		bodyInfo, err := os.Stat(body)
+		if err != nil {
+			// incomplete response
+			_ = os.Remove(meta)
+			continue
+		}
+		bodies[body] = true
+		stored = append(stored, storedItem{
+			item:    &diskCacheItem{name: name, version: entry.Version, size: int64(len(data)) + bodyInfo.Size()},
+			modTime: bodyInfo.ModTime(),
+		})
+	}
+
+	// the bodies whose metadata was not written, or that have been replaced
+	files, err := filepath.Glob(filepath.Join(s.dir, "*", "*.body"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !bodies[file] {
+			_ = os.Remove(file)
+		}
+	}
+
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].modTime.Before(stored[j].modTime)
+	})
+	for _, si := range stored {
+		s.items[si.item.name] = s.lru.PushFront(si.item)
+		s.size += si.item.size
+	}
+	return nil
+}
+
+// Get implements CacheStore
+func (s *DiskCacheStore) Get(key string) ([]*CacheEntry, error) {
+	metas, err := filepath.Glob(filepath.Join(s.dir, bodyHash([]byte(key)), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*CacheEntry, 0, len(metas))
+	for _, meta := range metas {
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		entry := new(CacheEntry)
+		if err = json.Unmarshal(data, entry); err != nil || entry.Key != key {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Open implements CacheStore
+func (s *DiskCacheStore) Open(entry *CacheEntry) (io.ReadCloser, error) {
+	name := s.name(entry)
+	// the body of a replaced response has been removed
+	f, err := os.Open(s.bodyPath(name, entry.Version))
+	if os.IsNotExist(err) {
+		return nil, CacheEntryNotFoundErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the modification time orders the responses when the store is reloaded
+	now := time.Now()
+	_ = os.Chtimes(f.Name(), now, now)
+	s.mu.Lock()
+	if el, ok := s.items[name]; ok {
+		s.lru.MoveToFront(el)
+	}
+	s.mu.Unlock()
+	return f, nil
+}
+
+// Set implements CacheStore, the body is written to a temporary file of the directory
+func (s *DiskCacheStore) Set(entry *CacheEntry) (CacheWriter, error) {
+	version, err := newCacheVersion()
+	if err != nil {
+		return nil, err
+	}
+	entry = entry.clone()
+	entry.Version = version
+	name := s.name(entry)
+	if err := os.MkdirAll(filepath.Dir(s.path(name, "")), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path(name, "")), ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &diskCacheWriter{store: s, entry: entry, name: name, f: f}, nil
+}
+
+// commit stores the response, its body is the temporary file
+func (s *DiskCacheStore) commit(entry *CacheEntry, name, bodyFile string) error {
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	size := int64(len(meta)) + entry.Size
+	if s.maxSize > 0 && size > s.maxSize {
+		return CacheEntryTooLargeErr
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, _ := s.storedVersion(name)
+	// The metadata is written last, it switches to the new body.
+	// A body without metadata is removed when the store is reloaded.
+	body := s.bodyPath(name, entry.Version)
+	if err = os.Rename(bodyFile, body); err != nil {
+		return fmt.Errorf("write cache file: %w", err)
+	}
+	if err = s.writeFile(s.path(name, ".json"), meta); err != nil {
+		_ = os.Remove(body)
+		return err
+	}
+	if previous != "" {
+		// the readers of the previous body keep reading it
+		_ = os.Remove(s.bodyPath(name, previous))
+	}
+
+	s.forget(name)
+	s.items[name] = s.lru.PushFront(&diskCacheItem{name: name, version: entry.Version, size: size})
+	s.size += size
+	s.evict()
+	return nil
+}
+
+// Update implements CacheStore
+func (s *DiskCacheStore) Update(entry *CacheEntry) error {
+	name := s.name(entry)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version, err := s.storedVersion(name); err != nil || version != entry.Version {
+		return CacheEntryNotFoundErr
+	}
+	info, err := os.Stat(s.bodyPath(name, entry.Version))
+	if os.IsNotExist(err) {
+		return CacheEntryNotFoundErr
+	}
+	if err != nil {
+		return err
+	}
+	entry = entry.clone()
+	entry.Size = info.Size()
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = s.writeFile(s.path(name, ".json"), meta); err != nil {
+		return err
+	}
+
+	if el, ok := s.items[name]; ok {
+		item := el.Value.(*diskCacheItem)
+		s.size += int64(len(meta)) + info.Size() - item.size
+		item.size = int64(len(meta)) + info.Size()
+	}
+	return nil
+}
+
+// Delete implements CacheStore
+func (s *DiskCacheStore) Delete(key string) error {
+	keyHash := bodyHash([]byte(key))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.items {
+		if strings.HasPrefix(name, keyHash+"/") {
+			s.forget(name)
+		}
+	}
+	return os.RemoveAll(filepath.Join(s.dir, keyHash))
+}
+
+// Clear implements CacheStore
+func (s *DiskCacheStore) Clear() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.items {
+		s.forget(name)
+	}
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err = os.RemoveAll(filepath.Join(s.dir, d.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Len returns the number of responses
+func (s *DiskCacheStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// Size returns the number of bytes of the stored files
+func (s *DiskCacheStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// name returns <key hash>/<variant hash> of the entry
+func (s *DiskCacheStore) name(entry *CacheEntry) string {
+	return bodyHash([]byte(entry.Key)) + "/" + bodyHash([]byte(entry.Variant))[:16]
+}
+
+func (s *DiskCacheStore) path(name, ext string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name)) + ext
+}
+
+// bodyPath returns the path of the body of the version of the response
+func (s *DiskCacheStore) bodyPath(name, version string) string {
+	return s.path(name, "."+version+".body")
+}
+
+// storedVersion returns the Version of the stored response, read from its metadata
+func (s *DiskCacheStore) storedVersion(name string) (string, error) {
+	data, err := os.ReadFile(s.path(name, ".json"))
+	if err != nil {
+		return "", err
+	}
+	entry := new(CacheEntry)
+	if err = json.Unmarshal(data, entry); err != nil {
+		return "", err
+	}
+	return entry.Version, nil
+}
+
+// newCacheVersion returns a random Version, unique across the restarts of the store
+func newCacheVersion() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writeFile replaces the file atomically, the readers keep the previous content
+func (s *DiskCacheStore) writeFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("write cache file: %w", err)
+	}
+	return nil
+}
+
+// diskCacheWriter writes the body to a temporary file, the response is stored when it is closed
+type diskCacheWriter struct {
+	store *DiskCacheStore
+	entry *CacheEntry
+	name  string
+	f     *os.File
+	err   error
+}
+
+func (w *diskCacheWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.store.maxSize > 0 && w.entry.Size+int64(len(p)) > w.store.maxSize {
+		_ = w.Abort()
+		w.err = CacheEntryTooLargeErr
+		return 0, w.err
+	}
+	n, err := w.f.Write(p)
+	w.entry.Size += int64(n)
+	if err != nil {
+		_ = w.Abort()
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *diskCacheWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = os.ErrClosed
+	err := w.f.Close()
+	if err == nil {
+		err = w.store.commit(w.entry, w.name, w.f.Name())
+	}
+	if err != nil {
+		_ = os.Remove(w.f.Name())
+	}
+	return err
+}
+
+func (w *diskCacheWriter) Abort() error {
+	if w.err != nil {
+		return nil
+	}
+	w.err = os.ErrClosed
+	_ = w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// forget removes the response from the index
+func (s *DiskCacheStore) forget(name string) {
+	if el, ok := s.items[name]; ok {
+		s.lru.Remove(el)
+		s.size -= el.Value.(*diskCacheItem).size
+		delete(s.items, name)
+	}
+}
+
+// evict removes the least recently used responses until the size fits
+func (s *DiskCacheStore) evict() {
+	for s.maxSize > 0 && s.size > s.maxSize && s.lru.Len() > 0 {
+		item := s.lru.Back().Value.(*diskCacheItem)
+		s.forget(item.name)
+		_ = os.Remove(s.path(item.name, ".json"))
+		_ = os.Remove(s.bodyPath(item.name, item.version))
+	}
+}
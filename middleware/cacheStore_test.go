@@ -0,0 +1,282 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// store a response of the key with the body, it returns the stored entry
+func setCacheEntry(t *testing.T, store CacheStore, key, variant, body string) *CacheEntry {
+	t.Helper()
+	now := time.Now()
+	entry := &CacheEntry{
+		Key:          key,
+		Variant:      variant,
+		StatusCode:   http.StatusOK,
+		Header:       http.Header{"Cache-Control": []string{"max-age=60"}},
+		RequestTime:  now,
+		ResponseTime: now,
+	}
+	w, err := store.Set(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body is written in several parts
+	for _, part := range []string{body[:len(body)/2], body[len(body)/2:]} {
+		if _, err = w.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return storedCacheEntry(t, store, key, variant)
+}
+
+// get the stored entry of the key and variant, nil if not found
+func storedCacheEntry(t *testing.T, store CacheStore, key, variant string) *CacheEntry {
+	t.Helper()
+	entries, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Variant == variant {
+			return entry
+		}
+	}
+	return nil
+}
+
+// read the stored body of the entry
+func readCacheBody(t *testing.T, store CacheStore, entry *CacheEntry) (string, error) {
+	t.Helper()
+	body, err := store.Open(entry)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	return string(data), err
+}
+
+// the stores under test, holding at most maxSize bytes
+func testCacheStores(t *testing.T, maxSize int64) map[string]func() CacheStore {
+	return map[string]func() CacheStore{
+		"memory": func() CacheStore {
+			return NewMemoryCacheStore(maxSize)
+		},
+		"disk": func() CacheStore {
+			store, err := NewDiskCacheStore(t.TempDir(), maxSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+}
+
+func TestCacheStore(t *testing.T) {
+	for name, newStore := range testCacheStores(t, 0) {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			asserts := assert.New(t)
+
+			a := setCacheEntry(t, store, "http://example.com/a", "", "hello")
+			if !asserts.NotNil(a) {
+				return
+			}
+			asserts.Equal(int64(5), a.Size)
+			asserts.Equal(http.StatusOK, a.StatusCode)
+			asserts.Equal("max-age=60", a.Header.Get("Cache-Control"))
+			body, err := readCacheBody(t, store, a)
+			asserts.NoError(err)
+			asserts.Equal("hello", body)
+
+			// the variants are stored apart
+			setCacheEntry(t, store, "http://example.com/a", "Accept-Encoding: gzip\n", "gzip")
+			entries, _ := store.Get("http://example.com/a")
+			asserts.Len(entries, 2)
+
+			// a new response replaces the response of the same variant
+			replaced := setCacheEntry(t, store, "http://example.com/a", "", "hello world")
+			body, _ = readCacheBody(t, store, replaced)
+			asserts.Equal("hello world", body)
+			_, err = store.Open(a)
+			asserts.ErrorIs(err, CacheEntryNotFoundErr, "the replaced response should not be opened")
+
+			// a body of the same size replaces the response too
+			same := setCacheEntry(t, store, "http://example.com/a", "", "HELLO WORLD")
+			asserts.NotEqual(replaced.Version, same.Version)
+			_, err = store.Open(replaced)
+			asserts.ErrorIs(err, CacheEntryNotFoundErr, "the replaced response should not be opened")
+			replaced.Header.Set("X-Version", "1")
+			asserts.ErrorIs(store.Update(replaced), CacheEntryNotFoundErr, "the replaced response should not be updated")
+
+			// the header is updated, the body is kept
+			same.Header.Set("X-Version", "2")
+			asserts.NoError(store.Update(same))
+			updated := storedCacheEntry(t, store, "http://example.com/a", "")
+			asserts.Equal("2", updated.Header.Get("X-Version"))
+			asserts.Equal(same.Version, updated.Version)
+			asserts.Equal(int64(11), updated.Size)
+			body, _ = readCacheBody(t, store, updated)
+			asserts.Equal("HELLO WORLD", body)
+			asserts.ErrorIs(store.Update(&CacheEntry{Key: "http://example.com/missing"}), CacheEntryNotFoundErr)
+
+			// an aborted response is not stored
+			w, err := store.Set(&CacheEntry{Key: "http://example.com/aborted", Header: http.Header{}})
+			if asserts.NoError(err) {
+				_, _ = w.Write([]byte("partial"))
+				asserts.NoError(w.Abort())
+			}
+			entries, _ = store.Get("http://example.com/aborted")
+			asserts.Empty(entries)
+
+			setCacheEntry(t, store, "http://example.com/b", "", "b")
+			asserts.NoError(store.Delete("http://example.com/a"))
+			entries, _ = store.Get("http://example.com/a")
+			asserts.Empty(entries)
+			asserts.NotNil(storedCacheEntry(t, store, "http://example.com/b", ""))
+
+			asserts.NoError(store.Clear())
+			entries, _ = store.Get("http://example.com/b")
+			asserts.Empty(entries)
+		})
+	}
+}
+
+func TestCacheStore_TooLarge(t *testing.T) {
+	for name, newStore := range testCacheStores(t, 100) {
+		t.Run(name, func(t *testing.T) {
+			store := newStore()
+			w, err := store.Set(&CacheEntry{Key: "http://example.com/", Header: http.Header{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			asserts := assert.New(t)
+			_, err = w.Write([]byte(strings.Repeat("a", 60)))
+			asserts.NoError(err)
+			_, err = w.Write([]byte(strings.Repeat("a", 60)))
+			asserts.ErrorIs(err, CacheEntryTooLargeErr, "the write should fail once the body exceeds the store")
+			asserts.Error(w.Close())
+			entries, _ := store.Get("http://example.com/")
+			asserts.Empty(entries)
+		})
+	}
+}
+
+func TestCacheStore_Evict(t *testing.T) {
+	body := strings.Repeat("a", 200)
+	// measure the size of a response in each store
+	sizes := make(map[string]int64)
+	for name, newStore := range testCacheStores(t, 0) {
+		store := newStore()
+		setCacheEntry(t, store, "http://example.com/a", "", body)
+		switch s := store.(type) {
+		case *MemoryCacheStore:
+			sizes[name] = s.Size()
+		case *DiskCacheStore:
+			sizes[name] = s.Size()
+		}
+	}
+
+	for name := range sizes {
+		t.Run(name, func(t *testing.T) {
+			// two responses fit in the store, not three
+			store := testCacheStores(t, sizes[name]*5/2)[name]()
+			a := setCacheEntry(t, store, "http://example.com/a", "", body)
+			b := setCacheEntry(t, store, "http://example.com/b", "", body)
+			// a is the most recently used
+			_, err := readCacheBody(t, store, a)
+			asserts := assert.New(t)
+			asserts.NoError(err)
+			setCacheEntry(t, store, "http://example.com/c", "", body)
+
+			asserts.NotNil(storedCacheEntry(t, store, "http://example.com/a", ""))
+			asserts.Nil(storedCacheEntry(t, store, "http://example.com/b", ""), "the least recently used response should be evicted")
+			asserts.NotNil(storedCacheEntry(t, store, "http://example.com/c", ""))
+			_, err = store.Open(b)
+			asserts.ErrorIs(err, CacheEntryNotFoundErr)
+		})
+	}
+}
+
+func TestDiskCacheStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskCacheStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := strings.Repeat("a", 200)
+	entries := map[string]*CacheEntry{}
+	for _, path := range []string{"/a", "/b", "/c"} {
+		entries[path] = setCacheEntry(t, store, "http://example.com"+path, "", body)
+	}
+	size := store.Size()
+
+	// the modification times of the bodies order the responses, /b is the least recently used
+	now := time.Now()
+	for path, d := range map[string]time.Duration{"/a": -time.Minute, "/b": -time.Hour, "/c": 0} {
+		name := store.name(entries[path])
+		if err = os.Chtimes(store.bodyPath(name, entries[path].Version), now.Add(d), now.Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the files left by a crash: a body being written, a response without body,
+	// a body whose metadata was not written and the body of a replaced response
+	name := store.name(entries["/a"])
+	keyDir := filepath.Dir(store.path(name, ""))
+	incomplete := filepath.Join(keyDir, "incomplete.json")
+	leftovers := []string{
+		filepath.Join(keyDir, ".tmp-1"),
+		incomplete,
+		filepath.Join(keyDir, "unwritten.0123456789abcdef.body"),
+		store.bodyPath(name, "0123456789abcdef"),
+	}
+	for _, file := range leftovers {
+		content := "partial"
+		if file == incomplete {
+			content = "{}"
+		}
+		if err = os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	asserts := assert.New(t)
+	reloaded, err := NewDiskCacheStore(dir, 0)
+	if !asserts.NoError(err) {
+		return
+	}
+	asserts.Equal(3, reloaded.Len())
+	asserts.Equal(size, reloaded.Size())
+	for _, file := range leftovers {
+		_, err = os.Stat(file)
+		asserts.True(os.IsNotExist(err), "%s should be removed", filepath.Base(file))
+	}
+
+	stored := storedCacheEntry(t, reloaded, "http://example.com/a", "")
+	if asserts.NotNil(stored) {
+		data, err := readCacheBody(t, reloaded, stored)
+		asserts.NoError(err)
+		asserts.Equal(body, data)
+	}
+
+	// the store is reduced to its size, the least recently used responses first
+	reduced, err := NewDiskCacheStore(dir, size-1)
+	if !asserts.NoError(err) {
+		return
+	}
+	asserts.Equal(2, reduced.Len())
+	asserts.Nil(storedCacheEntry(t, reduced, "http://example.com/b", ""))
+	asserts.NotNil(storedCacheEntry(t, reduced, "http://example.com/a", ""))
+	asserts.NotNil(storedCacheEntry(t, reduced, "http://example.com/c", ""))
+}
@@ -0,0 +1,646 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps"
+)
+
+// testCacheOrigin answers the requests with respond, it records the requests
+type testCacheOrigin struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	respond  func(req *http.Request) (*http.Response, error)
+}
+
+func (o *testCacheOrigin) handle(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	o.mu.Lock()
+	o.requests = append(o.requests, req.Clone(context.Background()))
+	respond := o.respond
+	o.mu.Unlock()
+	return respond(req)
+}
+
+func (o *testCacheOrigin) setRespond(respond func(req *http.Request) (*http.Response, error)) {
+	o.mu.Lock()
+	o.respond = respond
+	o.mu.Unlock()
+}
+
+func (o *testCacheOrigin) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.requests)
+}
+
+func (o *testCacheOrigin) last() *http.Request {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests[len(o.requests)-1]
+}
+
+// a respond function answering the status, the body and the header pairs
+func cacheRespond(status int, body string, header ...string) func(req *http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		h := make(http.Header)
+		for i := 0; i+1 < len(header); i += 2 {
+			h.Add(header[i], header[i+1])
+		}
+		return newTestResponse(req, status, h, body), nil
+	}
+}
+
+func newTestCache(opts CacheOptions, respond func(req *http.Request) (*http.Response, error)) (*Cache, *testCacheOrigin, *mps.Context) {
+	cache := NewCache(opts)
+	origin := &testCacheOrigin{respond: respond}
+	return cache, origin, newTestContext(origin.handle, cache)
+}
+
+// serve a GET request of the URL with the header pairs
+func serveCache(t *testing.T, ctx *mps.Context, url string, header ...string) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Add(header[i], header[i+1])
+	}
+	return serve(t, ctx, req)
+}
+
+// an HTTP date of the time shifted by d
+func httpDate(d time.Duration) string {
+	return time.Now().Add(d).UTC().Format(http.TimeFormat)
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Now()
+	date := now.Add(-100 * time.Second)
+	tests := []struct {
+		name     string
+		header   []string
+		status   int
+		request  time.Time
+		response time.Time
+		lifetime time.Duration
+		age      time.Duration
+	}{
+		{
+			name:     "max-age",
+			header:   []string{"Cache-Control", "max-age=60"},
+			lifetime: 60 * time.Second,
+			age:      100 * time.Second,
+		},
+		{
+			name:     "s-maxage wins over max-age",
+			header:   []string{"Cache-Control", "max-age=60, s-maxage=300"},
+			lifetime: 300 * time.Second,
+			age:      100 * time.Second,
+		},
+		{
+			name:     "max-age wins over Expires",
+			header:   []string{"Cache-Control", "max-age=60", "Expires", date.Add(time.Hour).UTC().Format(http.TimeFormat)},
+			lifetime: 60 * time.Second,
+			age:      100 * time.Second,
+		},
+		{
+			name:     "Expires",
+			header:   []string{"Expires", date.Add(time.Hour).UTC().Format(http.TimeFormat)},
+			lifetime: time.Hour,
+			age:      100 * time.Second,
+		},
+		{
+			name:   "invalid Expires is expired",
+			header: []string{"Expires", "0"},
+			age:    100 * time.Second,
+		},
+		{
+			name:     "heuristic",
+			header:   []string{"Last-Modified", date.Add(-100 * time.Minute).UTC().Format(http.TimeFormat)},
+			lifetime: 10 * time.Minute,
+			age:      100 * time.Second,
+		},
+		{
+			name:     "heuristic capped",
+			header:   []string{"Last-Modified", date.Add(-100 * 24 * time.Hour).UTC().Format(http.TimeFormat)},
+			lifetime: 24 * time.Hour,
+			age:      100 * time.Second,
+		},
+		{
+			name:   "heuristic of a status not cacheable by default",
+			status: http.StatusCreated,
+			header: []string{"Last-Modified", date.Add(-100 * time.Minute).UTC().Format(http.TimeFormat)},
+			age:    100 * time.Second,
+		},
+		{
+			name:     "Age header",
+			header:   []string{"Cache-Control", "max-age=600", "Age", "300"},
+			lifetime: 600 * time.Second,
+			age:      400 * time.Second,
+		},
+		{
+			name:     "response delay",
+			header:   []string{"Cache-Control", "max-age=600", "Age", "300"},
+			request:  date.Add(-20 * time.Second),
+			lifetime: 600 * time.Second,
+			age:      420 * time.Second,
+		},
+		{
+			name:     "without Date",
+			header:   []string{"Cache-Control", "max-age=600", "Date", ""},
+			response: now.Add(-10 * time.Second),
+			lifetime: 600 * time.Second,
+			age:      10 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Date": []string{date.UTC().Format(http.TimeFormat)}}
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				header.Set(tt.header[i], tt.header[i+1])
+			}
+			entry := &CacheEntry{StatusCode: tt.status, Header: header, RequestTime: tt.request, ResponseTime: tt.response}
+			if entry.StatusCode == 0 {
+				entry.StatusCode = http.StatusOK
+			}
+			if entry.ResponseTime.IsZero() {
+				entry.ResponseTime = date
+			}
+			if entry.RequestTime.IsZero() {
+				entry.RequestTime = entry.ResponseTime
+			}
+			lifetime, age := freshness(entry, parseCacheControl(header), now)
+			assert.Equal(t, tt.lifetime, lifetime, "lifetime")
+			// the HTTP dates have a precision of a second
+			assert.InDelta(t, tt.age.Seconds(), age.Seconds(), 1, "age")
+		})
+	}
+}
+
+func TestIsFresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		age      time.Duration
+		request  string
+		fresh    bool
+	}{
+		{name: "fresh", lifetime: time.Minute, age: 30 * time.Second, fresh: true},
+		{name: "stale", lifetime: time.Minute, age: time.Minute},
+		{name: "request max-age", lifetime: time.Minute, age: 30 * time.Second, request: "max-age=10"},
+		{name: "request max-age older", lifetime: time.Minute, age: 30 * time.Second, request: "max-age=40", fresh: true},
+		{name: "request min-fresh", lifetime: time.Minute, age: 30 * time.Second, request: "min-fresh=40"},
+		{name: "request min-fresh shorter", lifetime: time.Minute, age: 30 * time.Second, request: "min-fresh=20", fresh: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqCC := parseCacheControl(http.Header{"Cache-Control": []string{tt.request}})
+			assert.Equal(t, tt.fresh, isFresh(tt.lifetime, tt.age, reqCC))
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	header := http.Header{"Cache-Control": []string{`Max-Age=60, no-cache="Set-Cookie, X-Foo", public`, "s-maxage=x"}}
+	cc := parseCacheControl(header)
+	asserts := assert.New(t)
+	asserts.Equal(cacheControl{"max-age": "60", "no-cache": "Set-Cookie, X-Foo", "public": "", "s-maxage": "x"}, cc)
+	d, ok := cc.duration("max-age")
+	asserts.True(ok)
+	asserts.Equal(time.Minute, d)
+	d, ok = cc.duration("s-maxage")
+	asserts.True(ok, "an invalid value is present")
+	asserts.Equal(time.Duration(0), d)
+
+	asserts.True(requestCacheControl(http.Header{"Pragma": []string{"no-cache"}}).has("no-cache"))
+	asserts.False(requestCacheControl(http.Header{"Pragma": []string{"no-cache"}, "Cache-Control": []string{"max-age=5"}}).has("no-cache"),
+		"Pragma is ignored with Cache-Control")
+}
+
+func TestCache_Hit(t *testing.T) {
+	_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "hello", "Cache-Control", "max-age=60", "Date", httpDate(-10*time.Second)))
+
+	asserts := assert.New(t)
+	resp, body := serveCache(t, ctx, "http://example.com/a")
+	asserts.Equal("hello", body)
+	asserts.Equal("MISS", resp.Header.Get("X-Cache"))
+
+	req := httptest.NewRequest(http.MethodGet, "http://EXAMPLE.com:80/a", nil)
+	reqCtx := ctx.WithRequest(req)
+	resp, err := reqCtx.Next(req)
+	if !asserts.NoError(err) {
+		return
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	asserts.Equal("hello", string(data), "the key should be the normalized URL")
+	asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+	asserts.Equal("10", resp.Header.Get("Age"))
+	asserts.Equal("5", resp.Header.Get("Content-Length"))
+	asserts.Equal(int64(5), resp.ContentLength)
+	status, _ := reqCtx.Get(CacheContextKey)
+	asserts.Equal(CacheHit, status)
+	asserts.Equal(1, origin.count())
+
+	// HEAD requests are answered with the stored GET response
+	resp, body = serve(t, ctx, httptest.NewRequest(http.MethodHead, "http://example.com/a", nil))
+	asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+	asserts.Equal("", body)
+	asserts.Equal(1, origin.count())
+}
+
+func TestCache_Storable(t *testing.T) {
+	tests := []struct {
+		name      string
+		reqHeader []string
+		status    int
+		header    []string
+		stored    bool
+	}{
+		{name: "max-age", header: []string{"Cache-Control", "max-age=60"}, stored: true},
+		{name: "Expires", header: []string{"Expires", httpDate(time.Hour)}, stored: true},
+		{name: "no-store", header: []string{"Cache-Control", "max-age=60, no-store"}},
+		{name: "private", header: []string{"Cache-Control", "max-age=60, private"}},
+		{name: "Set-Cookie", header: []string{"Cache-Control", "max-age=60", "Set-Cookie", "a=b"}},
+		{name: "Vary star", header: []string{"Cache-Control", "max-age=60", "Vary", "*"}},
+		{name: "partial content", status: http.StatusPartialContent, header: []string{"Cache-Control", "max-age=60"}},
+		{name: "request no-store", reqHeader: []string{"Cache-Control", "no-store"}, header: []string{"Cache-Control", "max-age=60"}},
+		{name: "Range request", reqHeader: []string{"Range", "bytes=0-1"}, header: []string{"Cache-Control", "max-age=60"}},
+		{name: "Authorization", reqHeader: []string{"Authorization", "Bearer x"}, header: []string{"Cache-Control", "max-age=60"}},
+		{
+			name:      "Authorization public",
+			reqHeader: []string{"Authorization", "Bearer x"},
+			header:    []string{"Cache-Control", "max-age=60, public"},
+			stored:    true,
+		},
+		{name: "without freshness nor validators"},
+		{name: "heuristic", header: []string{"Last-Modified", httpDate(-100 * time.Hour)}, stored: true},
+		{name: "heuristic of a status not cacheable by default", status: http.StatusCreated, header: []string{"Last-Modified", httpDate(-100 * time.Hour)}},
+		{name: "error with max-age", status: http.StatusInternalServerError, header: []string{"Cache-Control", "max-age=60"}, stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(status, "hello", tt.header...))
+			serveCache(t, ctx, "http://example.com/", tt.reqHeader...)
+			resp, body := serveCache(t, ctx, "http://example.com/", tt.reqHeader...)
+
+			asserts := assert.New(t)
+			asserts.Equal("hello", body)
+			asserts.Equal(status, resp.StatusCode)
+			if tt.stored {
+				asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+				asserts.Equal(1, origin.count())
+			} else {
+				asserts.NotEqual("HIT", resp.Header.Get("X-Cache"))
+				asserts.Equal(2, origin.count())
+			}
+		})
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	_, origin, ctx := newTestCache(CacheOptions{}, func(req *http.Request) (*http.Response, error) {
+		header := http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"accept-encoding, Accept-Language"}}
+		return newTestResponse(req, http.StatusOK, header, req.Header.Get("Accept-Encoding")+" "+req.Header.Get("Accept-Language")), nil
+	})
+
+	tests := []struct {
+		header []string
+		body   string
+		cache  string
+	}{
+		{[]string{"Accept-Encoding", "gzip"}, "gzip ", "MISS"},
+		{[]string{"Accept-Encoding", "br"}, "br ", "MISS"},
+		{[]string{"Accept-Encoding", "gzip"}, "gzip ", "HIT"},
+		{[]string{"Accept-Encoding", "br"}, "br ", "HIT"},
+		{[]string{"Accept-Encoding", "gzip", "Accept-Language", "fr"}, "gzip fr", "MISS"},
+		// the values are normalized
+		{[]string{"Accept-Encoding", "gzip,  deflate"}, "gzip,  deflate ", "MISS"},
+		{[]string{"Accept-Encoding", "gzip", "Accept-Encoding", "deflate"}, "gzip,  deflate ", "HIT"},
+		{nil, " ", "MISS"},
+		{nil, " ", "HIT"},
+	}
+	for i, tt := range tests {
+		resp, body := serveCache(t, ctx, "http://example.com/", tt.header...)
+		assert.Equal(t, tt.body, body, "request %d", i)
+		assert.Equal(t, tt.cache, resp.Header.Get("X-Cache"), "request %d", i)
+	}
+	assert.Equal(t, 5, origin.count())
+}
+
+func TestCache_Revalidate(t *testing.T) {
+	_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "one",
+		"Cache-Control", "max-age=0", "ETag", `"v1"`, "Last-Modified", httpDate(-time.Hour), "X-Version", "1"))
+	serveCache(t, ctx, "http://example.com/")
+
+	// the origin validates the stored response
+	origin.setRespond(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("If-None-Match") != `"v1"` {
+			return cacheRespond(http.StatusOK, "unexpected")(req)
+		}
+		return cacheRespond(http.StatusNotModified, "", "Cache-Control", "max-age=60", "X-Version", "2")(req)
+	})
+	asserts := assert.New(t)
+	resp, body := serveCache(t, ctx, "http://example.com/", "If-None-Match", `"other"`)
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+	asserts.Equal("one", body)
+	asserts.Equal("REVALIDATED", resp.Header.Get("X-Cache"))
+	asserts.Equal("2", resp.Header.Get("X-Version"), "the header should be updated")
+	asserts.Equal(`"v1"`, origin.last().Header.Get("If-None-Match"), "the conditional of the client should be replaced")
+	asserts.NotEmpty(origin.last().Header.Get("If-Modified-Since"))
+
+	// the updated response is fresh
+	resp, body = serveCache(t, ctx, "http://example.com/")
+	asserts.Equal("one", body)
+	asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+	asserts.Equal(2, origin.count())
+
+	// the client conditional is answered by the cache
+	resp, body = serveCache(t, ctx, "http://example.com/", "If-None-Match", `W/"v1"`)
+	asserts.Equal(http.StatusNotModified, resp.StatusCode)
+	asserts.Equal("", body)
+	resp, _ = serveCache(t, ctx, "http://example.com/", "If-Modified-Since", httpDate(0))
+	asserts.Equal(http.StatusNotModified, resp.StatusCode)
+	resp, _ = serveCache(t, ctx, "http://example.com/", "If-None-Match", `"v2"`)
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+	asserts.Equal(2, origin.count())
+
+	// no-cache forces the revalidation, a new response replaces the stored one
+	origin.setRespond(cacheRespond(http.StatusOK, "two", "Cache-Control", "max-age=60", "ETag", `"v2"`))
+	resp, body = serveCache(t, ctx, "http://example.com/", "Cache-Control", "no-cache")
+	asserts.Equal("two", body)
+	asserts.Equal("MISS", resp.Header.Get("X-Cache"))
+	resp, body = serveCache(t, ctx, "http://example.com/", "Pragma", "no-cache")
+	asserts.Equal("two", body)
+	asserts.Equal("MISS", resp.Header.Get("X-Cache"))
+	resp, body = serveCache(t, ctx, "http://example.com/")
+	asserts.Equal("two", body)
+	asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+	asserts.Equal(4, origin.count())
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "one",
+		"Cache-Control", "max-age=60, stale-while-revalidate=120", "ETag", `"v1"`, "Date", httpDate(-100*time.Second)))
+	serveCache(t, ctx, "http://example.com/")
+
+	revalidated := make(chan struct{})
+	var once sync.Once
+	origin.setRespond(func(req *http.Request) (*http.Response, error) {
+		defer once.Do(func() {
+			close(revalidated)
+		})
+		return cacheRespond(http.StatusNotModified, "", "Cache-Control", "max-age=60", "Date", httpDate(0))(req)
+	})
+
+	asserts := assert.New(t)
+	resp, body := serveCache(t, ctx, "http://example.com/")
+	asserts.Equal("one", body)
+	asserts.Equal("STALE", resp.Header.Get("X-Cache"), "the stale response should be served while revalidating")
+	select {
+	case <-revalidated:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the response has not been revalidated")
+	}
+	asserts.Equal(`"v1"`, origin.last().Header.Get("If-None-Match"))
+
+	var cache string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline) && cache != "HIT"; time.Sleep(5 * time.Millisecond) {
+		resp, body = serveCache(t, ctx, "http://example.com/")
+		cache = resp.Header.Get("X-Cache")
+	}
+	asserts.Equal("HIT", cache, "the revalidated response should be fresh")
+	asserts.Equal("one", body)
+	asserts.Equal(2, origin.count())
+}
+
+func TestCache_Stale(t *testing.T) {
+	failure := func(req *http.Request) (*http.Response, error) {
+		return cacheRespond(http.StatusInternalServerError, "failure")(req)
+	}
+	tests := []struct {
+		name      string
+		cc        string
+		reqHeader []string
+		respond   func(req *http.Request) (*http.Response, error)
+		body      string
+		cache     string
+	}{
+		{name: "stale-if-error", cc: "max-age=60, stale-if-error=300", respond: failure, body: "one", cache: "STALE"},
+		{
+			name: "origin unreachable", cc: "max-age=60, stale-if-error=300", body: "one", cache: "STALE",
+			respond: func(req *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+		},
+		{name: "stale-if-error exceeded", cc: "max-age=60, stale-if-error=10", respond: failure, body: "failure"},
+		{name: "request stale-if-error", cc: "max-age=60", reqHeader: []string{"Cache-Control", "stale-if-error=300"}, respond: failure, body: "one", cache: "STALE"},
+		{name: "must-revalidate", cc: "max-age=60, must-revalidate, stale-if-error=300", respond: failure, body: "failure"},
+		{name: "s-maxage", cc: "s-maxage=60, stale-if-error=300", respond: failure, body: "failure"},
+		{name: "without stale-if-error", cc: "max-age=60", respond: failure, body: "failure"},
+		{name: "max-stale", cc: "max-age=60", reqHeader: []string{"Cache-Control", "max-stale=300"}, respond: failure, body: "one", cache: "STALE"},
+		{name: "max-stale without value", cc: "max-age=60", reqHeader: []string{"Cache-Control", "max-stale"}, respond: failure, body: "one", cache: "STALE"},
+		{name: "max-stale exceeded", cc: "max-age=60", reqHeader: []string{"Cache-Control", "max-stale=10"}, respond: failure, body: "failure"},
+		{name: "only-if-cached", cc: "max-age=60", reqHeader: []string{"Cache-Control", "only-if-cached"}, respond: failure, body: "504 Gateway Timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the stored response is stale for 40s
+			_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "one",
+				"Cache-Control", tt.cc, "ETag", `"v1"`, "Date", httpDate(-100*time.Second)))
+			serveCache(t, ctx, "http://example.com/")
+			origin.setRespond(tt.respond)
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			for i := 0; i+1 < len(tt.reqHeader); i += 2 {
+				req.Header.Add(tt.reqHeader[i], tt.reqHeader[i+1])
+			}
+			resp, err := ctx.WithRequest(req).Next(req)
+			if err != nil {
+				assert.Equal(t, "", tt.cache, "unexpected error %v", err)
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, tt.body, string(body))
+			assert.Equal(t, tt.cache, resp.Header.Get("X-Cache"))
+		})
+	}
+}
+
+func TestCache_OnlyIfCached(t *testing.T) {
+	_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "hello", "Cache-Control", "max-age=60"))
+	resp, _ := serveCache(t, ctx, "http://example.com/", "Cache-Control", "only-if-cached")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, 0, origin.count())
+
+	serveCache(t, ctx, "http://example.com/")
+	resp, body := serveCache(t, ctx, "http://example.com/", "Cache-Control", "only-if-cached")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, 1, origin.count())
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		header   []string
+		removed  []string
+		retained []string
+	}{
+		{
+			name:     "POST",
+			method:   http.MethodPost,
+			status:   http.StatusCreated,
+			header:   []string{"Location", "/b", "Content-Location", "http://example.com/c"},
+			removed:  []string{"/a", "/b", "/c"},
+			retained: []string{"/d"},
+		},
+		{
+			name:     "other host",
+			method:   http.MethodPut,
+			status:   http.StatusOK,
+			header:   []string{"Location", "http://other.com/b"},
+			removed:  []string{"/a"},
+			retained: []string{"/b", "/c", "/d"},
+		},
+		{name: "DELETE", method: http.MethodDelete, status: http.StatusNoContent, removed: []string{"/a"}, retained: []string{"/b"}},
+		{name: "failure", method: http.MethodPost, status: http.StatusBadRequest, retained: []string{"/a", "/b"}},
+		{name: "safe method", method: http.MethodOptions, status: http.StatusOK, retained: []string{"/a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "stored", "Cache-Control", "max-age=60"))
+			for _, path := range []string{"/a", "/b", "/c", "/d"} {
+				serveCache(t, ctx, "http://example.com"+path)
+			}
+
+			origin.setRespond(cacheRespond(tt.status, "", tt.header...))
+			resp, _ := serve(t, ctx, httptest.NewRequest(tt.method, "http://example.com/a", strings.NewReader("data")))
+			assert.Equal(t, tt.status, resp.StatusCode)
+
+			origin.setRespond(cacheRespond(http.StatusOK, "new", "Cache-Control", "max-age=60"))
+			for _, path := range tt.removed {
+				_, body := serveCache(t, ctx, "http://example.com"+path)
+				assert.Equal(t, "new", body, path)
+			}
+			for _, path := range tt.retained {
+				_, body := serveCache(t, ctx, "http://example.com"+path)
+				assert.Equal(t, "stored", body, path)
+			}
+		})
+	}
+}
+
+func TestCache_PurgeClear(t *testing.T) {
+	cache, origin, ctx := newTestCache(CacheOptions{}, cacheRespond(http.StatusOK, "hello", "Cache-Control", "max-age=60"))
+	serveCache(t, ctx, "http://example.com/a")
+	serveCache(t, ctx, "http://example.com/b")
+
+	asserts := assert.New(t)
+	asserts.Error(cache.Purge("/a"), "the URL should be absolute")
+	asserts.NoError(cache.Purge("http://EXAMPLE.com:80/a"))
+	resp, _ := serveCache(t, ctx, "http://example.com/a")
+	asserts.Equal("MISS", resp.Header.Get("X-Cache"))
+	resp, _ = serveCache(t, ctx, "http://example.com/b")
+	asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+
+	asserts.NoError(cache.Clear())
+	resp, _ = serveCache(t, ctx, "http://example.com/b")
+	asserts.Equal("MISS", resp.Header.Get("X-Cache"))
+	asserts.Equal(4, origin.count())
+}
+
+func TestCache_Body(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		// the number of bytes read by the client before it closes the body, -1 reads it all
+		read   int
+		stored bool
+		// the body has no Content-Length
+		chunked bool
+	}{
+		{name: "complete", status: http.StatusOK, body: "hello", read: -1, stored: true},
+		{name: "too large", status: http.StatusOK, body: "hello world", read: -1},
+		{name: "too large without length", status: http.StatusOK, body: "hello world", read: -1, chunked: true},
+		{name: "without length", status: http.StatusOK, body: "hello", read: -1, chunked: true, stored: true},
+		{name: "aborted without length", status: http.StatusOK, body: "hello", read: 5, chunked: true},
+		{name: "aborted", status: http.StatusOK, body: "hello", read: 2},
+		{name: "read without EOF", status: http.StatusOK, body: "hello", read: 5, stored: true},
+		{name: "empty body not read", status: http.StatusNoContent, read: 0, stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryCacheStore(0)
+			respond := cacheRespond(tt.status, tt.body, "Cache-Control", "max-age=60")
+			_, origin, ctx := newTestCache(CacheOptions{Store: store, MaxEntrySize: 8}, func(req *http.Request) (*http.Response, error) {
+				resp, err := respond(req)
+				if tt.chunked {
+					resp.ContentLength = -1
+				}
+				return resp, err
+			})
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			resp, err := ctx.WithRequest(req).Next(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.read < 0 {
+				_, _ = io.ReadAll(resp.Body)
+			} else {
+				_, _ = io.ReadFull(resp.Body, make([]byte, tt.read))
+			}
+			resp.Body.Close()
+
+			asserts := assert.New(t)
+			if !tt.stored {
+				asserts.Equal(0, store.Len())
+				return
+			}
+			asserts.Equal(1, store.Len())
+			resp, body := serveCache(t, ctx, "http://example.com/")
+			asserts.Equal("HIT", resp.Header.Get("X-Cache"))
+			asserts.Equal(tt.status, resp.StatusCode)
+			asserts.Equal(tt.body, body)
+			asserts.Equal(1, origin.count())
+		})
+	}
+}
+
+func TestCache_DiskStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskCacheStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, origin, ctx := newTestCache(CacheOptions{Store: store}, cacheRespond(http.StatusOK, "hello", "Cache-Control", "max-age=60"))
+	serveCache(t, ctx, "http://example.com/")
+
+	// another proxy reuses the stored responses
+	store, err = NewDiskCacheStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ctx = newTestCache(CacheOptions{Store: store}, func(req *http.Request) (*http.Response, error) {
+		return origin.handle(req, nil)
+	})
+	resp, body := serveCache(t, ctx, "http://example.com/")
+	assert.Equal(t, "HIT", resp.Header.Get("X-Cache"))
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, 1, origin.count())
+}
@@ -0,0 +1,504 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/telanflow/mps"
+)
+
+// DefaultCassetteMaxBodySize is the default size cap of the recorded bodies
+const DefaultCassetteMaxBodySize = 10 << 20
+
+// CassetteMissErr is returned in replay mode when no interaction matches the request
+var CassetteMissErr = errors.New("cassette: no recorded interaction matches the request")
+
+// CassetteMode is the mode of the Cassette
+type CassetteMode int
+
+const (
+	// CassetteRecord sends the requests to the Transport, and stores the interactions
+	CassetteRecord CassetteMode = iota
+	// CassetteReplay answers the requests with the stored interactions
+	CassetteReplay
+)
+
+// CassetteMissPolicy is the handling of the requests without interaction in replay mode
+type CassetteMissPolicy int
+
+const (
+	// CassetteMissFail fails the request with CassetteMissErr
+	CassetteMissFail CassetteMissPolicy = iota
+	// CassetteMissPassthrough sends the request to the Transport
+	CassetteMissPassthrough
+	// CassetteMissRecord sends the request to the Transport, and stores the interaction
+	CassetteMissRecord
+)
+
+// CassetteMatcher reports whether the request matches a recorded interaction.
+// body is the body of the request.
+type CassetteMatcher func(req *http.Request, body []byte, interaction *CassetteInteraction) bool
+
+// DefaultCassetteMatchers match the method, the URL and the body of the requests
+var DefaultCassetteMatchers = []CassetteMatcher{MatchMethod, MatchURL, MatchBody}
+
+// CassetteOptions is the configuration of the Cassette
+type CassetteOptions struct {
+	// Dir is the cassette directory, one JSON file per interaction
+	Dir string
+
+	// Mode is CassetteRecord by default
+	Mode CassetteMode
+
+	// Miss is the handling of the unmatched requests in replay mode, CassetteMissFail by default
+	Miss CassetteMissPolicy
+
+	// Matchers must all match for an interaction to be replayed, DefaultCassetteMatchers by default
+	Matchers []CassetteMatcher
+
+	// MaxBodySize caps the request and response bodies, DefaultCassetteMaxBodySize by default.
+	// The exchanges with a larger body are proxied, they are neither recorded nor replayed.
+	MaxBodySize int64
+
+	// RecordCredentials records the Authorization, Proxy-Authorization and Cookie headers
+	// of the requests as they are. By default their values are redacted.
+	RecordCredentials bool
+}
+
+// CassetteInteraction is a recorded request and response
+type CassetteInteraction struct {
+	Request    CassetteRequest  `json:"request"`
+	Response   CassetteResponse `json:"response"`
+	RecordedAt time.Time        `json:"recordedAt"`
+
+	// file is the name of the interaction file
+	file string
+}
+
+// CassetteRequest is a recorded request
+type CassetteRequest struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body,omitempty"`
+	Encoding string      `json:"encoding,omitempty"`
+	BodyHash string      `json:"bodyHash"`
+}
+
+// CassetteResponse is a recorded response
+type CassetteResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+	Encoding   string      `json:"encoding,omitempty"`
+}
+
+// Cassette is a middleware recording the exchanges seen by Context.Next to a directory,
+// and replaying them without touching the Transport, for deterministic tests.
+// The CONNECT and websocket upgrade requests are not recorded, the decrypted MITM requests are.
+type Cassette struct {
+	opts CassetteOptions
+
+	mu           sync.Mutex
+	interactions []*CassetteInteraction
+	replayed     map[*CassetteInteraction]bool
+}
+
+// NewCassette Create a Cassette, the interactions of the directory are loaded for replay
+func NewCassette(opts CassetteOptions) (*Cassette, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("cassette: no directory")
+	}
+	if opts.Matchers == nil {
+		opts.Matchers = DefaultCassetteMatchers
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DefaultCassetteMaxBodySize
+	}
+	c := &Cassette{
+		opts:     opts,
+		replayed: make(map[*CassetteInteraction]bool),
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Handle implements mps.Middleware
+func (c *Cassette) Handle(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	// The tunnels can't be recorded
+	if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+		return ctx.Next(req)
+	}
+
+	body, complete, err := readRequestBody(req, c.opts.MaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+
+	// A request with a body too large can't be matched, it is a miss
+	record := c.opts.Mode == CassetteRecord && complete
+	if c.opts.Mode == CassetteReplay {
+		if complete {
+			if interaction := c.match(req, body); interaction != nil {
+				return interaction.Response.response(req), nil
+			}
+		}
+		switch c.opts.Miss {
+		case CassetteMissPassthrough:
+		case CassetteMissRecord:
+			record = complete
+		default:
+			return nil, fmt.Errorf("%w: %s %s", CassetteMissErr, req.Method, req.URL)
+		}
+	}
+
+	interaction := &CassetteInteraction{
+		Request:    newCassetteRequest(req, body, !c.opts.RecordCredentials),
+		RecordedAt: time.Now(),
+	}
+	resp, err := ctx.Next(req)
+	if err != nil || !record {
+		return resp, err
+	}
+
+	// The interaction is stored when the response body has been read completely.
+	// The responses without body, like the responses to HEAD requests, are stored at once.
+	// A body closed before its end is not stored.
+	interaction.Response = CassetteResponse{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	}
+	if resp.Body == nil || resp.Body == http.NoBody || resp.ContentLength == 0 {
+		_ = c.save(interaction)
+		return resp, nil
+	}
+	ctx.WrapResponseBody(resp, func(body io.ReadCloser) io.ReadCloser {
+		return &cassetteBody{ReadCloser: body, max: c.opts.MaxBodySize, length: resp.ContentLength, done: func(data []byte) {
+			interaction.Response.Body, interaction.Response.Encoding = encodeCassetteBody(data)
+			// The recording must not break the proxy
+			_ = c.save(interaction)
+		}}
+	})
+	return resp, nil
+}
+
+// Interactions returns the number of interactions of the cassette
+func (c *Cassette) Interactions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.interactions)
+}
+
+// Rewind allows the replayed interactions to be replayed again in order
+func (c *Cassette) Rewind() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replayed = make(map[*CassetteInteraction]bool)
+}
+
+// match returns the interaction to replay for the request. The matching interactions are
+// replayed in the order they were recorded, the last one is repeated.
+func (c *Cassette) match(req *http.Request, body []byte) *CassetteInteraction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var last *CassetteInteraction
+	for _, interaction := range c.interactions {
+		if !c.matches(req, body, interaction) {
+			continue
+		}
+		if !c.replayed[interaction] {
+			c.replayed[interaction] = true
+			return interaction
+		}
+		last = interaction
+	}
+	return last
+}
+
+func (c *Cassette) matches(req *http.Request, body []byte, interaction *CassetteInteraction) bool {
+	for _, matcher := range c.opts.Matchers {
+		if !matcher(req, body, interaction) {
+			return false
+		}
+	}
+	return true
+}
+
+// load reads the interactions of the directory, in the order they were recorded
+func (c *Cassette) load() error {
+	files, err := filepath.Glob(filepath.Join(c.opts.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		interaction := &CassetteInteraction{file: filepath.Base(file)}
+		if err = json.Unmarshal(data, interaction); err != nil {
+			return fmt.Errorf("cassette: %s: %w", file, err)
+		}
+		c.interactions = append(c.interactions, interaction)
+	}
+	sort.SliceStable(c.interactions, func(i, j int) bool {
+		a, b := c.interactions[i], c.interactions[j]
+		if !a.RecordedAt.Equal(b.RecordedAt) {
+			return a.RecordedAt.Before(b.RecordedAt)
+		}
+		return a.file < b.file
+	})
+	return nil
+}
+
+// save writes the interaction to a new file of the directory
+func (c *Cassette) save(interaction *CassetteInteraction) error {
+	data, err := json.MarshalIndent(interaction, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := interaction.Request.key()
+	for n := 1; ; n++ {
+		name := fmt.Sprintf("%s-%d.json", key, n)
+		f, err := os.OpenFile(filepath.Join(c.opts.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		interaction.file = name
+		c.interactions = append(c.interactions, interaction)
+		// The new interaction has been seen, it is not replayed before the older ones
+		c.replayed[interaction] = true
+		return nil
+	}
+}
+
+// MatchMethod is a CassetteMatcher comparing the methods
+func MatchMethod(req *http.Request, _ []byte, interaction *CassetteInteraction) bool {
+	return req.Method == interaction.Request.Method
+}
+
+// MatchURL is a CassetteMatcher comparing the URLs
+func MatchURL(req *http.Request, _ []byte, interaction *CassetteInteraction) bool {
+	return req.URL.String() == interaction.Request.URL
+}
+
+// MatchBody is a CassetteMatcher comparing the hashes of the bodies
+func MatchBody(_ *http.Request, body []byte, interaction *CassetteInteraction) bool {
+	return bodyHash(body) == interaction.Request.BodyHash
+}
+
+// MatchHeaders returns a CassetteMatcher comparing the values of the headers.
+// The redacted credentials only match the requests with the header.
+func MatchHeaders(names ...string) CassetteMatcher {
+	return func(req *http.Request, _ []byte, interaction *CassetteInteraction) bool {
+		for _, name := range names {
+			values := req.Header.Values(name)
+			recorded := interaction.Request.Header.Values(name)
+			if isCredentialHeader(name) && len(recorded) > 0 && recorded[0] == redacted {
+				values = redactValues(values)
+			}
+			if strings.Join(values, ",") != strings.Join(recorded, ",") {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func newCassetteRequest(req *http.Request, body []byte, redact bool) CassetteRequest {
+	header := req.Header.Clone()
+	if redact {
+		for name, values := range header {
+			if isCredentialHeader(name) {
+				header[name] = redactValues(values)
+			}
+		}
+	}
+	r := CassetteRequest{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Header:   header,
+		BodyHash: bodyHash(body),
+	}
+	r.Body, r.Encoding = encodeCassetteBody(body)
+	return r
+}
+
+// key names the interaction files of the request
+func (r *CassetteRequest) key() string {
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL + " " + r.BodyHash))
+	return strings.ToLower(r.Method) + "-" + hex.EncodeToString(sum[:8])
+}
+
+// response creates the response replayed to req
+func (r *CassetteResponse) response(req *http.Request) *http.Response {
+	body := decodeCassetteBody(r.Body, r.Encoding)
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// redactValues returns as many redacted values
+func redactValues(values []string) []string {
+	redactedValues := make([]string, len(values))
+	for i := range redactedValues {
+		redactedValues[i] = redacted
+	}
+	return redactedValues
+}
+
+// cassetteBody buffers the response body up to max bytes, done is called once it has
+// been read completely. done is not called if the body is larger than max, fails,
+// or is closed before its end.
+type cassetteBody struct {
+	io.ReadCloser
+	buf    bytes.Buffer
+	max    int64
+	length int64
+	failed bool
+	done   func(data []byte)
+	once   sync.Once
+}
+
+func (b *cassetteBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.write(p[:n])
+	switch {
+	case err == io.EOF:
+		b.commit()
+	case err != nil:
+		b.failed = true
+	}
+	return n, err
+}
+
+// Close doesn't read the rest of the body, the client may have gone away
+// while the upstream keeps sending. The body is complete if its length is known
+// and has been read, without seeing io.EOF.
+func (b *cassetteBody) Close() error {
+	if b.length < 0 || int64(b.buf.Len()) != b.length {
+		b.failed = true
+	}
+	b.commit()
+	return b.ReadCloser.Close()
+}
+
+// write buffers p, the buffer is released when the body is too large
+func (b *cassetteBody) write(p []byte) {
+	if b.failed {
+		return
+	}
+	if int64(b.buf.Len()+len(p)) > b.max {
+		b.failed = true
+		b.buf = bytes.Buffer{}
+		return
+	}
+	b.buf.Write(p)
+}
+
+func (b *cassetteBody) commit() {
+	if b.failed {
+		return
+	}
+	b.once.Do(func() {
+		b.done(b.buf.Bytes())
+	})
+}
+
+// readRequestBody reads the body of the request up to max bytes, the body is replaced
+// to be read again. If the body is larger, complete is false and the returned bytes
+// are only the beginning of the body. If max is negative, the size is not limited.
+func readRequestBody(req *http.Request, max int64) (body []byte, complete bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	r := io.Reader(req.Body)
+	if max >= 0 {
+		r = io.LimitReader(req.Body, max+1)
+	}
+	body, err = io.ReadAll(r)
+	if err != nil {
+		_ = req.Body.Close()
+		return nil, false, err
+	}
+	if max >= 0 && int64(len(body)) > max {
+		// The rest of the body is read after the beginning
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return body[:max], false, nil
+	}
+	_ = req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true, nil
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeCassetteBody returns the body as text, or in base64 if it is binary
+func encodeCassetteBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeCassetteBody(body, encoding string) []byte {
+	if encoding == "base64" {
+		data, err := base64.StdEncoding.DecodeString(body)
+		if err == nil {
+			return data
+		}
+	}
+	return []byte(body)
+}
@@ -0,0 +1,388 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps"
+)
+
+func newTestCassette(t *testing.T, opts CassetteOptions) *Cassette {
+	t.Helper()
+	c, err := NewCassette(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// an origin answering the number of the request
+func newTestCounterOrigin(count *int) mps.MiddlewareFunc {
+	return func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		if req.Body != nil {
+			_, _ = io.Copy(io.Discard, req.Body)
+		}
+		*count++
+		return newTestResponse(req, http.StatusOK, nil, strconv.Itoa(*count)), nil
+	}
+}
+
+// an origin failing the test, the replayed requests must not reach it
+func newTestUnreachableOrigin(t *testing.T) mps.MiddlewareFunc {
+	return func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		t.Errorf("unexpected request to the origin: %s %s", req.Method, req.URL)
+		return nil, errors.New("unreachable")
+	}
+}
+
+// read the recorded interaction files of the directory
+func cassetteFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func TestCassette_RecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	var count int
+	recorder := newTestCassette(t, CassetteOptions{Dir: dir})
+	ctx := newTestContext(newTestCounterOrigin(&count), recorder)
+	serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/seq", nil))
+	serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/seq", nil))
+	serve(t, ctx, httptest.NewRequest(http.MethodPost, "http://example.com/post", strings.NewReader("\x00\xff")))
+
+	asserts := assert.New(t)
+	asserts.Equal(3, recorder.Interactions())
+	asserts.Len(cassetteFiles(t, dir), 3)
+
+	player := newTestCassette(t, CassetteOptions{Dir: dir, Mode: CassetteReplay})
+	ctx = newTestContext(newTestUnreachableOrigin(t), player)
+	asserts.Equal(3, player.Interactions())
+
+	// the interactions are replayed in order, the last one is repeated
+	for _, want := range []string{"1", "2", "2"} {
+		resp, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/seq", nil))
+		asserts.Equal(http.StatusOK, resp.StatusCode)
+		asserts.Equal(want, body)
+	}
+	player.Rewind()
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/seq", nil))
+	asserts.Equal("1", body)
+
+	// the binary bodies are recorded in base64
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodPost, "http://example.com/post", strings.NewReader("\x00\xff")))
+	asserts.Equal("3", body)
+}
+
+func TestCassette_Miss(t *testing.T) {
+	tests := []struct {
+		name         string
+		miss         CassetteMissPolicy
+		err          error
+		count        int
+		interactions int
+	}{
+		{name: "fail", miss: CassetteMissFail, err: CassetteMissErr, interactions: 1},
+		{name: "passthrough", miss: CassetteMissPassthrough, count: 1, interactions: 1},
+		{name: "record", miss: CassetteMissRecord, count: 1, interactions: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var count int
+			recorder := newTestCassette(t, CassetteOptions{Dir: dir})
+			serve(t, newTestContext(newTestCounterOrigin(&count), recorder),
+				httptest.NewRequest(http.MethodGet, "http://example.com/recorded", nil))
+
+			count = 0
+			player := newTestCassette(t, CassetteOptions{Dir: dir, Mode: CassetteReplay, Miss: tt.miss})
+			ctx := newTestContext(newTestCounterOrigin(&count), player)
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/missing", nil)
+			resp, err := ctx.WithRequest(req).Next(req)
+
+			asserts := assert.New(t)
+			if tt.err != nil {
+				asserts.ErrorIs(err, tt.err)
+			} else if asserts.NoError(err) {
+				_, _ = io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+			asserts.Equal(tt.count, count)
+			asserts.Equal(tt.interactions, player.Interactions())
+			asserts.Len(cassetteFiles(t, dir), tt.interactions)
+		})
+	}
+}
+
+func TestCassette_Matchers(t *testing.T) {
+	newRequest := func(method, url, body, env string) *http.Request {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("X-Env", env)
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		matchers []CassetteMatcher
+		req      *http.Request
+		match    bool
+	}{
+		{name: "same request", req: newRequest(http.MethodPost, "http://example.com/a?q=1", "body", "test"), match: true},
+		{name: "method", req: newRequest(http.MethodPut, "http://example.com/a?q=1", "body", "test")},
+		{name: "url", req: newRequest(http.MethodPost, "http://example.com/a?q=2", "body", "test")},
+		{name: "body", req: newRequest(http.MethodPost, "http://example.com/a?q=1", "other", "test")},
+		{
+			name:     "body ignored",
+			matchers: []CassetteMatcher{MatchMethod, MatchURL},
+			req:      newRequest(http.MethodPost, "http://example.com/a?q=1", "other", "test"),
+			match:    true,
+		},
+		{
+			name:     "header",
+			matchers: []CassetteMatcher{MatchMethod, MatchURL, MatchHeaders("X-Env")},
+			req:      newRequest(http.MethodPost, "http://example.com/a?q=1", "other", "prod"),
+		},
+		{
+			name:     "same header",
+			matchers: []CassetteMatcher{MatchMethod, MatchURL, MatchHeaders("X-Env")},
+			req:      newRequest(http.MethodPost, "http://example.com/a?q=1", "other", "test"),
+			match:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var count int
+			recorder := newTestCassette(t, CassetteOptions{Dir: dir})
+			serve(t, newTestContext(newTestCounterOrigin(&count), recorder),
+				newRequest(http.MethodPost, "http://example.com/a?q=1", "body", "test"))
+
+			player := newTestCassette(t, CassetteOptions{Dir: dir, Mode: CassetteReplay, Matchers: tt.matchers})
+			ctx := newTestContext(newTestUnreachableOrigin(t), player)
+			_, err := ctx.WithRequest(tt.req).Next(tt.req)
+			if tt.match {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, CassetteMissErr)
+			}
+		})
+	}
+}
+
+func TestCassette_Credentials(t *testing.T) {
+	newRequest := func(token string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+		req.Header.Set("Cookie", "session=client-secret")
+		return req
+	}
+	secrets := []string{"Bearer token", "Zm9vOmJhcg==", "client-secret"}
+
+	tests := []struct {
+		name   string
+		opts   CassetteOptions
+		stored bool
+		// another token matches the recorded Authorization
+		anyToken bool
+	}{
+		{name: "redacted by default", anyToken: true},
+		{name: "recorded", opts: CassetteOptions{RecordCredentials: true}, stored: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var count int
+			tt.opts.Dir = dir
+			recorder := newTestCassette(t, tt.opts)
+			serve(t, newTestContext(newTestCounterOrigin(&count), recorder), newRequest("token"))
+
+			asserts := assert.New(t)
+			files := cassetteFiles(t, dir)
+			if !asserts.Len(files, 1) {
+				return
+			}
+			for _, secret := range secrets {
+				asserts.Equal(tt.stored, strings.Contains(files[0], secret), secret)
+			}
+
+			tt.opts.Mode = CassetteReplay
+			tt.opts.Matchers = []CassetteMatcher{MatchMethod, MatchURL, MatchHeaders("Authorization")}
+			ctx := newTestContext(newTestUnreachableOrigin(t), newTestCassette(t, tt.opts))
+			req := newRequest("token")
+			_, err := ctx.WithRequest(req).Next(req)
+			asserts.NoError(err)
+
+			req = newRequest("other")
+			_, err = ctx.WithRequest(req).Next(req)
+			asserts.Equal(tt.anyToken, err == nil, "%v", err)
+
+			// a request without credentials doesn't match the redacted ones
+			req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			_, err = ctx.WithRequest(req).Next(req)
+			asserts.ErrorIs(err, CassetteMissErr)
+		})
+	}
+}
+
+func TestCassette_Close(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+		body   string
+		// the number of bytes read by the client before it closes the body
+		read     int
+		recorded bool
+	}{
+		{name: "HEAD", method: http.MethodHead, status: http.StatusOK, recorded: true},
+		{name: "no content", method: http.MethodDelete, status: http.StatusNoContent, recorded: true},
+		{name: "not modified", method: http.MethodGet, status: http.StatusNotModified, recorded: true},
+		{name: "read without EOF", method: http.MethodGet, status: http.StatusOK, body: "hello world", read: 11, recorded: true},
+		{name: "aborted", method: http.MethodGet, status: http.StatusOK, body: "hello world", read: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			origin := func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+				resp := newTestResponse(req, tt.status, nil, tt.body)
+				if tt.body == "" {
+					resp.Body = http.NoBody
+				}
+				return resp, nil
+			}
+			recorder := newTestCassette(t, CassetteOptions{Dir: dir})
+			ctx := newTestContext(origin, recorder)
+			req := httptest.NewRequest(tt.method, "http://example.com/", nil)
+			resp, err := ctx.WithRequest(req).Next(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the body is closed without being read to the end
+			_, _ = io.ReadFull(resp.Body, make([]byte, tt.read))
+			asserts := assert.New(t)
+			asserts.NoError(resp.Body.Close())
+			if !tt.recorded {
+				asserts.Equal(0, recorder.Interactions(), "a partial body should not be recorded")
+				asserts.Empty(cassetteFiles(t, dir))
+				return
+			}
+			asserts.Equal(1, recorder.Interactions())
+
+			player := newTestCassette(t, CassetteOptions{Dir: dir, Mode: CassetteReplay})
+			resp, body := serve(t, newTestContext(newTestUnreachableOrigin(t), player),
+				httptest.NewRequest(tt.method, "http://example.com/", nil))
+			asserts.Equal(tt.status, resp.StatusCode)
+			asserts.Equal(tt.body, body)
+		})
+	}
+}
+
+// endlessBody is a response body sent slowly and never ending, like a stream of events
+type endlessBody struct {
+	reads  int
+	closed chan struct{}
+}
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	select {
+	case <-b.closed:
+		return 0, errors.New("read on closed body")
+	case <-time.After(time.Millisecond):
+	}
+	b.reads++
+	return copy(p, "data: event\n\n"), nil
+}
+
+func (b *endlessBody) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestCassette_CloseEndless(t *testing.T) {
+	dir := t.TempDir()
+	upstream := &endlessBody{closed: make(chan struct{})}
+	origin := func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		resp := newTestResponse(req, http.StatusOK, http.Header{"Content-Type": []string{"text/event-stream"}}, "")
+		resp.Body = upstream
+		resp.ContentLength = -1
+		return resp, nil
+	}
+	recorder := newTestCassette(t, CassetteOptions{Dir: dir})
+	ctx := newTestContext(origin, recorder)
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/events", nil)
+	resp, err := ctx.WithRequest(req).Next(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.ReadFull(resp.Body, make([]byte, 20))
+	reads := upstream.reads
+
+	// the client goes away
+	closed := make(chan error)
+	go func() {
+		closed <- resp.Body.Close()
+	}()
+	asserts := assert.New(t)
+	select {
+	case err = <-closed:
+		asserts.NoError(err)
+	case <-time.After(time.Second):
+		t.Fatal("Close should not read the rest of the body")
+	}
+	asserts.Equal(reads, upstream.reads, "the upstream should not be read after Close")
+	asserts.Equal(0, recorder.Interactions())
+	asserts.Empty(cassetteFiles(t, dir))
+}
+
+func TestCassette_MaxBodySize(t *testing.T) {
+	dir := t.TempDir()
+	var received string
+	origin := func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		data, _ := io.ReadAll(req.Body)
+		received = string(data)
+		return newTestResponse(req, http.StatusOK, nil, req.URL.Query().Get("body")), nil
+	}
+	recorder := newTestCassette(t, CassetteOptions{Dir: dir, MaxBodySize: 4})
+	ctx := newTestContext(origin, recorder)
+
+	asserts := assert.New(t)
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/?body=large+response", nil))
+	asserts.Equal("large response", body, "the client should receive the whole body")
+	asserts.Equal(0, recorder.Interactions())
+
+	serve(t, ctx, httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("large request")))
+	asserts.Equal("large request", received, "the origin should receive the whole body")
+	asserts.Equal(0, recorder.Interactions())
+
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodPost, "http://example.com/?body=1234", strings.NewReader("1234")))
+	asserts.Equal("1234", body)
+	asserts.Equal(1, recorder.Interactions(), "the bodies of the cap size should be recorded")
+
+	// a large request can't be replayed
+	player := newTestCassette(t, CassetteOptions{Dir: dir, Mode: CassetteReplay, MaxBodySize: 4})
+	ctx = newTestContext(newTestUnreachableOrigin(t), player)
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/?body=1234", strings.NewReader("12345"))
+	_, err := ctx.WithRequest(req).Next(req)
+	asserts.ErrorIs(err, CassetteMissErr)
+}
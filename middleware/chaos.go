@@ -0,0 +1,307 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/telanflow/mps"
+)
+
+// ChaosContextKey is the key of the faults injected in the Context of the request
+const ChaosContextKey = "chaos"
+
+// ChaosFaultKind is the kind of a fault injected by the Chaos middleware
+type ChaosFaultKind string
+
+const (
+	// ChaosLatency delays the request
+	ChaosLatency ChaosFaultKind = "latency"
+	// ChaosStatus answers a synthetic response
+	ChaosStatus ChaosFaultKind = "status"
+	// ChaosTruncate cuts the response body
+	ChaosTruncate ChaosFaultKind = "truncate"
+	// ChaosReset resets the client connection
+	ChaosReset ChaosFaultKind = "reset"
+	// ChaosThrottle slows down the response body
+	ChaosThrottle ChaosFaultKind = "throttle"
+)
+
+// ChaosFault is a fault injected in a request
+type ChaosFault struct {
+	// Rule is the name of the rule injecting the fault
+	Rule string
+	// Kind of the fault
+	Kind ChaosFaultKind
+	// Value of the fault, e.g. the latency or the status code
+	Value string
+}
+
+func (f ChaosFault) String() string {
+	return fmt.Sprintf("%s: %s %s", f.Rule, f.Kind, f.Value)
+}
+
+// ChaosRule injects faults in the requests matching its filters
+type ChaosRule struct {
+	// Name of the rule, recorded with the faults
+	Name string
+
+	// Filters select the requests, all of them must match.
+	// If empty, the rule applies to every request.
+	Filters []mps.Filter
+
+	// Probability of injecting the faults in a matching request, between 0 and 1
+	Probability float64
+
+	// Latency delays the request
+	Latency time.Duration
+
+	// Status answers a synthetic response with this status code, e.g. 503,
+	// instead of forwarding the request
+	Status int
+
+	// Reset resets the client connection.
+	// The tunnels are reset before they are established.
+	Reset bool
+
+	// Truncate cuts the response body after TruncateAfter bytes,
+	// the client receives a body shorter than its Content-Length
+	Truncate      bool
+	TruncateAfter int64
+
+	// Throttle is the number of bytes per second of the response body.
+	// If zero, the body is not throttled. The throttled body fails
+	// when the request or the Context is canceled.
+	Throttle int64
+}
+
+// match reports whether the rule applies to the request
+func (r *ChaosRule) match(req *http.Request) bool {
+	for _, f := range r.Filters {
+		if !f.Match(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// Chaos is a middleware injecting faults to test the resilience of the clients:
+// latency, synthetic 5xx responses, truncated or throttled bodies and connection resets.
+// The rules can be changed at runtime, the injected faults are recorded
+// in the Context of the request, see ChaosFaults.
+type Chaos struct {
+	// Rand returns a number in [0, 1) drawn for each matching rule.
+	// If nil, math/rand is used.
+	Rand func() float64
+
+	mu    sync.RWMutex
+	rules []ChaosRule
+}
+
+// NewChaos Create a Chaos middleware
+func NewChaos(rules ...ChaosRule) *Chaos {
+	c := &Chaos{}
+	c.SetRules(rules...)
+	return c
+}
+
+// SetRules replaces the rules
+func (c *Chaos) SetRules(rules ...ChaosRule) {
+	rules = append([]ChaosRule(nil), rules...)
+	c.mu.Lock()
+	c.rules = rules
+	c.mu.Unlock()
+}
+
+// AddRule appends a rule
+func (c *Chaos) AddRule(rule ChaosRule) {
+	c.mu.Lock()
+	c.rules = append(c.rules[:len(c.rules):len(c.rules)], rule)
+	c.mu.Unlock()
+}
+
+// Rules returns the rules
+func (c *Chaos) Rules() []ChaosRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]ChaosRule(nil), c.rules...)
+}
+
+// Handle implements mps.Middleware
+func (c *Chaos) Handle(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	var (
+		faults   []ChaosFault
+		latency  time.Duration
+		status   int
+		reset    bool
+		truncate int64 = -1
+		throttle int64
+	)
+	add := func(rule *ChaosRule, kind ChaosFaultKind, value string) {
+		faults = append(faults, ChaosFault{Rule: rule.Name, Kind: kind, Value: value})
+	}
+
+	c.mu.RLock()
+	rules := c.rules
+	c.mu.RUnlock()
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.match(req) || c.rand() >= rule.Probability {
+			continue
+		}
+		if rule.Latency > 0 {
+			latency += rule.Latency
+			add(rule, ChaosLatency, rule.Latency.String())
+		}
+		if rule.Reset {
+			reset = true
+			add(rule, ChaosReset, "")
+		}
+		if rule.Status > 0 && status == 0 {
+			status = rule.Status
+			add(rule, ChaosStatus, strconv.Itoa(rule.Status))
+		}
+		if rule.Truncate && (truncate < 0 || rule.TruncateAfter < truncate) {
+			truncate = rule.TruncateAfter
+			add(rule, ChaosTruncate, strconv.FormatInt(rule.TruncateAfter, 10))
+		}
+		if rule.Throttle > 0 && (throttle == 0 || rule.Throttle < throttle) {
+			throttle = rule.Throttle
+			add(rule, ChaosThrottle, strconv.FormatInt(rule.Throttle, 10))
+		}
+	}
+	if len(faults) == 0 {
+		return ctx.Next(req)
+	}
+	ctx.Set(ChaosContextKey, faults)
+
+	if err := chaosSleep(latency, req.Context(), ctx.Context); err != nil {
+		return nil, err
+	}
+	if reset {
+		return nil, mps.ConnectionResetErr
+	}
+	if status > 0 {
+		return chaosResponse(req, status), nil
+	}
+
+	resp, err := ctx.Next(req)
+	if err != nil || resp == nil {
+		return resp, err
+	}
+	if truncate >= 0 || throttle > 0 {
+		// The body keeps its Content-Length, the client notices the truncation
+		ctx.WrapResponseBody(resp, func(body io.ReadCloser) io.ReadCloser {
+			return &chaosBody{
+				ReadCloser: body,
+				remaining:  truncate,
+				rate:       throttle,
+				reqCtx:     req.Context(),
+				proxyCtx:   ctx.Context,
+			}
+		})
+	}
+	return resp, nil
+}
+
+func (c *Chaos) rand() float64 {
+	if c.Rand != nil {
+		return c.Rand()
+	}
+	return rand.Float64()
+}
+
+// ChaosFaults returns the faults injected in the request of the Context
+func ChaosFaults(ctx *mps.Context) []ChaosFault {
+	value, ok := ctx.Get(ChaosContextKey)
+	if !ok {
+		return nil
+	}
+	faults, _ := value.([]ChaosFault)
+	return faults
+}
+
+// chaosResponse returns the synthetic response of the status code
+func chaosResponse(req *http.Request, status int) *http.Response {
+	msg := strconv.Itoa(status) + " " + http.StatusText(status)
+	return &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(bytes.NewBufferString(msg)),
+		ContentLength: int64(len(msg)),
+	}
+}
+
+// chaosBody truncates and throttles a response body
+type chaosBody struct {
+	io.ReadCloser
+	// remaining is the number of bytes before the truncation, negative without truncation
+	remaining int64
+	// rate is the number of bytes per second, zero without throttling
+	rate int64
+	// the throttling stops when one of the contexts is canceled
+	reqCtx   context.Context
+	proxyCtx context.Context
+}
+
+func (b *chaosBody) Read(p []byte) (int, error) {
+	if b.remaining == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if b.remaining > 0 && int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	if b.rate > 0 && int64(len(p)) > b.rate {
+		// at most one second of bytes at once
+		p = p[:b.rate]
+	}
+
+	start := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+	}
+	if b.rate > 0 && n > 0 {
+		d := time.Duration(n) * time.Second / time.Duration(b.rate)
+		if serr := chaosSleep(d-time.Since(start), b.reqCtx, b.proxyCtx); serr != nil {
+			return n, serr
+		}
+	}
+	return n, err
+}
+
+// chaosSleep waits for d, it returns the error of the first canceled context.
+// The contexts may be nil.
+func chaosSleep(d time.Duration, reqCtx, proxyCtx context.Context) error {
+	if d <= 0 {
+		return nil
+	}
+	var reqDone, proxyDone <-chan struct{}
+	if reqCtx != nil {
+		reqDone = reqCtx.Done()
+	}
+	if proxyCtx != nil {
+		proxyDone = proxyCtx.Done()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-reqDone:
+		return reqCtx.Err()
+	case <-proxyDone:
+		return proxyCtx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
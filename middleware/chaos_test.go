@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps"
+)
+
+// a Rand function returning the values in turn
+func sequenceRand(values ...float64) func() float64 {
+	i := 0
+	return func() float64 {
+		v := values[i%len(values)]
+		i++
+		return v
+	}
+}
+
+// the origin behind the chaos middleware
+func chaosOrigin(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	return newTestResponse(req, http.StatusOK, nil, "origin"), nil
+}
+
+// serve req with the chaos middleware, it returns the Context of the request
+func serveChaos(chaos *Chaos, origin mps.MiddlewareFunc, req *http.Request) (*mps.Context, *http.Response, error) {
+	ctx := newTestContext(origin, chaos).WithRequest(req)
+	resp, err := ctx.Next(req)
+	return ctx, resp, err
+}
+
+func TestChaos_Probability(t *testing.T) {
+	tests := []struct {
+		name        string
+		probability float64
+		rand        []float64
+		injected    []bool
+	}{
+		{name: "never", probability: 0, rand: []float64{0, 0.5}, injected: []bool{false, false}},
+		{name: "always", probability: 1, rand: []float64{0, 0.999}, injected: []bool{true, true}},
+		{name: "half", probability: 0.5, rand: []float64{0.2, 0.5, 0.7, 0.49}, injected: []bool{true, false, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chaos := NewChaos(ChaosRule{Name: "unavailable", Probability: tt.probability, Status: http.StatusServiceUnavailable})
+			chaos.Rand = sequenceRand(tt.rand...)
+			ctx := newTestContext(chaosOrigin, chaos)
+			for i, injected := range tt.injected {
+				resp, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+				if injected {
+					assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "request %d", i)
+				} else {
+					assert.Equal(t, "origin", body, "request %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestChaos_Filters(t *testing.T) {
+	chaos := NewChaos(ChaosRule{
+		Name:        "api",
+		Probability: 1,
+		Status:      http.StatusBadGateway,
+		Filters: []mps.Filter{
+			mps.FilterHostIs("api.example.com"),
+			mps.FilterUrlMatches(regexp.MustCompile(`/v1/`)),
+		},
+	})
+	tests := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"http://api.example.com/v1/users", http.StatusBadGateway, "502 Bad Gateway"},
+		{"http://api.example.com/v2/users", http.StatusOK, "origin"},
+		{"http://www.example.com/v1/users", http.StatusOK, "origin"},
+	}
+	ctx := newTestContext(chaosOrigin, chaos)
+	for _, tt := range tests {
+		resp, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, tt.url, nil))
+		assert.Equal(t, tt.status, resp.StatusCode, tt.url)
+		assert.Equal(t, tt.body, body, tt.url)
+	}
+}
+
+func TestChaos_Faults(t *testing.T) {
+	chaos := NewChaos(
+		ChaosRule{Name: "slow", Probability: 1, Latency: 10 * time.Millisecond},
+		ChaosRule{Name: "slower", Probability: 1, Latency: 20 * time.Millisecond},
+		ChaosRule{Name: "down", Probability: 1, Status: http.StatusServiceUnavailable},
+		ChaosRule{Name: "gateway", Probability: 1, Status: http.StatusBadGateway},
+	)
+
+	start := time.Now()
+	ctx, resp, err := serveChaos(chaos, chaosOrigin, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	asserts := assert.New(t)
+	if !asserts.NoError(err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	asserts.GreaterOrEqual(time.Since(start), 30*time.Millisecond, "the latencies should add up")
+	asserts.Equal(http.StatusServiceUnavailable, resp.StatusCode, "the first status should win")
+	asserts.Equal("503 Service Unavailable", string(body))
+	asserts.Equal([]ChaosFault{
+		{Rule: "slow", Kind: ChaosLatency, Value: "10ms"},
+		{Rule: "slower", Kind: ChaosLatency, Value: "20ms"},
+		{Rule: "down", Kind: ChaosStatus, Value: "503"},
+	}, ChaosFaults(ctx))
+	asserts.Equal("down: status 503", ChaosFaults(ctx)[2].String())
+
+	// no fault is recorded for the requests without fault
+	chaos.SetRules()
+	ctx, resp, err = serveChaos(chaos, chaosOrigin, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if asserts.NoError(err) {
+		body, _ = io.ReadAll(resp.Body)
+		asserts.Equal("origin", string(body))
+	}
+	asserts.Nil(ChaosFaults(ctx))
+
+	chaos.AddRule(ChaosRule{Name: "reset", Probability: 1, Reset: true})
+	asserts.Len(chaos.Rules(), 1)
+	ctx, _, err = serveChaos(chaos, chaosOrigin, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	asserts.ErrorIs(err, mps.ConnectionResetErr)
+	asserts.Equal([]ChaosFault{{Rule: "reset", Kind: ChaosReset}}, ChaosFaults(ctx))
+}
+
+func TestChaos_LatencyCanceled(t *testing.T) {
+	chaos := NewChaos(ChaosRule{Probability: 1, Latency: time.Hour})
+	reqCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(reqCtx)
+	start := time.Now()
+	_, _, err := serveChaos(chaos, chaosOrigin, req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second, "the latency should stop with the request")
+}
+
+func TestChaos_Truncate(t *testing.T) {
+	chaos := NewChaos(
+		ChaosRule{Name: "cut", Probability: 1, Truncate: true, TruncateAfter: 8},
+		ChaosRule{Name: "shorter", Probability: 1, Truncate: true, TruncateAfter: 5},
+	)
+	ctx, resp, err := serveChaos(chaos, chaosOrigin, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	asserts := assert.New(t)
+	asserts.ErrorIs(err, io.ErrUnexpectedEOF)
+	asserts.Equal("origi", string(body))
+	asserts.Equal(int64(6), resp.ContentLength, "the client should notice the truncation")
+	asserts.Len(ChaosFaults(ctx), 2)
+}
+
+func TestChaos_Throttle(t *testing.T) {
+	origin := func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		return newTestResponse(req, http.StatusOK, nil, strings.Repeat("a", 20)), nil
+	}
+	chaos := NewChaos(ChaosRule{Probability: 1, Throttle: 200})
+
+	start := time.Now()
+	_, resp, err := serveChaos(chaos, origin, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	asserts := assert.New(t)
+	asserts.NoError(err)
+	asserts.Len(body, 20)
+	asserts.GreaterOrEqual(time.Since(start), 100*time.Millisecond, "20 bytes at 200 bytes/s")
+
+	tests := []struct {
+		name   string
+		cancel func(req *http.Request, ctx *mps.Context) (*http.Request, *mps.Context)
+	}{
+		{
+			name: "request canceled",
+			cancel: func(req *http.Request, ctx *mps.Context) (*http.Request, *mps.Context) {
+				reqCtx, cancel := context.WithTimeout(req.Context(), 20*time.Millisecond)
+				t.Cleanup(cancel)
+				return req.WithContext(reqCtx), ctx
+			},
+		},
+		{
+			name: "Context canceled",
+			cancel: func(req *http.Request, ctx *mps.Context) (*http.Request, *mps.Context) {
+				proxyCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				t.Cleanup(cancel)
+				ctx.Context = proxyCtx
+				return req, ctx
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// one byte per second, the body would take minutes
+			chaos := NewChaos(ChaosRule{Probability: 1, Throttle: 1})
+			req, ctx := tt.cancel(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), newTestContext(origin, chaos))
+			resp, err := ctx.WithRequest(req).Next(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			_, err = io.ReadAll(resp.Body)
+			asserts := assert.New(t)
+			asserts.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+			asserts.Less(time.Since(start), time.Second, "the throttling should stop with the context")
+		})
+	}
+}
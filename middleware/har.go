@@ -0,0 +1,695 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/telanflow/mps"
+)
+
+const (
+	// DefaultHARMaxBodySize is the default size cap of the recorded bodies
+	DefaultHARMaxBodySize = 1 << 20
+	// DefaultHARBufferSize is the default number of entries kept in memory
+	DefaultHARBufferSize = 1000
+	// DefaultHARFileEntries is the default number of entries of a HAR file
+	DefaultHARFileEntries = 1000
+)
+
+// redacted replaces the values of the credentials in the recordings
+const redacted = "[redacted]"
+
+// HAR is a HTTP Archive 1.2 document, see http://www.softwareishard.com/blog/har-12-spec/
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+// HARLog is the root of the HAR document
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+// HARCreator is the application which created the HAR
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// HAREntry is a recorded exchange
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Connection      string      `json:"connection,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+	// TLS is the session of the client decrypted by the MitmHandler
+	TLS *HARTLS `json:"_tls,omitempty"`
+}
+
+// HARRequest is a recorded request
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse is a recorded response
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARNameValue is a header or a query string parameter
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARCookie is a cookie of the request or the response
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+// HARPostData is the body of the request
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []HARNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+// HARContent is the body of the response
+type HARContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// HARTimings are the durations of the phases of the exchange in milliseconds, -1 if not applicable
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// HARTLS is the TLS session of the client
+type HARTLS struct {
+	Version            string `json:"version"`
+	CipherSuite        string `json:"cipherSuite"`
+	ServerName         string `json:"serverName,omitempty"`
+	NegotiatedProtocol string `json:"negotiatedProtocol,omitempty"`
+}
+
+// HARRecorderOptions is the configuration of the HARRecorder
+type HARRecorderOptions struct {
+	// MaxBodySize caps the recorded request and response bodies, DefaultHARMaxBodySize by default.
+	// If negative, the bodies are not recorded.
+	MaxBodySize int64
+
+	// BufferSize is the number of the latest entries kept in memory, DefaultHARBufferSize by default
+	BufferSize int
+
+	// Dir is the directory of the HAR files. If empty, the entries are only kept in memory.
+	Dir string
+
+	// MaxFileEntries rotates the HAR file when it has this number of entries, DefaultHARFileEntries by default
+	MaxFileEntries int
+
+	// RotateInterval rotates the HAR file when it has been open for this duration.
+	// If zero, the files are only rotated by MaxFileEntries.
+	RotateInterval time.Duration
+
+	// RecordCredentials records the Authorization, Proxy-Authorization, Cookie and Set-Cookie
+	// headers and the cookies as they are. By default their values are redacted.
+	RecordCredentials bool
+}
+
+// HARRecorder is a middleware recording the exchanges passing through Context.Next
+// in a ring buffer, and in HAR 1.2 files when a directory is configured.
+// Exchanges without response, like CONNECT requests and websocket upgrades, are not recorded.
+type HARRecorder struct {
+	opts HARRecorderOptions
+
+	mu      sync.Mutex
+	entries []HAREntry
+	next    int
+	full    bool
+
+	// the current HAR file
+	file        *os.File
+	fileEntries int
+	fileOpened  time.Time
+	fileSeq     int
+}
+
+// NewHARRecorder Create a HARRecorder
+func NewHARRecorder(opts HARRecorderOptions) *HARRecorder {
+	if opts.MaxBodySize == 0 {
+		opts.MaxBodySize = DefaultHARMaxBodySize
+	}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultHARBufferSize
+	}
+	if opts.MaxFileEntries <= 0 {
+		opts.MaxFileEntries = DefaultHARFileEntries
+	}
+	return &HARRecorder{
+		opts:    opts,
+		entries: make([]HAREntry, opts.BufferSize),
+	}
+}
+
+// Handle implements mps.Middleware
+func (r *HARRecorder) Handle(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	rec := &harExchange{recorder: r, start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), rec.clientTrace()))
+	if req.Body != nil && req.Body != http.NoBody {
+		rec.reqBody = newHARBody(req.Body, r.opts.MaxBodySize, nil)
+		req.Body = rec.reqBody
+	}
+	rec.entry.Request = harRequest(req, !r.opts.RecordCredentials)
+	rec.entry.TLS = harTLS(req.TLS)
+
+	resp, err := ctx.Next(req)
+	if errors.Is(err, mps.MethodNotSupportErr) || errors.Is(err, mps.RequestWebsocketUpgradeErr) {
+		return resp, err
+	}
+	if err != nil || resp == nil {
+		if err != nil {
+			rec.entry.Comment = err.Error()
+		}
+		rec.done()
+		return resp, err
+	}
+
+	rec.entry.Response = harResponse(resp, !r.opts.RecordCredentials)
+	ctx.WrapResponseBody(resp, func(body io.ReadCloser) io.ReadCloser {
+		rec.respBody = newHARBody(body, r.opts.MaxBodySize, rec.done)
+		return rec.respBody
+	})
+	return resp, nil
+}
+
+// Entries returns the entries kept in memory, from the oldest to the latest
+func (r *HARRecorder) Entries() []HAREntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]HAREntry(nil), r.entries[:r.next]...)
+	}
+	entries := make([]HAREntry, 0, len(r.entries))
+	entries = append(entries, r.entries[r.next:]...)
+	return append(entries, r.entries[:r.next]...)
+}
+
+// Dump writes the entries kept in memory as a HAR document
+func (r *HARRecorder) Dump(w io.Writer) error {
+	entries := r.Entries()
+	if entries == nil {
+		entries = []HAREntry{}
+	}
+	har := HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: harCreator,
+		Entries: entries,
+	}}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&har)
+}
+
+// Close completes the current HAR file
+func (r *HARRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+// record adds the entry to the ring buffer and to the HAR file
+func (r *HARRecorder) record(entry HAREntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	if r.opts.Dir != "" {
+		// The capture must not break the proxy, the entry is only kept in memory
+		_ = r.writeEntry(&entry)
+	}
+}
+
+// writeEntry appends the entry to the HAR file, rotating it when needed
+func (r *HARRecorder) writeEntry(entry *HAREntry) error {
+	if r.file != nil && (r.fileEntries >= r.opts.MaxFileEntries ||
+		r.opts.RotateInterval > 0 && time.Since(r.fileOpened) >= r.opts.RotateInterval) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		if err := r.openFile(); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if r.fileEntries > 0 {
+		data = append([]byte(",\n"), data...)
+	}
+	if _, err = r.file.Write(data); err != nil {
+		return err
+	}
+	r.fileEntries++
+	return nil
+}
+
+// openFile creates a new HAR file, the entries are appended until it is closed
+func (r *HARRecorder) openFile() error {
+	if err := os.MkdirAll(r.opts.Dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	r.fileSeq++
+	name := fmt.Sprintf("mps-%s-%d.har", now.Format("20060102-150405"), r.fileSeq)
+	f, err := os.OpenFile(filepath.Join(r.opts.Dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	creator, _ := json.Marshal(harCreator)
+	if _, err = fmt.Fprintf(f, `{"log":{"version":"1.2","creator":%s,"entries":[`+"\n", creator); err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.file = f
+	r.fileEntries = 0
+	r.fileOpened = now
+	return nil
+}
+
+// closeFile writes the end of the HAR document and closes the file
+func (r *HARRecorder) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	f := r.file
+	r.file = nil
+	_, err := f.Write([]byte("\n]}}\n"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var harCreator = HARCreator{Name: "mps", Version: "1.2"}
+
+// harExchange is an exchange being recorded
+type harExchange struct {
+	recorder *HARRecorder
+	entry    HAREntry
+	reqBody  *harBody
+	respBody *harBody
+	once     sync.Once
+
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+// clientTrace records the timings and the server of the upstream connection
+func (rec *harExchange) clientTrace() *httptrace.ClientTrace {
+	set := func(t *time.Time) {
+		rec.mu.Lock()
+		*t = time.Now()
+		rec.mu.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { set(&rec.dnsStart) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&rec.dnsDone) },
+		ConnectStart:         func(string, string) { set(&rec.connectStart) },
+		ConnectDone:          func(string, string, error) { set(&rec.connectDone) },
+		TLSHandshakeStart:    func() { set(&rec.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&rec.tlsDone) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { set(&rec.wroteRequest) },
+		GotFirstResponseByte: func() { set(&rec.firstByte) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			rec.gotConn = time.Now()
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				rec.entry.ServerIPAddress = host
+			}
+			if _, port, err := net.SplitHostPort(info.Conn.LocalAddr().String()); err == nil {
+				rec.entry.Connection = port
+			}
+		},
+	}
+}
+
+// done completes the entry and records it, once the response body has been read
+func (rec *harExchange) done() {
+	rec.once.Do(func() {
+		end := time.Now()
+		rec.mu.Lock()
+		entry := rec.entry
+		timings := rec.timings(end)
+		rec.mu.Unlock()
+
+		entry.StartedDateTime = rec.start.Format(time.RFC3339Nano)
+		entry.Timings = timings
+		entry.Time = float64(end.Sub(rec.start)) / float64(time.Millisecond)
+		if rec.reqBody != nil {
+			text, size, truncated := rec.reqBody.snapshot()
+			entry.Request.BodySize = size
+			entry.Request.PostData = harPostData(entry.Request, text, truncated)
+		}
+		if rec.respBody != nil {
+			text, size, truncated := rec.respBody.snapshot()
+			entry.Response.BodySize = size
+			entry.Response.Content = harContent(entry.Response, text, size, truncated)
+		}
+		rec.recorder.record(entry)
+	})
+}
+
+// timings computes the HAR timings, the phases which didn't happen are -1
+func (rec *harExchange) timings(end time.Time) HARTimings {
+	ms := func(from, to time.Time) float64 {
+		if from.IsZero() || to.IsZero() || to.Before(from) {
+			return -1
+		}
+		return float64(to.Sub(from)) / float64(time.Millisecond)
+	}
+	t := HARTimings{
+		DNS:     ms(rec.dnsStart, rec.dnsDone),
+		Connect: ms(rec.connectStart, rec.connectDone),
+		SSL:     ms(rec.tlsStart, rec.tlsDone),
+		Send:    ms(rec.gotConn, rec.wroteRequest),
+		Wait:    ms(rec.wroteRequest, rec.firstByte),
+		Receive: ms(rec.firstByte, end),
+	}
+	// HAR includes the TLS handshake in the connect time
+	if t.SSL >= 0 && t.Connect >= 0 {
+		t.Connect = ms(rec.connectStart, rec.tlsDone)
+	}
+	if rec.gotConn.IsZero() {
+		// The response has been created by a middleware
+		t.Blocked = -1
+		t.Send, t.Wait, t.Receive = 0, ms(rec.start, end), 0
+		return t
+	}
+	t.Blocked = ms(rec.start, rec.gotConn)
+	for _, d := range []float64{t.DNS, t.Connect} {
+		if d > 0 {
+			t.Blocked -= d
+		}
+	}
+	if t.Blocked < 0 {
+		t.Blocked = 0
+	}
+	// HAR requires send, wait and receive
+	for _, d := range []*float64{&t.Send, &t.Wait, &t.Receive} {
+		if *d < 0 {
+			*d = 0
+		}
+	}
+	return t
+}
+
+// harBody records a body up to a size cap, done is called at the end of the body
+type harBody struct {
+	io.ReadCloser
+	max  int64
+	done func()
+
+	// The request body may still be read by the Transport when the exchange is done
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	size      int64
+	truncated bool
+}
+
+func newHARBody(body io.ReadCloser, max int64, done func()) *harBody {
+	return &harBody{ReadCloser: body, max: max, done: done}
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.mu.Lock()
+		b.size += int64(n)
+		if room := b.max - int64(b.buf.Len()); room > 0 {
+			if int64(n) > room {
+				b.buf.Write(p[:room])
+				b.truncated = true
+			} else {
+				b.buf.Write(p[:n])
+			}
+		} else if b.max >= 0 {
+			b.truncated = true
+		}
+		b.mu.Unlock()
+	}
+	if err == io.EOF && b.done != nil {
+		b.done()
+	}
+	return n, err
+}
+
+// snapshot returns the recorded bytes, the size of the body read so far, and whether it was truncated
+func (b *harBody) snapshot() ([]byte, int64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.size, b.truncated
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.done()
+	}
+	return err
+}
+
+func harRequest(req *http.Request, redact bool) HARRequest {
+	r := HARRequest{
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		HTTPVersion: req.Proto,
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(req.Header, redact),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+	// Include the Host header, which Go removes from the header map
+	if req.Host != "" {
+		r.Headers = append([]HARNameValue{{Name: "Host", Value: req.Host}}, r.Headers...)
+	}
+	for _, c := range req.Cookies() {
+		cookie := HARCookie{Name: c.Name, Value: c.Value}
+		if redact {
+			cookie.Value = redacted
+		}
+		r.Cookies = append(r.Cookies, cookie)
+	}
+	for name, values := range req.URL.Query() {
+		for _, v := range values {
+			r.QueryString = append(r.QueryString, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return r
+}
+
+func harResponse(resp *http.Response, redact bool) HARResponse {
+	r := HARResponse{
+		Status:      resp.StatusCode,
+		StatusText:  http.StatusText(resp.StatusCode),
+		HTTPVersion: resp.Proto,
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(resp.Header, redact),
+		Content:     HARContent{Size: 0, MimeType: resp.Header.Get("Content-Type")},
+		RedirectURL: resp.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+	if r.HTTPVersion == "" {
+		r.HTTPVersion = "HTTP/1.1"
+	}
+	for _, c := range resp.Cookies() {
+		cookie := HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(time.RFC3339)
+		}
+		if redact {
+			cookie.Value = redacted
+		}
+		r.Cookies = append(r.Cookies, cookie)
+	}
+	return r
+}
+
+func harHeaders(header http.Header, redact bool) []HARNameValue {
+	headers := make([]HARNameValue, 0, len(header))
+	for name, values := range header {
+		for _, v := range values {
+			if redact && isCredentialHeader(name) {
+				v = redacted
+			}
+			headers = append(headers, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+// isCredentialHeader reports whether the header carries credentials
+func isCredentialHeader(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie":
+		return true
+	}
+	return false
+}
+
+func harPostData(req HARRequest, text []byte, truncated bool) *HARPostData {
+	data := &HARPostData{Params: []HARNameValue{}}
+	for _, h := range req.Headers {
+		if strings.EqualFold(h.Name, "Content-Type") {
+			data.MimeType = h.Value
+		}
+	}
+	// HAR can't encode a binary request body
+	switch {
+	case !utf8.Valid(text):
+		data.Comment = "binary body not recorded"
+	case truncated:
+		data.Text = string(text)
+		data.Comment = "body truncated"
+	default:
+		data.Text = string(text)
+	}
+	return data
+}
+
+func harContent(resp HARResponse, text []byte, size int64, truncated bool) HARContent {
+	content := resp.Content
+	content.Size = size
+
+	// The body is recorded as it was transferred, decode gzip for readability
+	for _, h := range resp.Headers {
+		if strings.EqualFold(h.Name, "Content-Encoding") && strings.EqualFold(h.Value, "gzip") && !truncated {
+			if zr, err := gzip.NewReader(bytes.NewReader(text)); err == nil {
+				if decoded, err := io.ReadAll(zr); err == nil {
+					content.Size = int64(len(decoded))
+					content.Compression = content.Size - size
+					text = decoded
+				}
+			}
+		}
+	}
+
+	if utf8.Valid(text) {
+		content.Text = string(text)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(text)
+		content.Encoding = "base64"
+	}
+	if truncated {
+		content.Comment = "body truncated"
+	}
+	return content
+}
+
+func harTLS(state *tls.ConnectionState) *HARTLS {
+	if state == nil {
+		return nil
+	}
+	return &HARTLS{
+		Version:            tlsVersionName(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		ServerName:         state.ServerName,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
@@ -0,0 +1,273 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps"
+)
+
+// find the value of the header in the recorded headers
+func harHeader(headers []HARNameValue, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
+
+// the origin behind the recorder, like the Transport it reads the request body
+func harOrigin(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	if req.Body != nil {
+		_, _ = io.Copy(io.Discard, req.Body)
+	}
+	header := http.Header{"Content-Type": []string{"text/plain"}}
+	return newTestResponse(req, http.StatusOK, header, "response"), nil
+}
+
+func TestHARRecorder_Entries(t *testing.T) {
+	recorder := NewHARRecorder(HARRecorderOptions{})
+	ctx := newTestContext(harOrigin, recorder)
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/path?q=1", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	_, body := serve(t, ctx, req)
+
+	asserts := assert.New(t)
+	asserts.Equal("response", body)
+	entries := recorder.Entries()
+	if !asserts.Len(entries, 1) {
+		return
+	}
+	entry := entries[0]
+	asserts.Equal(http.MethodPost, entry.Request.Method)
+	asserts.Equal("http://example.com/path?q=1", entry.Request.URL)
+	asserts.Equal([]HARNameValue{{Name: "q", Value: "1"}}, entry.Request.QueryString)
+	asserts.Equal("example.com", harHeader(entry.Request.Headers, "Host"))
+	if asserts.NotNil(entry.Request.PostData) {
+		asserts.Equal("hello", entry.Request.PostData.Text)
+		asserts.Equal("text/plain", entry.Request.PostData.MimeType)
+	}
+	asserts.Equal(int64(5), entry.Request.BodySize)
+	asserts.Equal(http.StatusOK, entry.Response.Status)
+	asserts.Equal("response", entry.Response.Content.Text)
+	asserts.Equal("text/plain", entry.Response.Content.MimeType)
+	asserts.Equal(int64(8), entry.Response.Content.Size)
+	asserts.Equal(int64(8), entry.Response.BodySize)
+
+	// The response has been created by a middleware, there is no connection
+	asserts.Equal(float64(-1), entry.Timings.Blocked)
+	asserts.Equal(float64(-1), entry.Timings.Connect)
+	asserts.Equal(float64(0), entry.Timings.Send)
+	asserts.GreaterOrEqual(entry.Timings.Wait, float64(0))
+
+	var buf bytes.Buffer
+	asserts.NoError(recorder.Dump(&buf))
+	var har HAR
+	asserts.NoError(json.Unmarshal(buf.Bytes(), &har))
+	asserts.Equal("1.2", har.Log.Version)
+	asserts.Len(har.Log.Entries, 1)
+
+	// An empty recorder dumps an empty list of entries
+	buf.Reset()
+	asserts.NoError(NewHARRecorder(HARRecorderOptions{}).Dump(&buf))
+	asserts.Contains(buf.String(), `"entries": []`)
+}
+
+func TestHARRecorder_RingBuffer(t *testing.T) {
+	recorder := NewHARRecorder(HARRecorderOptions{BufferSize: 3})
+	ctx := newTestContext(harOrigin, recorder)
+	for i := 0; i < 5; i++ {
+		serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/"+strconv.Itoa(i), nil))
+	}
+
+	var urls []string
+	for _, entry := range recorder.Entries() {
+		urls = append(urls, entry.Request.URL)
+	}
+	assert.Equal(t, []string{
+		"http://example.com/2",
+		"http://example.com/3",
+		"http://example.com/4",
+	}, urls, "the latest entries should be kept, from the oldest")
+}
+
+func TestHARRecorder_Truncate(t *testing.T) {
+	recorder := NewHARRecorder(HARRecorderOptions{MaxBodySize: 4})
+	ctx := newTestContext(harOrigin, recorder)
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader("request body")))
+
+	asserts := assert.New(t)
+	asserts.Equal("response", body, "the client should receive the whole body")
+	entry := recorder.Entries()[0]
+	asserts.Equal("resp", entry.Response.Content.Text)
+	asserts.Equal("body truncated", entry.Response.Content.Comment)
+	asserts.Equal(int64(8), entry.Response.BodySize)
+	asserts.Equal("requ", entry.Request.PostData.Text)
+	asserts.Equal("body truncated", entry.Request.PostData.Comment)
+}
+
+func TestHARRecorder_Credentials(t *testing.T) {
+	origin := func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		header := http.Header{"Set-Cookie": []string{"session=server-secret; Path=/"}}
+		return newTestResponse(req, http.StatusOK, header, ""), nil
+	}
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+		req.Header.Set("Cookie", "session=client-secret")
+		req.Header.Set("Accept", "*/*")
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		opts    HARRecorderOptions
+		request map[string]string
+		cookies [2]string
+	}{
+		{
+			name: "redacted by default",
+			request: map[string]string{
+				"Authorization":       redacted,
+				"Proxy-Authorization": redacted,
+				"Cookie":              redacted,
+				"Accept":              "*/*",
+			},
+			cookies: [2]string{redacted, redacted},
+		},
+		{
+			name: "recorded",
+			opts: HARRecorderOptions{RecordCredentials: true},
+			request: map[string]string{
+				"Authorization":       "Bearer token",
+				"Proxy-Authorization": "Basic Zm9vOmJhcg==",
+				"Cookie":              "session=client-secret",
+				"Accept":              "*/*",
+			},
+			cookies: [2]string{"client-secret", "server-secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewHARRecorder(tt.opts)
+			serve(t, newTestContext(origin, recorder), newRequest())
+
+			asserts := assert.New(t)
+			entry := recorder.Entries()[0]
+			for name, value := range tt.request {
+				asserts.Equal(value, harHeader(entry.Request.Headers, name), name)
+			}
+			if asserts.Len(entry.Request.Cookies, 1) && asserts.Len(entry.Response.Cookies, 1) {
+				asserts.Equal(tt.cookies[0], entry.Request.Cookies[0].Value)
+				asserts.Equal(tt.cookies[1], entry.Response.Cookies[0].Value)
+			}
+			if tt.opts.RecordCredentials {
+				return
+			}
+			var buf bytes.Buffer
+			asserts.NoError(recorder.Dump(&buf))
+			for _, secret := range []string{"token", "Zm9vOmJhcg==", "client-secret", "server-secret"} {
+				asserts.NotContains(buf.String(), secret)
+			}
+		})
+	}
+}
+
+func TestHARRecorder_Timings(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = rw.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	recorder := NewHARRecorder(HARRecorderOptions{})
+	ctx := mps.NewContext()
+	ctx.Transport.Proxy = nil
+	ctx.Use(recorder)
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, srv.URL+"/", nil))
+
+	asserts := assert.New(t)
+	asserts.Equal("hello", body)
+	entry := recorder.Entries()[0]
+	asserts.Equal("127.0.0.1", entry.ServerIPAddress)
+	asserts.NotEmpty(entry.Connection)
+	asserts.GreaterOrEqual(entry.Timings.Blocked, float64(0))
+	asserts.GreaterOrEqual(entry.Timings.Connect, float64(0))
+	asserts.Equal(float64(-1), entry.Timings.SSL)
+	asserts.GreaterOrEqual(entry.Timings.Send, float64(0))
+	asserts.GreaterOrEqual(entry.Timings.Wait, float64(20))
+	asserts.GreaterOrEqual(entry.Timings.Receive, float64(0))
+	asserts.GreaterOrEqual(entry.Time, entry.Timings.Wait)
+}
+
+func TestHARRecorder_Rotate(t *testing.T) {
+	dir := t.TempDir()
+	recorder := NewHARRecorder(HARRecorderOptions{Dir: dir, MaxFileEntries: 2})
+	ctx := newTestContext(harOrigin, recorder)
+	for i := 0; i < 5; i++ {
+		serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/"+strconv.Itoa(i), nil))
+	}
+	asserts := assert.New(t)
+	asserts.NoError(recorder.Close())
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.har"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	asserts.Len(files, 3)
+
+	// every file is a complete HAR document
+	var urls []string
+	for _, filename := range files {
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var har HAR
+		if !asserts.NoError(json.Unmarshal(data, &har), filename) {
+			continue
+		}
+		asserts.Equal("1.2", har.Log.Version)
+		asserts.LessOrEqual(len(har.Log.Entries), 2)
+		for _, entry := range har.Log.Entries {
+			urls = append(urls, entry.Request.URL)
+		}
+	}
+	sort.Strings(urls)
+	asserts.Len(urls, 5)
+	asserts.Equal("http://example.com/0", urls[0])
+	asserts.Equal("http://example.com/4", urls[4])
+}
+
+func TestHARRecorder_RotateInterval(t *testing.T) {
+	dir := t.TempDir()
+	recorder := NewHARRecorder(HARRecorderOptions{Dir: dir, RotateInterval: 20 * time.Millisecond})
+	ctx := newTestContext(harOrigin, recorder)
+	serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	time.Sleep(30 * time.Millisecond)
+	serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+
+	asserts := assert.New(t)
+	asserts.NoError(recorder.Close())
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	asserts.Len(files, 2, "the file should be rotated after the interval")
+	for _, filename := range files {
+		data, _ := os.ReadFile(filename)
+		asserts.True(json.Valid(data), filename)
+	}
+}
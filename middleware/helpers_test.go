@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/telanflow/mps"
+)
+
+// create a test Context serving the requests with the middlewares,
+// the last middleware answers with origin instead of the network
+func newTestContext(origin mps.MiddlewareFunc, middlewares ...mps.Middleware) *mps.Context {
+	ctx := mps.NewContext()
+	ctx.Use(middlewares...)
+	ctx.Use(origin)
+	return ctx
+}
+
+func newTestResponse(req *http.Request, status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+// serve req with ctx and read the response body
+func serve(t *testing.T, ctx *mps.Context, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := ctx.WithRequest(req).Next(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
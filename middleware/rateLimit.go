@@ -0,0 +1,312 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/telanflow/mps"
+)
+
+// RateLimitAlgorithm is the algorithm counting the requests of a key
+type RateLimitAlgorithm int
+
+const (
+	// FixedWindow allows Limit requests in each Window, the counter is reset at the start of the window
+	FixedWindow RateLimitAlgorithm = iota
+	// SlidingWindow allows Limit requests in any Window, weighting the requests of the previous window
+	SlidingWindow
+	// TokenBucket allows bursts of Burst requests, refilled at the rate of Limit requests per Window
+	TokenBucket
+)
+
+// memoryStoreSweepInterval is how often the expired states are removed from the MemoryRateLimitStore
+const memoryStoreSweepInterval = time.Minute
+
+// RateLimitKeyFunc returns the key whose requests are counted, the requests without key are not limited
+type RateLimitKeyFunc func(req *http.Request) string
+
+// RateLimitOptions is the configuration of the RateLimit middleware
+type RateLimitOptions struct {
+	// Algorithm counting the requests, FixedWindow by default
+	Algorithm RateLimitAlgorithm
+
+	// Limit is the number of requests allowed per Window.
+	// If zero or negative, the requests are not limited.
+	Limit int64
+
+	// Window is the duration of the limit, one second by default
+	Window time.Duration
+
+	// Burst is the capacity of the TokenBucket, Limit by default
+	Burst int64
+
+	// KeyFunc returns the key of the request, RateLimitByClientIP by default
+	KeyFunc RateLimitKeyFunc
+
+	// Store holds the state of the keys, a MemoryRateLimitStore by default
+	Store RateLimitStore
+}
+
+// RateLimitState is the state of a key
+type RateLimitState struct {
+	// WindowStart is the start of the current window
+	WindowStart time.Time
+	// Count is the number of requests of the current window
+	Count int64
+	// PrevCount is the number of requests of the previous window
+	PrevCount int64
+
+	// Tokens is the number of requests left in the bucket
+	Tokens float64
+	// Last is the time the bucket was refilled
+	Last time.Time
+}
+
+// RateLimitStore holds the RateLimitState of the keys.
+// Implement it to share the counters between several proxies.
+type RateLimitStore interface {
+	// Update atomically updates the state of the key with fn.
+	// The zero state is used for a new key, the state may be discarded
+	// when it hasn't been updated for ttl.
+	Update(key string, ttl time.Duration, fn func(state *RateLimitState))
+}
+
+// RateLimit returns a middleware limiting the rate of the requests.
+// The requests beyond the limit are answered with 429 Too Many Requests and a Retry-After header.
+func RateLimit(opts RateLimitOptions) mps.MiddlewareFunc {
+	if opts.Limit <= 0 {
+		return func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+			return ctx.Next(req)
+		}
+	}
+	if opts.Window <= 0 {
+		opts.Window = time.Second
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = opts.Limit
+	}
+	if opts.KeyFunc == nil {
+		opts.KeyFunc = RateLimitByClientIP
+	}
+	if opts.Store == nil {
+		opts.Store = NewMemoryRateLimitStore()
+	}
+
+	return func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+		key := opts.KeyFunc(req)
+		if key == "" {
+			return ctx.Next(req)
+		}
+
+		var (
+			allowed    bool
+			retryAfter time.Duration
+			now        = time.Now()
+		)
+		opts.Store.Update(key, opts.ttl(), func(state *RateLimitState) {
+			allowed, retryAfter = opts.allow(state, now)
+		})
+		if !allowed {
+			return RateLimitExceeded(req, retryAfter), nil
+		}
+		return ctx.Next(req)
+	}
+}
+
+// allow counts a request in the state, it returns how long to wait when the request is not allowed
+func (opts *RateLimitOptions) allow(state *RateLimitState, now time.Time) (bool, time.Duration) {
+	switch opts.Algorithm {
+	case SlidingWindow:
+		return opts.allowSlidingWindow(state, now)
+	case TokenBucket:
+		return opts.allowTokenBucket(state, now)
+	default:
+		return opts.allowFixedWindow(state, now)
+	}
+}
+
+func (opts *RateLimitOptions) allowFixedWindow(state *RateLimitState, now time.Time) (bool, time.Duration) {
+	start := now.Truncate(opts.Window)
+	if !state.WindowStart.Equal(start) {
+		state.WindowStart = start
+		state.Count = 0
+	}
+	if state.Count >= opts.Limit {
+		return false, start.Add(opts.Window).Sub(now)
+	}
+	state.Count++
+	return true, 0
+}
+
+func (opts *RateLimitOptions) allowSlidingWindow(state *RateLimitState, now time.Time) (bool, time.Duration) {
+	start := now.Truncate(opts.Window)
+	if !state.WindowStart.Equal(start) {
+		// The current window becomes the previous one, if it is adjacent
+		if state.WindowStart.Add(opts.Window).Equal(start) {
+			state.PrevCount = state.Count
+		} else {
+			state.PrevCount = 0
+		}
+		state.WindowStart = start
+		state.Count = 0
+	}
+
+	// The previous window is weighted by the part of it still in the sliding window
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(opts.Window)
+	if float64(state.PrevCount)*weight+float64(state.Count) < float64(opts.Limit) {
+		state.Count++
+		return true, 0
+	}
+
+	if state.Count >= opts.Limit || state.PrevCount == 0 {
+		return false, opts.Window - elapsed
+	}
+	// wait until the weight of the previous window leaves room for a request
+	fraction := 1 - float64(opts.Limit-state.Count)/float64(state.PrevCount)
+	wait := time.Duration(fraction*float64(opts.Window)) - elapsed
+	if wait <= 0 {
+		wait = time.Millisecond
+	}
+	return false, wait
+}
+
+func (opts *RateLimitOptions) allowTokenBucket(state *RateLimitState, now time.Time) (bool, time.Duration) {
+	rate := float64(opts.Limit) / opts.Window.Seconds()
+	burst := float64(opts.Burst)
+	if state.Last.IsZero() {
+		state.Tokens = burst
+	} else if elapsed := now.Sub(state.Last).Seconds(); elapsed > 0 {
+		state.Tokens = math.Min(burst, state.Tokens+elapsed*rate)
+	}
+	state.Last = now
+
+	if state.Tokens >= 1 {
+		state.Tokens--
+		return true, 0
+	}
+	if rate <= 0 {
+		return false, opts.Window
+	}
+	return false, time.Duration((1 - state.Tokens) / rate * float64(time.Second))
+}
+
+// ttl returns how long the state of an unused key is kept
+func (opts *RateLimitOptions) ttl() time.Duration {
+	if opts.Algorithm == TokenBucket && opts.Limit > 0 {
+		// the time to refill the bucket completely
+		return time.Duration(float64(opts.Burst) / float64(opts.Limit) * float64(opts.Window))
+	}
+	// the sliding window needs the previous window
+	return 2 * opts.Window
+}
+
+// RateLimitByClientIP is a RateLimitKeyFunc counting the requests of each client IP
+func RateLimitByClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitByUser is a RateLimitKeyFunc counting the requests of each
+// user authenticated with the Proxy-Authorization Basic credentials
+func RateLimitByUser(req *http.Request) string {
+	usr, _, ok := parseBasicAuth(req.Header.Get(proxyAuthorization))
+	if !ok {
+		return ""
+	}
+	return usr
+}
+
+// RateLimitByHost is a RateLimitKeyFunc counting the requests to each destination host
+func RateLimitByHost(req *http.Request) string {
+	if req.URL.Host != "" {
+		return req.URL.Host
+	}
+	return req.Host
+}
+
+// RateLimitExceeded returns the 429 Too Many Requests response
+func RateLimitExceeded(req *http.Request, retryAfter time.Duration) *http.Response {
+	const tooManyRequestsMsg = "429 Too Many Requests"
+	// Retry-After is a number of seconds, rounded up
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Request:    req,
+		Header: http.Header{
+			"Retry-After":  []string{strconv.FormatInt(seconds, 10)},
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Body:          io.NopCloser(bytes.NewBuffer([]byte(tooManyRequestsMsg))),
+		ContentLength: int64(len(tooManyRequestsMsg)),
+	}
+}
+
+// MemoryRateLimitStore is a RateLimitStore in memory
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	states    map[string]*memoryRateLimitState
+	lastSweep time.Time
+}
+
+type memoryRateLimitState struct {
+	state   RateLimitState
+	expires time.Time
+}
+
+// NewMemoryRateLimitStore Create a MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		states: make(map[string]*memoryRateLimitState),
+	}
+}
+
+// Update implements RateLimitStore
+func (s *MemoryRateLimitStore) Update(key string, ttl time.Duration, fn func(state *RateLimitState)) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	entry, ok := s.states[key]
+	if !ok || now.After(entry.expires) {
+		entry = &memoryRateLimitState{}
+		s.states[key] = entry
+	}
+	fn(&entry.state)
+	entry.expires = now.Add(ttl)
+}
+
+// Len returns the number of keys
+func (s *MemoryRateLimitStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.states)
+}
+
+// sweep removes the expired states
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < memoryStoreSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, entry := range s.states {
+		if now.After(entry.expires) {
+			delete(s.states, key)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps"
+)
+
+// the origin behind the RateLimit middleware
+func rateLimitOrigin(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	return newTestResponse(req, http.StatusOK, nil, "ok"), nil
+}
+
+func TestRateLimitOptions_Allow(t *testing.T) {
+	type step struct {
+		at         time.Duration
+		allowed    bool
+		retryAfter time.Duration
+	}
+	ms := time.Millisecond
+	tests := []struct {
+		name  string
+		opts  RateLimitOptions
+		steps []step
+	}{
+		{
+			name: "fixed window",
+			opts: RateLimitOptions{Algorithm: FixedWindow, Limit: 2, Window: time.Second},
+			steps: []step{
+				{0, true, 0},
+				{100 * ms, true, 0},
+				{200 * ms, false, 800 * ms},
+				{1000 * ms, true, 0},
+			},
+		},
+		{
+			name: "sliding window",
+			opts: RateLimitOptions{Algorithm: SlidingWindow, Limit: 2, Window: time.Second},
+			steps: []step{
+				{0, true, 0},
+				{100 * ms, true, 0},
+				{200 * ms, false, 800 * ms},
+				// the previous window weighs 0.9
+				{1100 * ms, true, 0},
+				// the previous window weighs 0.8, 1.6 + 1 requests
+				{1200 * ms, false, 300 * ms},
+				// the previous window weighs 0.4, 0.8 + 1 requests
+				{1600 * ms, true, 0},
+				{1700 * ms, false, 300 * ms},
+				// the previous window is not adjacent
+				{3000 * ms, true, 0},
+				{3000 * ms, true, 0},
+			},
+		},
+		{
+			name: "token bucket",
+			opts: RateLimitOptions{Algorithm: TokenBucket, Limit: 1, Window: time.Second, Burst: 2},
+			steps: []step{
+				{0, true, 0},
+				{0, true, 0},
+				{0, false, time.Second},
+				{500 * ms, false, 500 * ms},
+				{1000 * ms, true, 0},
+				{1000 * ms, false, time.Second},
+				// the bucket is refilled up to the burst
+				{5000 * ms, true, 0},
+				{5000 * ms, true, 0},
+				{5000 * ms, false, time.Second},
+			},
+		},
+	}
+	start := time.Unix(1000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var state RateLimitState
+			for i, s := range tt.steps {
+				allowed, retryAfter := tt.opts.allow(&state, start.Add(s.at))
+				assert.Equal(t, s.allowed, allowed, "step %d", i)
+				assert.Equal(t, s.retryAfter, retryAfter, "step %d", i)
+			}
+		})
+	}
+}
+
+func TestRateLimitExceeded(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{0, "1"},
+		{300 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1500 * time.Millisecond, "2"},
+		{time.Hour, "3600"},
+	}
+	for _, tt := range tests {
+		resp := RateLimitExceeded(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), tt.retryAfter)
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Equal(t, tt.want, resp.Header.Get("Retry-After"), "Retry-After of %s should be rounded up", tt.retryAfter)
+	}
+}
+
+func TestRateLimit_RetryAfter(t *testing.T) {
+	ctx := newTestContext(rateLimitOrigin, RateLimit(RateLimitOptions{
+		Limit:  1,
+		Window: time.Hour,
+	}))
+
+	resp, _ := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	asserts := assert.New(t)
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+
+	resp, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	asserts.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	asserts.Equal("429 Too Many Requests", body)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	asserts.NoError(err)
+	asserts.True(retryAfter >= 1 && retryAfter <= 3600, "Retry-After: %d", retryAfter)
+
+	// another client is counted apart
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	resp, _ = serve(t, ctx, req)
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestRateLimit_ZeroLimit(t *testing.T) {
+	store := &recordingStore{MemoryRateLimitStore: NewMemoryRateLimitStore()}
+	ctx := newTestContext(rateLimitOrigin, RateLimit(RateLimitOptions{Store: store}))
+	for i := 0; i < 10; i++ {
+		resp, _ := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "a zero limit should not limit the requests")
+	}
+	assert.Empty(t, store.keys, "the requests should not be counted")
+}
+
+func TestRateLimitKeyFunc(t *testing.T) {
+	newRequest := func(url, remoteAddr, username string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = remoteAddr
+		if username != "" {
+			SetBasicAuth(req, username, "password")
+		}
+		return req
+	}
+	tests := []struct {
+		name    string
+		keyFunc RateLimitKeyFunc
+		req     *http.Request
+		want    string
+	}{
+		{"client ip", RateLimitByClientIP, newRequest("http://example.com/", "192.0.2.1:1234", ""), "192.0.2.1"},
+		{"client ipv6", RateLimitByClientIP, newRequest("http://example.com/", "[2001:db8::1]:1234", ""), "2001:db8::1"},
+		{"client without port", RateLimitByClientIP, newRequest("http://example.com/", "192.0.2.1", ""), "192.0.2.1"},
+		{"user", RateLimitByUser, newRequest("http://example.com/", "192.0.2.1:1234", "foo"), "foo"},
+		{"anonymous user", RateLimitByUser, newRequest("http://example.com/", "192.0.2.1:1234", ""), ""},
+		{"host", RateLimitByHost, newRequest("http://example.com:8080/path", "192.0.2.1:1234", ""), "example.com:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.keyFunc(tt.req))
+		})
+	}
+}
+
+// recordingStore is a RateLimitStore recording its updates
+type recordingStore struct {
+	*MemoryRateLimitStore
+	keys []string
+	ttls []time.Duration
+}
+
+func (s *recordingStore) Update(key string, ttl time.Duration, fn func(state *RateLimitState)) {
+	s.keys = append(s.keys, key)
+	s.ttls = append(s.ttls, ttl)
+	s.MemoryRateLimitStore.Update(key, ttl, fn)
+}
+
+func TestRateLimit_Store(t *testing.T) {
+	store := &recordingStore{MemoryRateLimitStore: NewMemoryRateLimitStore()}
+	ctx := newTestContext(rateLimitOrigin, RateLimit(RateLimitOptions{
+		Algorithm: SlidingWindow,
+		Limit:     1,
+		Window:    time.Minute,
+		KeyFunc:   RateLimitByUser,
+		Store:     store,
+	}))
+
+	newRequest := func(username string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		if username != "" {
+			SetBasicAuth(req, username, "password")
+		}
+		return req
+	}
+
+	asserts := assert.New(t)
+	resp, _ := serve(t, ctx, newRequest("foo"))
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+	resp, _ = serve(t, ctx, newRequest("foo"))
+	asserts.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	resp, _ = serve(t, ctx, newRequest("bar"))
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+	// the requests without key are not limited
+	resp, _ = serve(t, ctx, newRequest(""))
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+	resp, _ = serve(t, ctx, newRequest(""))
+	asserts.Equal(http.StatusOK, resp.StatusCode)
+
+	asserts.Equal([]string{"foo", "foo", "bar"}, store.keys)
+	asserts.Equal(2*time.Minute, store.ttls[0], "the sliding window keeps the previous window")
+	asserts.Equal(2, store.Len())
+}
+
+func TestMemoryRateLimitStore_Expire(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	store.Update("foo", 10*time.Millisecond, func(state *RateLimitState) {
+		state.Count = 5
+	})
+	store.Update("foo", 10*time.Millisecond, func(state *RateLimitState) {
+		assert.Equal(t, int64(5), state.Count)
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	store.Update("foo", 10*time.Millisecond, func(state *RateLimitState) {
+		assert.Equal(t, RateLimitState{}, *state, "the expired state should be discarded")
+	})
+}
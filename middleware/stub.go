@@ -0,0 +1,679 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/telanflow/mps"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultStubMaxBodySize is the default size cap of the request bodies read by the rules
+const DefaultStubMaxBodySize = 1 << 20
+
+// StubRules is the content of a rules file, in YAML or JSON (.json extension)
+//
+//	rules:
+//	  - name: user
+//	    match:
+//	      method: GET
+//	      url: https://api.example.com/users/*
+//	      query: {id: "4*"}
+//	      body: {"$.user.name": alice}
+//	    response:
+//	      status: 200
+//	      headers: {Content-Type: application/json}
+//	      body: '{"id": "{{ .Query.Get "id" }}"}'
+//	      delay: 100ms
+type StubRules struct {
+	Rules []StubRule `yaml:"rules" json:"rules"`
+}
+
+// StubRule answers the matching requests with its responses
+type StubRule struct {
+	Name  string    `yaml:"name" json:"name"`
+	Match StubMatch `yaml:"match" json:"match"`
+
+	// Response is the response of every matching request
+	Response *StubResponse `yaml:"response" json:"response"`
+
+	// Sequence are the responses of the successive matching requests, the last one is repeated
+	Sequence []StubResponse `yaml:"sequence" json:"sequence"`
+}
+
+// StubMatch are the conditions of a rule, the patterns are globs where '*' matches any characters
+type StubMatch struct {
+	// Method of the request, any method if empty
+	Method string `yaml:"method" json:"method"`
+
+	// URL is the pattern of the URL without query. A pattern starting with "/" matches the path.
+	URL string `yaml:"url" json:"url"`
+
+	// URLRegexp is a regular expression of the URL without query
+	URLRegexp string `yaml:"urlRegexp" json:"urlRegexp"`
+
+	// Headers are the patterns of the request headers
+	Headers map[string]string `yaml:"headers" json:"headers"`
+
+	// Query are the patterns of the query parameters
+	Query map[string]string `yaml:"query" json:"query"`
+
+	// Body are the patterns of the values at JSONPaths of the JSON body, e.g. "$.items[0].id"
+	Body map[string]string `yaml:"body" json:"body"`
+}
+
+// StubResponse is a templated response. The templates are executed with StubTemplateData.
+type StubResponse struct {
+	Status  int               `yaml:"status" json:"status"`
+	Headers map[string]string `yaml:"headers" json:"headers"`
+
+	// Body is the template of the body
+	Body string `yaml:"body" json:"body"`
+
+	// BodyFile is the file of the body, relative to the rules file. It is read for each response.
+	BodyFile string `yaml:"bodyFile" json:"bodyFile"`
+
+	// Template executes the BodyFile as a template
+	Template bool `yaml:"template" json:"template"`
+
+	// Delay before the response, e.g. "200ms"
+	Delay string `yaml:"delay" json:"delay"`
+}
+
+// StubTemplateData is the data of the response templates
+type StubTemplateData struct {
+	Request *http.Request
+	Method  string
+	URL     string
+	Path    string
+	Host    string
+	Query   url.Values
+	Header  http.Header
+	// Body is the request body, JSON the decoded JSON body if any.
+	// They are empty if the body is larger than MaxBodySize.
+	Body string
+	JSON interface{}
+	// Count is the number of requests matched by the rule, starting at 1
+	Count int
+}
+
+// Stub is a middleware answering the requests with the responses of the declarative rules,
+// the unmatched requests are passed to the next middleware. The rules files can be reloaded
+// while the proxy is running. The request body is only read when a rule matches on it,
+// or a response template uses it.
+type Stub struct {
+	// MaxBodySize caps the request bodies read by the rules, DefaultStubMaxBodySize by default.
+	// A larger body matches no body pattern.
+	MaxBodySize int64
+
+	files []string
+
+	mu    sync.RWMutex
+	rules []*stubRule
+}
+
+// NewStub Create a Stub with the rules files
+func NewStub(files ...string) (*Stub, error) {
+	s := &Stub{files: files}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the rules files again, the sequences start over.
+// The current rules are kept if a file is invalid.
+func (s *Stub) Reload() error {
+	var rules []*stubRule
+	for _, file := range s.files {
+		r, err := loadStubRules(file)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r...)
+	}
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the rules files when they are modified, until stop is called.
+// The invalid files are reported to onError, if not nil.
+func (s *Stub) Watch(interval time.Duration, onError func(err error)) (stop func()) {
+	done := make(chan struct{})
+	// The files modified once Watch returns are reloaded
+	last := s.modTimes()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			modTimes := s.modTimes()
+			if modTimes == last {
+				continue
+			}
+			last = modTimes
+			if err := s.Reload(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// modTimes returns a fingerprint of the modification times of the rules files
+func (s *Stub) modTimes() string {
+	var b strings.Builder
+	for _, file := range s.files {
+		if info, err := os.Stat(file); err == nil {
+			b.WriteString(info.ModTime().String())
+			b.WriteString(strconv.FormatInt(info.Size(), 10))
+		}
+		b.WriteByte(';')
+	}
+	return b.String()
+}
+
+// Handle implements mps.Middleware
+func (s *Stub) Handle(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	if req.Method == http.MethodConnect {
+		return ctx.Next(req)
+	}
+
+	max := s.MaxBodySize
+	if max <= 0 {
+		max = DefaultStubMaxBodySize
+	}
+	body := &stubRequestBody{req: req, max: max}
+
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+	for _, rule := range rules {
+		if !rule.match(req) {
+			continue
+		}
+		if len(rule.body) > 0 {
+			document, err := body.document()
+			if err != nil {
+				return nil, err
+			}
+			if !rule.matchBody(document) {
+				continue
+			}
+		}
+		resp, count := rule.next()
+		data := &StubTemplateData{
+			Request: req,
+			Method:  req.Method,
+			URL:     req.URL.String(),
+			Path:    req.URL.Path,
+			Host:    req.URL.Host,
+			Query:   req.URL.Query(),
+			Header:  req.Header,
+			Count:   count,
+		}
+		return resp.response(req, data, body)
+	}
+	return ctx.Next(req)
+}
+
+// stubRequestBody reads the request body once, when a rule needs it
+type stubRequestBody struct {
+	req  *http.Request
+	max  int64
+	read bool
+	data []byte
+	json interface{}
+	err  error
+}
+
+// document returns the decoded JSON body, nil if the body is not JSON or too large
+func (b *stubRequestBody) document() (interface{}, error) {
+	if b.read {
+		return b.json, b.err
+	}
+	b.read = true
+	data, complete, err := readRequestBody(b.req, b.max)
+	if err != nil {
+		b.err = err
+		return nil, err
+	}
+	if complete {
+		b.data = data
+		if len(data) > 0 {
+			_ = json.Unmarshal(data, &b.json)
+		}
+	}
+	return b.json, nil
+}
+
+// fill sets the body of the template data
+func (b *stubRequestBody) fill(data *StubTemplateData) error {
+	document, err := b.document()
+	if err != nil {
+		return err
+	}
+	data.Body, data.JSON = string(b.data), document
+	return nil
+}
+
+// stubRule is a compiled StubRule
+type stubRule struct {
+	name      string
+	method    string
+	url       *regexp.Regexp
+	headers   map[string]*regexp.Regexp
+	query     map[string]*regexp.Regexp
+	body      map[string]*regexp.Regexp
+	responses []*stubResponse
+
+	mu    sync.Mutex
+	count int
+}
+
+// loadStubRules reads and compiles the rules of a file
+func loadStubRules(file string) ([]*stubRule, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules StubRules
+	if strings.EqualFold(filepath.Ext(file), ".json") {
+		err = json.Unmarshal(data, &rules)
+	} else {
+		err = yaml.Unmarshal(data, &rules)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stub: %s: %w", file, err)
+	}
+
+	compiled := make([]*stubRule, 0, len(rules.Rules))
+	for i := range rules.Rules {
+		rule, err := compileStubRule(&rules.Rules[i], filepath.Dir(file))
+		if err != nil {
+			return nil, fmt.Errorf("stub: %s: rule %d %q: %w", file, i, rules.Rules[i].Name, err)
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+func compileStubRule(rule *StubRule, dir string) (*stubRule, error) {
+	var err error
+	r := &stubRule{
+		name:   rule.Name,
+		method: strings.ToUpper(rule.Match.Method),
+	}
+	switch {
+	case rule.Match.URLRegexp != "":
+		r.url, err = regexp.Compile(rule.Match.URLRegexp)
+	case rule.Match.URL != "":
+		r.url = globRegexp(rule.Match.URL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.headers = globRegexps(rule.Match.Headers)
+	r.query = globRegexps(rule.Match.Query)
+	r.body = globRegexps(rule.Match.Body)
+	for path := range rule.Match.Body {
+		if _, err = parseJSONPath(path); err != nil {
+			return nil, err
+		}
+	}
+
+	responses := rule.Sequence
+	if rule.Response != nil {
+		responses = append([]StubResponse{*rule.Response}, responses...)
+	}
+	if len(responses) == 0 {
+		return nil, errors.New("no response")
+	}
+	for i := range responses {
+		resp, err := compileStubResponse(&responses[i], dir)
+		if err != nil {
+			return nil, err
+		}
+		r.responses = append(r.responses, resp)
+	}
+	return r, nil
+}
+
+// match reports whether the request matches the rule, but for the body
+func (r *stubRule) match(req *http.Request) bool {
+	if r.method != "" && r.method != req.Method {
+		return false
+	}
+	if r.url != nil {
+		u := *req.URL
+		u.RawQuery, u.Fragment = "", ""
+		if !r.url.MatchString(u.String()) && !r.url.MatchString(u.Path) {
+			return false
+		}
+	}
+	for name, re := range r.headers {
+		if !re.MatchString(req.Header.Get(name)) {
+			return false
+		}
+	}
+	query := req.URL.Query()
+	for name, re := range r.query {
+		if _, ok := query[name]; !ok || !re.MatchString(query.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchBody reports whether the decoded JSON body matches the rule
+func (r *stubRule) matchBody(document interface{}) bool {
+	for path, re := range r.body {
+		value, ok := evalJSONPath(document, path)
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// next returns the response of the sequence, and the number of matched requests
+func (r *stubRule) next() (*stubResponse, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	i := r.count - 1
+	if i >= len(r.responses) {
+		i = len(r.responses) - 1
+	}
+	return r.responses[i], r.count
+}
+
+// stubResponse is a compiled StubResponse
+type stubResponse struct {
+	status   int
+	headers  map[string]*template.Template
+	body     *template.Template
+	bodyFile string
+	template bool
+	delay    time.Duration
+
+	// needsBody reports whether the templates use the request body
+	needsBody bool
+}
+
+func compileStubResponse(resp *StubResponse, dir string) (*stubResponse, error) {
+	var err error
+	r := &stubResponse{
+		status:   resp.Status,
+		headers:  make(map[string]*template.Template, len(resp.Headers)),
+		template: resp.Template,
+	}
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	for name, value := range resp.Headers {
+		if r.headers[name], err = template.New(name).Parse(value); err != nil {
+			return nil, err
+		}
+		r.needsBody = r.needsBody || templateUsesBody(r.headers[name])
+	}
+	if r.body, err = template.New("body").Parse(resp.Body); err != nil {
+		return nil, err
+	}
+	r.needsBody = r.needsBody || templateUsesBody(r.body)
+	if resp.BodyFile != "" {
+		r.bodyFile = resp.BodyFile
+		if !filepath.IsAbs(r.bodyFile) {
+			r.bodyFile = filepath.Join(dir, r.bodyFile)
+		}
+	}
+	if resp.Delay != "" {
+		if r.delay, err = time.ParseDuration(resp.Delay); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// response renders the response of the request, the body is read if the templates use it
+func (r *stubResponse) response(req *http.Request, data *StubTemplateData, reqBody *stubRequestBody) (*http.Response, error) {
+	if r.delay > 0 {
+		timer := time.NewTimer(r.delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	var (
+		body      bytes.Buffer
+		content   []byte
+		tpl       = r.body
+		needsBody = r.needsBody
+	)
+	if r.bodyFile != "" {
+		var err error
+		if content, err = os.ReadFile(r.bodyFile); err != nil {
+			return nil, err
+		}
+		tpl = nil
+		if r.template {
+			if tpl, err = template.New(filepath.Base(r.bodyFile)).Parse(string(content)); err != nil {
+				return nil, err
+			}
+			needsBody = needsBody || templateUsesBody(tpl)
+		}
+	}
+	if needsBody {
+		if err := reqBody.fill(data); err != nil {
+			return nil, err
+		}
+	}
+	if tpl == nil {
+		body.Write(content)
+	} else if err := tpl.Execute(&body, data); err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header, len(r.headers))
+	for name, tpl := range r.headers {
+		var value strings.Builder
+		if err := tpl.Execute(&value, data); err != nil {
+			return nil, err
+		}
+		header.Set(name, value.String())
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.status, http.StatusText(r.status)),
+		StatusCode:    r.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// templateUsesBody reports whether the template may use the Body or the JSON of StubTemplateData
+func templateUsesBody(tpl *template.Template) bool {
+	for _, t := range tpl.Templates() {
+		if t.Tree != nil && nodeUsesBody(t.Tree.Root) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeUsesBody(node parse.Node) bool {
+	usesField := func(ident []string) bool {
+		return len(ident) > 0 && (ident[0] == "Body" || ident[0] == "JSON")
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesBody(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesBody(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesBody(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesBody(arg) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return usesField(n.Ident)
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && usesField(n.Ident[1:])
+	case *parse.ChainNode:
+		return usesField(n.Field) || nodeUsesBody(n.Node)
+	case *parse.DotNode:
+		// The whole data may be printed or passed to a template
+		return true
+	case *parse.IfNode:
+		return nodeUsesBody(n.Pipe) || nodeUsesBody(n.List) || nodeUsesBody(n.ElseList)
+	case *parse.RangeNode:
+		return nodeUsesBody(n.Pipe) || nodeUsesBody(n.List) || nodeUsesBody(n.ElseList)
+	case *parse.WithNode:
+		return nodeUsesBody(n.Pipe) || nodeUsesBody(n.List) || nodeUsesBody(n.ElseList)
+	case *parse.TemplateNode:
+		return nodeUsesBody(n.Pipe)
+	}
+	return false
+}
+
+// globRegexp compiles a glob pattern, '*' matches any characters
+func globRegexp(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	return regexp.MustCompile("^" + strings.ReplaceAll(quoted, `\*`, ".*") + "$")
+}
+
+func globRegexps(patterns map[string]string) map[string]*regexp.Regexp {
+	res := make(map[string]*regexp.Regexp, len(patterns))
+	for name, pattern := range patterns {
+		res[name] = globRegexp(pattern)
+	}
+	return res
+}
+
+// parseJSONPath parses a JSONPath of the subset $.key.key[index]['key']
+func parseJSONPath(path string) ([]interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("invalid JSONPath %q", path)
+	}
+	var steps []interface{}
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			steps = append(steps, rest[1:end+1])
+			rest = rest[end+1:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			key := rest[1:end]
+			if unquoted := strings.Trim(key, `'"`); len(unquoted) == len(key)-2 {
+				steps = append(steps, unquoted)
+			} else if index, err := strconv.Atoi(key); err == nil {
+				steps = append(steps, index)
+			} else {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSONPath %q", path)
+		}
+	}
+	return steps, nil
+}
+
+// evalJSONPath returns the value at the path of the document as a string
+func evalJSONPath(document interface{}, path string) (string, bool) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return "", false
+	}
+	value := document
+	for _, step := range steps {
+		switch s := step.(type) {
+		case string:
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if value, ok = object[s]; !ok {
+				return "", false
+			}
+		case int:
+			array, ok := value.([]interface{})
+			if !ok || s < 0 || s >= len(array) {
+				return "", false
+			}
+			value = array[s]
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "null", true
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
@@ -0,0 +1,349 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps"
+)
+
+// write the rules file in the directory
+func writeStubRules(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newTestStub(t *testing.T, rules string) *Stub {
+	t.Helper()
+	stub, err := NewStub(writeStubRules(t, t.TempDir(), "rules.yaml", rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stub
+}
+
+// the origin behind the stub, it answers the requests matching no rule
+func stubOrigin(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+	return newTestResponse(req, http.StatusOK, nil, "origin"), nil
+}
+
+// readCounter counts the reads of a request body
+type readCounter struct {
+	io.Reader
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func (r *readCounter) Close() error {
+	return nil
+}
+
+func TestStub_Match(t *testing.T) {
+	stub := newTestStub(t, `
+rules:
+  - name: method
+    match: {method: delete}
+    response: {body: method}
+  - name: url
+    match: {url: "https://api.example.com/users/*"}
+    response: {body: url}
+  - name: path
+    match: {url: "/files/*.txt"}
+    response: {body: path}
+  - name: regexp
+    match: {urlRegexp: "^http://example\\.com/v[0-9]+/"}
+    response: {body: regexp}
+  - name: headers
+    match: {headers: {X-Env: "prod*"}}
+    response: {body: headers}
+  - name: query
+    match: {url: /search, query: {q: "go*"}}
+    response: {body: query}
+  - name: body
+    match: {body: {"$.user.name": alice, "$.items[1]": "2", "$['user'].admin": "true"}}
+    response: {body: body}
+`)
+	newRequest := func(method, url, body string, header map[string]string) *http.Request {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		rule string
+	}{
+		{name: "method", req: newRequest(http.MethodDelete, "http://example.com/", "", nil), rule: "method"},
+		{name: "url", req: newRequest(http.MethodGet, "https://api.example.com/users/42?x=1", "", nil), rule: "url"},
+		{name: "url prefix", req: newRequest(http.MethodGet, "https://api.example.com/groups/42", "", nil)},
+		{name: "path", req: newRequest(http.MethodGet, "http://other.com/files/a/b.txt", "", nil), rule: "path"},
+		{name: "path extension", req: newRequest(http.MethodGet, "http://other.com/files/b.json", "", nil)},
+		{name: "regexp", req: newRequest(http.MethodGet, "http://example.com/v2/users", "", nil), rule: "regexp"},
+		{name: "headers", req: newRequest(http.MethodGet, "http://example.com/", "", map[string]string{"X-Env": "production"}), rule: "headers"},
+		{name: "headers mismatch", req: newRequest(http.MethodGet, "http://example.com/", "", map[string]string{"X-Env": "test"})},
+		{name: "query", req: newRequest(http.MethodGet, "http://example.com/search?q=golang", "", nil), rule: "query"},
+		{name: "query missing", req: newRequest(http.MethodGet, "http://example.com/search", "", nil)},
+		{
+			name: "body",
+			req:  newRequest(http.MethodPost, "http://example.com/", `{"user": {"name": "alice", "admin": true}, "items": [1, 2]}`, nil),
+			rule: "body",
+		},
+		{
+			name: "body mismatch",
+			req:  newRequest(http.MethodPost, "http://example.com/", `{"user": {"name": "bob", "admin": true}, "items": [1, 2]}`, nil),
+		},
+		{name: "body not JSON", req: newRequest(http.MethodPost, "http://example.com/", `user.name=alice`, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := serve(t, newTestContext(stubOrigin, stub), tt.req)
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			if tt.rule == "" {
+				assert.Equal(t, "origin", body, "the request should be passed to the next middleware")
+				return
+			}
+			assert.Equal(t, tt.rule, body)
+		})
+	}
+}
+
+func TestStub_Sequence(t *testing.T) {
+	stub := newTestStub(t, `
+rules:
+  - name: job
+    match: {url: /job}
+    response: {status: 202, body: "pending {{ .Count }}"}
+    sequence:
+      - {status: 200, body: "done {{ .Count }}"}
+`)
+	ctx := newTestContext(stubOrigin, stub)
+	asserts := assert.New(t)
+	for _, want := range []struct {
+		status int
+		body   string
+	}{
+		{http.StatusAccepted, "pending 1"},
+		{http.StatusOK, "done 2"},
+		{http.StatusOK, "done 3"},
+	} {
+		resp, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/job", nil))
+		asserts.Equal(want.status, resp.StatusCode)
+		asserts.Equal(want.body, body)
+	}
+
+	// the sequences start over when the rules are reloaded
+	asserts.NoError(stub.Reload())
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/job", nil))
+	asserts.Equal("pending 1", body)
+}
+
+func TestStub_Template(t *testing.T) {
+	dir := t.TempDir()
+	writeStubRules(t, dir, "plain.txt", "{{ .Path }}")
+	writeStubRules(t, dir, "template.txt", "{{ .Method }} {{ .Path }} {{ .Body }}")
+	file := writeStubRules(t, dir, "rules.yaml", `
+rules:
+  - match: {url: /query}
+    response:
+      headers: {X-Id: '{{ .Query.Get "id" }}', Content-Type: text/plain}
+      body: '{{ .Host }} {{ .Header.Get "X-Env" }} {{ .Query.Get "id" }}'
+  - match: {url: /json}
+    response: {body: '{{ .JSON.user.name }} {{ len .Body }}'}
+  - match: {url: /plain}
+    response: {bodyFile: plain.txt}
+  - match: {url: /template}
+    response: {bodyFile: template.txt, template: true}
+`)
+	stub, err := NewStub(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newTestContext(stubOrigin, stub)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/query?id=42", nil)
+	req.Header.Set("X-Env", "test")
+	resp, body := serve(t, ctx, req)
+	asserts := assert.New(t)
+	asserts.Equal("example.com test 42", body)
+	asserts.Equal("42", resp.Header.Get("X-Id"))
+	asserts.Equal("text/plain", resp.Header.Get("Content-Type"))
+	asserts.Equal(int64(len(body)), resp.ContentLength)
+
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodPost, "http://example.com/json", strings.NewReader(`{"user": {"name": "alice"}}`)))
+	asserts.Equal("alice 27", body)
+
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/plain", nil))
+	asserts.Equal("{{ .Path }}", body, "the body file is not a template by default")
+
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodPut, "http://example.com/template", strings.NewReader("data")))
+	asserts.Equal("PUT /template data", body)
+}
+
+func TestStub_LazyBody(t *testing.T) {
+	stub := newTestStub(t, `
+rules:
+  - match: {url: /body, body: {$.name: alice}}
+    response: {body: matched}
+  - match: {url: /template}
+    response: {body: '{{ .Body }}'}
+  - match: {url: /static}
+    response: {body: static}
+`)
+	stub.MaxBodySize = 16
+
+	tests := []struct {
+		name  string
+		path  string
+		body  string
+		read  bool
+		match string
+	}{
+		{name: "no rule", path: "/other", body: `{"name": "alice"}`},
+		{name: "static response", path: "/static", body: `{"name": "alice"}`, match: "static"},
+		{name: "body matcher", path: "/body", body: `{"name":"alice"}`, read: true, match: "matched"},
+		{name: "template", path: "/template", body: `hello`, read: true, match: "hello"},
+		{name: "body too large", path: "/body", body: `{"name": "alice"}`, read: true},
+		{name: "template body too large", path: "/template", body: strings.Repeat("a", 17), read: true, match: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqBody := &readCounter{Reader: strings.NewReader(tt.body)}
+			req := httptest.NewRequest(http.MethodPost, "http://example.com"+tt.path, nil)
+			req.Body = reqBody
+
+			var received string
+			read := false
+			ctx := newTestContext(func(req *http.Request, ctx *mps.Context) (*http.Response, error) {
+				read = reqBody.reads > 0
+				data, _ := io.ReadAll(req.Body)
+				received = string(data)
+				return newTestResponse(req, http.StatusOK, nil, "origin"), nil
+			}, stub)
+			_, body := serve(t, ctx, req)
+
+			asserts := assert.New(t)
+			if tt.match != "" || tt.path == "/template" {
+				asserts.Equal(tt.match, body)
+				read = reqBody.reads > 0
+			} else {
+				asserts.Equal("origin", body)
+				asserts.Equal(tt.body, received, "the origin should receive the whole body")
+			}
+			asserts.Equal(tt.read, read, "the body should only be read by the stub when needed")
+		})
+	}
+}
+
+func TestStub_Delay(t *testing.T) {
+	stub := newTestStub(t, `
+rules:
+  - response: {body: late, delay: 1h}
+`)
+	ctx := newTestContext(stubOrigin, stub)
+	reqCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil).WithContext(reqCtx)
+	_, err := ctx.WithRequest(req).Next(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestStub_Reload(t *testing.T) {
+	dir := t.TempDir()
+	file := writeStubRules(t, dir, "rules.json", `{"rules": [{"match": {"url": "/a"}, "response": {"body": "first"}}]}`)
+	stub, err := NewStub(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newTestContext(stubOrigin, stub)
+	asserts := assert.New(t)
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/a", nil))
+	asserts.Equal("first", body)
+
+	writeStubRules(t, dir, "rules.json", `{"rules": [{"match": {"url": "/a"}, "response": {"body": "second"}}]}`)
+	asserts.NoError(stub.Reload())
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/a", nil))
+	asserts.Equal("second", body)
+
+	// the current rules are kept if a file is invalid
+	for _, invalid := range []string{
+		`{"rules": [`,
+		`{"rules": [{"match": {"url": "/a"}}]}`,
+		`{"rules": [{"match": {"urlRegexp": "("}, "response": {}}]}`,
+		`{"rules": [{"match": {"body": {"name": "x"}}, "response": {}}]}`,
+		`{"rules": [{"response": {"body": "{{ .Path "}}]}`,
+		`{"rules": [{"response": {"delay": "soon"}}]}`,
+	} {
+		writeStubRules(t, dir, "rules.json", invalid)
+		asserts.Error(stub.Reload(), invalid)
+	}
+	_, body = serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/a", nil))
+	asserts.Equal("second", body)
+
+	_, err = NewStub(filepath.Join(dir, "missing.yaml"))
+	asserts.Error(err)
+}
+
+func TestStub_Watch(t *testing.T) {
+	dir := t.TempDir()
+	file := writeStubRules(t, dir, "rules.yaml", "rules: [{response: {body: first}}]")
+	stub, err := NewStub(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	stop := stub.Watch(5*time.Millisecond, func(err error) {
+		errs <- err
+	})
+	defer stop()
+
+	ctx := newTestContext(stubOrigin, stub)
+	waitBody := func(want string) {
+		t.Helper()
+		var body string
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if _, body = serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil)); body == want {
+				return
+			}
+		}
+		t.Fatalf("the rules have not been reloaded, body %q", body)
+	}
+
+	// the file size changes with the rules, whatever the resolution of the modification times
+	writeStubRules(t, dir, "rules.yaml", "rules: [{response: {body: second}}]")
+	waitBody("second")
+
+	writeStubRules(t, dir, "rules.yaml", "rules: [")
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the invalid file has not been reported")
+	}
+	waitBody("second")
+
+	stop()
+	stop()
+	writeStubRules(t, dir, "rules.yaml", "rules: [{response: {body: stopped after}}]")
+	time.Sleep(20 * time.Millisecond)
+	_, body := serve(t, ctx, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, "second", body, "the rules should not be reloaded once stopped")
+}
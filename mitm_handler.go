@@ -3,9 +3,11 @@ package mps
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/tls"
@@ -23,10 +25,13 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/telanflow/mps/cert"
 	"github.com/telanflow/mps/pool"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/publicsuffix"
 )
 
 var (
@@ -41,6 +46,44 @@ type MitmHandler struct {
 	Certificate tls.Certificate
 	// CertContainer is certificate storage container
 	CertContainer cert.Container
+
+	// EnableHTTP2 advertises HTTP/2 to the clients with ALPN.
+	// Each HTTP/2 stream is handled concurrently and passes through the middlewares
+	// as an individual request.
+	EnableHTTP2 bool
+
+	// MaxConcurrentStreams limits the number of concurrent HTTP/2 streams
+	// per client connection. If zero, the http2 package default of 250 is used.
+	MaxConcurrentStreams uint32
+
+	// WildcardCert issues wildcard certificates for the parent domain (*.example.com),
+	// so that one certificate is shared by all the subdomains.
+	WildcardCert bool
+
+	// ReuseLeafKey signs all the leaf certificates with a single key pair,
+	// instead of generating a key pair for each host.
+	ReuseLeafKey bool
+
+	// PassthroughRules decides which CONNECT requests are tunneled without decryption
+	PassthroughRules *PassthroughRules
+
+	// WebsocketHandler relays the websocket connections upgraded in the decrypted sessions.
+	// If nil, a WebsocketHandler sharing the Context is used.
+	WebsocketHandler *WebsocketHandler
+
+	// MimicUpstreamCert connects to the upstream before the handshake with the client,
+	// and issues a certificate that copies the Subject, SANs, validity and key usage of
+	// the upstream certificate. A regular certificate is issued if the upstream is unreachable.
+	MimicUpstreamCert bool
+
+	// UpstreamPinning decides when a client TLS session is pinned to a dedicated upstream connection.
+	// The other requests share the connection pool of the Transport, which is tuned with
+	// its MaxIdleConns, MaxIdleConnsPerHost, MaxConnsPerHost and IdleConnTimeout.
+	UpstreamPinning PinMode
+
+	stats         upstreamStats
+	leafKeyMu     sync.Mutex
+	sharedLeafKey crypto.Signer
 }
 
 // NewMitmHandler Create a mitmHandler, use default cert.
@@ -49,7 +92,7 @@ func NewMitmHandler() *MitmHandler {
 		Ctx:           NewContext(),
 		BufferPool:    pool.DefaultBuffer,
 		Certificate:   cert.DefaultCertificate,
-		CertContainer: cert.NewMemProvider(),
+		CertContainer: cert.NewLRUProvider(cert.DefaultLRUCapacity, cert.DefaultLRUTTL),
 	}
 }
 
@@ -59,7 +102,7 @@ func NewMitmHandlerWithContext(ctx *Context) *MitmHandler {
 		Ctx:           ctx,
 		BufferPool:    pool.DefaultBuffer,
 		Certificate:   cert.DefaultCertificate,
-		CertContainer: cert.NewMemProvider(),
+		CertContainer: cert.NewLRUProvider(cert.DefaultLRUCapacity, cert.DefaultLRUTTL),
 	}
 }
 
@@ -73,7 +116,7 @@ func NewMitmHandlerWithCert(ctx *Context, certPEMBlock, keyPEMBlock []byte) (*Mi
 		Ctx:           ctx,
 		BufferPool:    pool.DefaultBuffer,
 		Certificate:   certificate,
-		CertContainer: cert.NewMemProvider(),
+		CertContainer: cert.NewLRUProvider(cert.DefaultLRUCapacity, cert.DefaultLRUTTL),
 	}, nil
 }
 
@@ -87,7 +130,7 @@ func NewMitmHandlerWithCertFile(ctx *Context, certFile, keyFile string) (*MitmHa
 		Ctx:           ctx,
 		BufferPool:    pool.DefaultBuffer,
 		Certificate:   certificate,
-		CertContainer: cert.NewMemProvider(),
+		CertContainer: cert.NewLRUProvider(cert.DefaultLRUCapacity, cert.DefaultLRUTTL),
 	}, nil
 }
 
@@ -96,29 +139,56 @@ func (mitm *MitmHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// execution middleware
 	ctx := mitm.Ctx.WithRequest(req)
 	resp, err := ctx.Next(req)
-	if err != nil && !errors.Is(err, MethodNotSupportErr) {
+	if errors.Is(err, ConnectionResetErr) {
+		resetClient(rw)
+		return
+	}
+	if !errors.Is(err, MethodNotSupportErr) {
+		// The middleware responded to the CONNECT request, e.g. authentication failed
 		if resp != nil {
+			defer resp.Body.Close()
 			copyHeaders(rw.Header(), resp.Header, mitm.Ctx.KeepDestinationHeaders)
 			rw.WriteHeader(resp.StatusCode)
 			buf := mitm.buffer().Get()
 			_, err = io.CopyBuffer(rw, resp.Body, buf)
 			mitm.buffer().Put(buf)
+		} else if err != nil {
+			http.Error(rw, err.Error(), 502)
 		}
 		return
 	}
 
+	// The connections that must not be decrypted are tunneled as-is
+	passthrough := mitm.PassthroughRules != nil && mitm.PassthroughRules.Match(req)
+	kind := ConnMitm
+	if passthrough {
+		kind = ConnTunnel
+	}
+
+	// The decrypted requests are shaped with the limits of the CONNECT request
+	limits := mitm.Ctx.BandwidthLimiter.limits(mitm.context(), req)
+	if limits.exhausted() {
+		http.Error(rw, BandwidthQuotaExceededErr.Error(), http.StatusTooManyRequests)
+		return
+	}
+
 	// get hijacker connection
 	clientConn, err := hijacker(rw)
 	if err != nil {
 		http.Error(rw, err.Error(), 502)
 		return
 	}
+	clientConn = limits.conn(mitm.Ctx.trackConn(clientConn, kind))
+
+	if passthrough {
+		mitm.tunnel().transmit(clientConn, req, false)
+		return
+	}
 
 	// this goes in a separate goroutine, so that the net/http server won't think we're
 	// still handling the request even after hijacking the connection. Those HTTP CONNECT
-	// request can take forever, and the server will be stuck when "closed".
-	// TODO: Allow Server.Close() mechanism to shut down this connection as nicely as possible
-	tlsConfig, err := mitm.TLSConfigFromCA(req.URL.Host)
+	// request can take forever, the ConnTracker of the Context shuts them down.
+	tlsConfig, err := mitm.tlsConfigFromCA(req)
 	if err != nil {
 		ConnError(clientConn)
 		return
@@ -131,17 +201,51 @@ func (mitm *MitmHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (mitm *MitmHandler) transmit(clientConn net.Conn, originalReq *http.Request, tlsConfig *tls.Config) {
-	// TODO: cache connections to the remote website
+	tracked := trackedOf(clientConn)
+	host := stripPort(originalReq.URL.Host)
+	rules := mitm.PassthroughRules
+	if rules != nil {
+		// The client may CONNECT to an IP address, check the server name as well
+		r := bufio.NewReaderSize(clientConn, 5+tlsMaxRecordLen)
+		clientConn = &peekedConn{Conn: clientConn, r: r}
+		if sni, err := peekSNI(r); err == nil && sni != "" {
+			if rules.MatchHost(sni) {
+				mitm.tunnel().transmit(clientConn, originalReq, true)
+				return
+			}
+			host = sni
+		}
+	}
+
 	rawClientTls := tls.Server(clientConn, tlsConfig)
 	if err := rawClientTls.Handshake(); err != nil {
+		// The client sent an alert, it doesn't trust the leaf certificate
+		if rules != nil && isRemoteAlert(err) {
+			rules.HandshakeFailed(host)
+		}
 		ConnError(clientConn)
 		_ = rawClientTls.Close()
 		return
 	}
+	if rules != nil {
+		rules.HandshakeSucceeded(host)
+	}
 	defer rawClientTls.Close()
 
+	// The upstream connections of the session
+	session := newMitmSession(mitm)
+	defer session.close()
+
+	if rawClientTls.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		mitm.serveHTTP2(rawClientTls, originalReq, session, tracked)
+		return
+	}
+
+	// The connection is idle while waiting for the next request
+	tracked.end()
 	clientTlsReader := bufio.NewReader(rawClientTls)
 	for !isEof(clientTlsReader) {
+		tracked.begin()
 		req, err := http.ReadRequest(clientTlsReader)
 		if err != nil {
 			break
@@ -149,6 +253,10 @@ func (mitm *MitmHandler) transmit(clientConn net.Conn, originalReq *http.Request
 
 		// since we're converting the request, need to carry over the original connecting IP as well
 		req.RemoteAddr = originalReq.RemoteAddr
+		req = inheritOriginalDst(req, originalReq)
+		// http.ReadRequest doesn't know the connection, the middlewares can inspect the TLS session
+		state := rawClientTls.ConnectionState()
+		req.TLS = &state
 
 		if !httpsRegexp.MatchString(req.URL.String()) {
 			req.URL, err = url.Parse("https://" + originalReq.Host + req.URL.String())
@@ -157,15 +265,105 @@ func (mitm *MitmHandler) transmit(clientConn net.Conn, originalReq *http.Request
 			return
 		}
 
-		var resp *http.Response
+		var (
+			resp *http.Response
+			ctx  *Context
+		)
 
 		// Copying a Context preserves the Transport, Middleware
-		ctx := mitm.Ctx.WithRequest(req)
+		req, ctx = session.withRequest(req)
 		resp, err = ctx.Next(req)
+		session.observe(resp)
+		if errors.Is(err, RequestWebsocketUpgradeErr) {
+			// The middleware may have rewritten the request
+			if ctx.Request != nil {
+				req = ctx.Request
+			}
+			// The connection is taken over by the websocket
+			mitm.websocketHandler().serveConn(&peekedConn{Conn: rawClientTls, r: clientTlsReader}, req)
+			return
+		}
+		if errors.Is(err, ConnectionResetErr) {
+			resetConn(clientConn)
+			return
+		}
 		if err != nil {
 			return
 		}
 
+		keepAlive, err := mitm.writeResponse(rawClientTls, req, resp, ctx)
+		_ = resp.Body.Close()
+		tracked.end()
+		// No more requests are read once the shutdown has started
+		if err != nil || !keepAlive || tracked.shuttingDown() {
+			return
+		}
+	}
+}
+
+// serveHTTP2 serves the HTTP/2 streams of the decrypted client connection.
+// The streams are handled concurrently, each of them is an individual request.
+func (mitm *MitmHandler) serveHTTP2(clientConn *tls.Conn, originalReq *http.Request, session *mitmSession, tracked *trackedConn) {
+	srv := &http2.Server{
+		MaxConcurrentStreams: mitm.MaxConcurrentStreams,
+	}
+	// On Shutdown, the client is sent a GOAWAY frame and the connection is closed
+	// once its streams are done, the shutdown hook is registered on base
+	base := &http.Server{}
+	if tracked != nil && http2.ConfigureServer(base, srv) == nil {
+		tracked.onShutdown(func() {
+			_ = base.Shutdown(context.Background())
+		})
+	}
+	// The connection is idle while no stream is in-flight
+	tracked.end()
+	srv.ServeConn(clientConn, &http2.ServeConnOpts{
+		Context: mitm.context(),
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			tracked.begin()
+			defer tracked.end()
+
+			// since we're converting the request, need to carry over the original connecting IP as well
+			req.RemoteAddr = originalReq.RemoteAddr
+			req = inheritOriginalDst(req, originalReq)
+			req.URL.Scheme = "https"
+			req.URL.Host = req.Host
+			if req.URL.Host == "" {
+				req.URL.Host = originalReq.Host
+			}
+
+			// Copying a Context preserves the Transport, Middleware
+			req, ctx := session.withRequest(req)
+			resp, err := ctx.Next(req)
+			session.observe(resp)
+			if errors.Is(err, ConnectionResetErr) {
+				// reset the stream
+				panic(http.ErrAbortHandler)
+			}
+			if err != nil {
+				http.Error(rw, err.Error(), 502)
+				return
+			}
+			defer resp.Body.Close()
+
+			err = writeResponse(rw, resp, ctx, mitm.buffer())
+			if err != nil {
+				// The response has been partially written, reset the stream
+				panic(http.ErrAbortHandler)
+			}
+		}),
+	})
+}
+
+// writeResponse writes the resp to the decrypted client connection.
+// The body is streamed as it arrives, using the chunked transfer encoding
+// when its length is unknown. It reports whether the connection can be reused
+// for the next request.
+func (mitm *MitmHandler) writeResponse(w io.Writer, req *http.Request, resp *http.Response, ctx *Context) (keepAlive bool, err error) {
+	// Honor "Connection: close" from either side
+	keepAlive = !req.Close && !resp.Close
+
+	if ctx.shouldBuffer(resp) {
 		var (
 			// Body buffer
 			buffer = new(bytes.Buffer)
@@ -177,20 +375,110 @@ func (mitm *MitmHandler) transmit(clientConn net.Conn, originalReq *http.Request
 		bufferSize, err = io.CopyBuffer(buffer, resp.Body, buf)
 		mitm.buffer().Put(buf)
 		if err != nil {
-			_ = resp.Body.Close()
 			return
 		}
-		_ = resp.Body.Close()
 
 		// reset Content-Length
 		resp.ContentLength = bufferSize
-		resp.Header.Set("Content-Length", strconv.Itoa(int(bufferSize)))
 		resp.Body = io.NopCloser(buffer)
-		err = resp.Write(rawClientTls)
-		if err != nil {
+	}
+
+	var (
+		hasBody = bodyAllowed(req, resp)
+		chunked = hasBody && resp.ContentLength < 0 && req.ProtoAtLeast(1, 1)
+	)
+	if hasBody && resp.ContentLength < 0 && !chunked {
+		// HTTP/1.0 client, the end of the body is marked by closing the connection
+		keepAlive = false
+	}
+
+	header := resp.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Del("Connection")
+	header.Del("Transfer-Encoding")
+	header.Del("Trailer")
+	if chunked {
+		header.Del("Content-Length")
+		header.Set("Transfer-Encoding", "chunked")
+		if len(resp.Trailer) > 0 {
+			trailerKeys := make([]string, 0, len(resp.Trailer))
+			for k := range resp.Trailer {
+				trailerKeys = append(trailerKeys, k)
+			}
+			header.Set("Trailer", strings.Join(trailerKeys, ", "))
+		}
+	} else if resp.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	if !keepAlive {
+		header.Set("Connection", "close")
+	}
+
+	// write status line and headers
+	bw := bufio.NewWriter(w)
+	text := http.StatusText(resp.StatusCode)
+	if text == "" {
+		text = "status code " + strconv.Itoa(resp.StatusCode)
+	}
+	if _, err = fmt.Fprintf(bw, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, text); err != nil {
+		return
+	}
+	if err = header.Write(bw); err != nil {
+		return
+	}
+	if _, err = bw.WriteString("\r\n"); err != nil {
+		return
+	}
+	if !hasBody {
+		err = bw.Flush()
+		return
+	}
+
+	// write body
+	var body io.Writer = bw
+	if chunked {
+		body = newChunkedWriter(bw)
+	}
+	buf := mitm.buffer().Get()
+	for {
+		nr, rerr := resp.Body.Read(buf)
+		if nr > 0 {
+			if _, err = body.Write(buf[:nr]); err != nil {
+				break
+			}
+			// flush every write, so that Server-Sent Events reach the client immediately
+			if err = bw.Flush(); err != nil {
+				break
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+			}
+			break
+		}
+	}
+	mitm.buffer().Put(buf)
+	if err != nil {
+		return
+	}
+
+	if chunked {
+		if err = body.(io.WriteCloser).Close(); err != nil {
+			return
+		}
+		// The trailers are only available when the body has been read to EOF
+		if err = resp.Trailer.Write(bw); err != nil {
+			return
+		}
+		if _, err = bw.WriteString("\r\n"); err != nil {
 			return
 		}
 	}
+	err = bw.Flush()
+	return
 }
 
 // Use registers a Middleware to proxy
@@ -213,6 +501,14 @@ func (mitm *MitmHandler) OnResponse(filters ...Filter) *RespFilterGroup {
 	return &RespFilterGroup{ctx: mitm.Ctx, filters: filters}
 }
 
+// get a context.Context
+func (mitm *MitmHandler) context() context.Context {
+	if mitm.Ctx.Context != nil {
+		return mitm.Ctx.Context
+	}
+	return context.Background()
+}
+
 // Get buffer pool
 func (mitm *MitmHandler) buffer() httputil.BufferPool {
 	if mitm.BufferPool != nil {
@@ -229,41 +525,182 @@ func (mitm *MitmHandler) certContainer() cert.Container {
 	return cert.DefaultMemProvider
 }
 
+// UpstreamStats returns the metrics of the upstream connections
+func (mitm *MitmHandler) UpstreamStats() UpstreamStats {
+	return UpstreamStats{
+		Requests:       mitm.stats.requests.Load(),
+		ReusedConns:    mitm.stats.reusedConns.Load(),
+		PinnedSessions: mitm.stats.pinnedSessions.Load(),
+	}
+}
+
+// get the WebsocketHandler
+func (mitm *MitmHandler) websocketHandler() *WebsocketHandler {
+	if mitm.WebsocketHandler != nil {
+		return mitm.WebsocketHandler
+	}
+	return &WebsocketHandler{
+		Ctx:        mitm.Ctx,
+		BufferPool: mitm.buffer(),
+	}
+}
+
+// get a TunnelHandler for the connections passed through
+func (mitm *MitmHandler) tunnel() *TunnelHandler {
+	return &TunnelHandler{
+		Ctx:        mitm.Ctx,
+		BufferPool: mitm.buffer(),
+	}
+}
+
 // Transport
 func (mitm *MitmHandler) Transport() *http.Transport {
 	return mitm.Ctx.Transport
 }
 
 func (mitm *MitmHandler) TLSConfigFromCA(host string) (*tls.Config, error) {
+	return mitm.tlsConfigFromCA(&http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: host},
+		Host:   host,
+		Header: make(http.Header),
+	})
+}
+
+// tlsConfigFromCA issues the certificate for the host of the CONNECT request
+func (mitm *MitmHandler) tlsConfigFromCA(req *http.Request) (*tls.Config, error) {
+	host := req.URL.Host
+	addr := host
+	if !hasPort.MatchString(addr) {
+		addr += ":443"
+	}
 	host = stripPort(host)
 
+	name, hosts := certHosts(host, mitm.WildcardCert && !mitm.MimicUpstreamCert)
+
 	// Returned existing certificate for the host
-	crt, err := mitm.certContainer().Get(host)
+	crt, err := mitm.certContainer().Get(name)
 	if err == nil && crt != nil {
-		return &tls.Config{
-			InsecureSkipVerify: true,
-			Certificates:       []tls.Certificate{*crt},
-		}, nil
+		return mitm.tlsConfig(crt), nil
 	}
 
 	// Issue a certificate for host
-	crt, err = signHost(mitm.Certificate, []string{host})
+	key, err := mitm.leafKey()
+	if err != nil {
+		return nil, err
+	}
+	cached := true
+	if mitm.MimicUpstreamCert {
+		// Fallback to a regular certificate if the upstream is unreachable.
+		// The fallback isn't cached, the mimicry is tried again on the next connection.
+		var upstream *x509.Certificate
+		if upstream, err = mitm.upstreamCertificate(req, addr, host); err == nil {
+			crt, err = mimicHost(mitm.Certificate, upstream, key)
+		}
+		cached = err == nil
+	}
+	if crt == nil {
+		crt, err = signHost(mitm.Certificate, hosts, key)
+	}
 	if err != nil {
 		err = fmt.Errorf("cannot sign host certificate with provided CA: %v", err)
 		return nil, err
 	}
 
 	// Set certificate to container
-	_ = mitm.certContainer().Set(host, crt)
+	if cached {
+		_ = mitm.certContainer().Set(name, crt)
+	}
+
+	return mitm.tlsConfig(crt), nil
+}
+
+// upstreamCertificate connects to the upstream of the CONNECT request and returns its leaf certificate.
+// The upstream is dialed like the TunnelHandler does, through the upstream proxy of the Transport.
+func (mitm *MitmHandler) upstreamCertificate(req *http.Request, addr, serverName string) (*x509.Certificate, error) {
+	tr := mitm.Transport()
+	if tr == nil {
+		tr = DefaultTransport
+	}
+	var (
+		u   *url.URL
+		err error
+	)
+	if tr.Proxy != nil {
+		if u, err = tr.Proxy(req); err != nil {
+			return nil, err
+		}
+	}
+	if dst, ok := originalDstOf(req); ok {
+		addr = dst
+	}
+	config := cloneTLSConfig(tr.TLSClientConfig)
+	config.InsecureSkipVerify = true
+	config.NextProtos = nil
+	if net.ParseIP(serverName) == nil {
+		config.ServerName = serverName
+	}
 
-	return &tls.Config{
+	timeout := tr.TLSHandshakeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(mitm.context(), timeout)
+	defer cancel()
+
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dialProxy(ctx, dial, u, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("upstream sent no certificate")
+	}
+	return certs[0], nil
+}
+
+// leafKey returns the key pair shared by the leaf certificates,
+// or nil if a key pair is generated for each certificate
+func (mitm *MitmHandler) leafKey() (crypto.Signer, error) {
+	if !mitm.ReuseLeafKey {
+		return nil, nil
+	}
+	mitm.leafKeyMu.Lock()
+	defer mitm.leafKeyMu.Unlock()
+	if mitm.sharedLeafKey == nil {
+		key, err := newLeafKey(mitm.Certificate, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		mitm.sharedLeafKey = key
+	}
+	return mitm.sharedLeafKey, nil
+}
+
+// tlsConfig returns the tls.Config of the decrypted client connection
+func (mitm *MitmHandler) tlsConfig(crt *tls.Certificate) *tls.Config {
+	config := &tls.Config{
 		InsecureSkipVerify: true,
 		Certificates:       []tls.Certificate{*crt},
-	}, nil
+	}
+	if mitm.EnableHTTP2 {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	return config
 }
 
-// sign host
-func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+// sign host, a key is generated for the hosts if key is nil
+func signHost(ca tls.Certificate, hosts []string, key crypto.Signer) (cert *tls.Certificate, err error) {
 	// Use the provided ca for certificate generation.
 	var x509ca *x509.Certificate
 	x509ca, err = x509.ParseCertificate(ca.Certificate[0])
@@ -274,30 +711,10 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 	start := time.Unix(time.Now().Unix()-2592000, 0) // 2592000  = 30 day
 	end := time.Unix(time.Now().Unix()+31536000, 0)  // 31536000 = 365 day
 
-	var random CounterEncryptorRand
-	random, err = NewCounterEncryptorRand(ca.PrivateKey, hashHosts(hosts))
-	if err != nil {
-		return
-	}
-
-	var pk crypto.Signer
-	switch ca.PrivateKey.(type) {
-	case *rsa.PrivateKey:
-		pk, err = rsa.GenerateKey(&random, 2048)
-	case *ecdsa.PrivateKey:
-		pk, err = ecdsa.GenerateKey(elliptic.P256(), &random)
-	default:
-		err = fmt.Errorf("unsupported key type %T", ca.PrivateKey)
-	}
-	if err != nil {
-		return
-	}
-
 	// certificate template
 	serial := big.NewInt(mpsRand.Int63())
 	tpl := x509.Certificate{
 		SerialNumber: serial,
-		Issuer:       x509ca.Subject,
 		Subject: pkix.Name{
 			Organization: []string{"MPS untrusted MITM proxy Inc"},
 		},
@@ -318,9 +735,56 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 			tpl.Subject.CommonName = hosts[i]
 		}
 	}
+	return signCertificate(ca, x509ca, &tpl, hashHosts(hosts), key)
+}
+
+// mimic the upstream certificate, the leaf copies its Subject, SANs, validity and key usage.
+// A key is generated for the certificate if key is nil.
+func mimicHost(ca tls.Certificate, upstream *x509.Certificate, key crypto.Signer) (*tls.Certificate, error) {
+	x509ca, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	tpl := x509.Certificate{
+		SerialNumber:          big.NewInt(mpsRand.Int63()),
+		Subject:               upstream.Subject,
+		NotBefore:             upstream.NotBefore,
+		NotAfter:              upstream.NotAfter,
+		KeyUsage:              upstream.KeyUsage,
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		UnknownExtKeyUsage:    upstream.UnknownExtKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              upstream.DNSNames,
+		IPAddresses:           upstream.IPAddresses,
+		EmailAddresses:        upstream.EmailAddresses,
+		URIs:                  upstream.URIs,
+	}
+	// ExtraNames is used by CreateCertificate, Names is only filled by parsing
+	tpl.Subject.ExtraNames = nil
+	hash := sha1.Sum(upstream.Raw)
+	return signCertificate(ca, x509ca, &tpl, hash[:], key)
+}
+
+// signCertificate signs the certificate template with the ca.
+// The random generator is seeded with seed, so that the generated keys are deterministic.
+func signCertificate(ca tls.Certificate, x509ca *x509.Certificate, tpl *x509.Certificate, seed []byte, key crypto.Signer) (cert *tls.Certificate, err error) {
+	var random CounterEncryptorRand
+	random, err = NewCounterEncryptorRand(ca.PrivateKey, seed)
+	if err != nil {
+		return
+	}
+
+	pk := key
+	if pk == nil {
+		pk, err = newLeafKey(ca, &random)
+		if err != nil {
+			return
+		}
+	}
 
 	var der []byte
-	der, err = x509.CreateCertificate(&random, &tpl, x509ca, pk.Public(), ca.PrivateKey)
+	der, err = x509.CreateCertificate(&random, tpl, x509ca, pk.Public(), ca.PrivateKey)
 	if err != nil {
 		return
 	}
@@ -329,9 +793,42 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		Certificate: [][]byte{der, ca.Certificate[0]},
 		PrivateKey:  pk,
 	}
+	cert.Leaf, err = x509.ParseCertificate(der)
 	return
 }
 
+// newLeafKey generates a leaf key of the same type as the CA key
+func newLeafKey(ca tls.Certificate, random io.Reader) (crypto.Signer, error) {
+	switch ca.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return rsa.GenerateKey(random, 2048)
+	case *ecdsa.PrivateKey:
+		return ecdsa.GenerateKey(elliptic.P256(), random)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+	}
+}
+
+// certHosts returns the name of the certificate issued for host and its SANs.
+// With wildcard, the certificate covers the parent domain and all its direct subdomains,
+// but never a public suffix (e.g. *.co.uk) nor an IP address.
+func certHosts(host string, wildcard bool) (name string, hosts []string) {
+	if !wildcard || net.ParseIP(host) != nil {
+		return host, []string{host}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		// host is a public suffix or a single label
+		return host, []string{host}
+	}
+	parent := domain
+	if host != domain {
+		parent = host[strings.IndexByte(host, '.')+1:]
+	}
+	return "*." + parent, []string{"*." + parent, parent}
+}
+
 func stripPort(s string) string {
 	var ix int
 	if strings.Contains(s, "[") && strings.Contains(s, "]") {
@@ -375,6 +872,20 @@ func cloneTLSConfig(cfg *tls.Config) *tls.Config {
 	return cfg.Clone()
 }
 
+// bodyAllowed reports whether the response to req is allowed to have a body.
+func bodyAllowed(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead {
+		return false
+	}
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode <= 199:
+		return false
+	case resp.StatusCode == 204, resp.StatusCode == 304:
+		return false
+	}
+	return true
+}
+
 func isEof(r *bufio.Reader) bool {
 	_, err := r.Peek(1)
 	if err == io.EOF {
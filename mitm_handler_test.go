@@ -1,14 +1,24 @@
 package mps
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/telanflow/mps/cert"
 )
@@ -48,3 +58,557 @@ func TestNewMitmHandler(t *testing.T) {
 	asserts.Equal(resp.StatusCode, 200, "response status code not equal 200")
 	asserts.Equal(int64(len(body)), resp.ContentLength)
 }
+
+// create a http client that trusts the default MITM certificate
+func newMitmTestClient(proxyURL string) *http.Client {
+	clientCertPool := x509.NewCertPool()
+	clientCertPool.AppendCertsFromPEM([]byte(cert.CertPEM))
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse(proxyURL)
+			},
+			TLSClientConfig: &tls.Config{
+				RootCAs: clientCertPool,
+			},
+		},
+	}
+}
+
+func TestMitmHandler_Streaming(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		_, _ = rw.Write([]byte("data: second\n\n"))
+		rw.Header().Set("X-Checksum", "mps")
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	mitmHandler := NewMitmHandler()
+	mitmSrv := httptest.NewServer(mitmHandler)
+	defer mitmSrv.Close()
+
+	client := newMitmTestClient(mitmSrv.URL)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal(int64(-1), resp.ContentLength)
+
+	// The first event must arrive before the upstream finishes the response
+	first := make([]byte, len("data: first\n\n"))
+	_, err = io.ReadFull(resp.Body, first)
+	asserts.NoError(err)
+	asserts.Equal("data: first\n\n", string(first))
+
+	release <- struct{}{}
+	rest, err := io.ReadAll(resp.Body)
+	asserts.NoError(err)
+	asserts.Equal("data: second\n\n", string(rest))
+	asserts.Equal("mps", resp.Trailer.Get("X-Checksum"))
+
+	// The connection is kept alive for the next request
+	reused := false
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused = info.Reused
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp2, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp2.Body.Close()
+	asserts.True(reused, "the client connection should be reused")
+}
+
+func TestMitmHandler_ConnectionClose(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Connection", "close")
+		_, _ = rw.Write([]byte("hello world"))
+	}))
+	defer srv.Close()
+
+	mitmHandler := NewMitmHandler()
+	mitmSrv := httptest.NewServer(mitmHandler)
+	defer mitmSrv.Close()
+
+	client := newMitmTestClient(mitmSrv.URL)
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	asserts := assert.New(t)
+	asserts.Equal("hello world", string(body))
+	asserts.True(resp.Close, "Connection: close should be forwarded to the client")
+}
+
+func TestMitmHandler_HTTP2(t *testing.T) {
+	// The upstream only answers when all the requests have arrived
+	const total = 3
+	var arrived sync.WaitGroup
+	arrived.Add(total)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		_, _ = rw.Write([]byte(req.URL.Path))
+	}))
+	defer srv.Close()
+
+	mitmHandler := NewMitmHandler()
+	mitmHandler.EnableHTTP2 = true
+	mitmSrv := httptest.NewServer(mitmHandler)
+	defer mitmSrv.Close()
+
+	client := newMitmTestClient(mitmSrv.URL)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+
+	asserts := assert.New(t)
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL + path)
+			if !asserts.NoError(err) {
+				arrived.Done()
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			asserts.Equal(2, resp.ProtoMajor, "the client connection should use HTTP/2")
+			asserts.Equal(path, string(body))
+		}("/" + strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func TestCertHosts(t *testing.T) {
+	asserts := assert.New(t)
+	cases := []struct {
+		host  string
+		name  string
+		hosts []string
+	}{
+		{"a.example.com", "*.example.com", []string{"*.example.com", "example.com"}},
+		{"example.com", "*.example.com", []string{"*.example.com", "example.com"}},
+		{"b.a.example.com", "*.a.example.com", []string{"*.a.example.com", "a.example.com"}},
+		{"www.example.co.uk", "*.example.co.uk", []string{"*.example.co.uk", "example.co.uk"}},
+		{"co.uk", "co.uk", []string{"co.uk"}},
+		{"localhost", "localhost", []string{"localhost"}},
+		{"127.0.0.1", "127.0.0.1", []string{"127.0.0.1"}},
+		{"2606:4700::1111", "2606:4700::1111", []string{"2606:4700::1111"}},
+	}
+	for _, c := range cases {
+		name, hosts := certHosts(c.host, true)
+		asserts.Equal(c.name, name, c.host)
+		asserts.Equal(c.hosts, hosts, c.host)
+	}
+
+	name, hosts := certHosts("a.example.com", false)
+	asserts.Equal("a.example.com", name)
+	asserts.Equal([]string{"a.example.com"}, hosts)
+}
+
+func TestMitmHandler_WildcardCert(t *testing.T) {
+	mitm := NewMitmHandler()
+	mitm.WildcardCert = true
+	mitm.ReuseLeafKey = true
+
+	asserts := assert.New(t)
+	configA, err := mitm.TLSConfigFromCA("a.example.com:443")
+	asserts.NoError(err)
+	configB, err := mitm.TLSConfigFromCA("b.example.com:443")
+	asserts.NoError(err)
+	configC, err := mitm.TLSConfigFromCA("c.example.org:443")
+	asserts.NoError(err)
+
+	// a.example.com and b.example.com share the wildcard certificate
+	leaf, err := x509.ParseCertificate(configA.Certificates[0].Certificate[0])
+	asserts.NoError(err)
+	asserts.NoError(leaf.VerifyHostname("b.example.com"))
+	asserts.NoError(leaf.VerifyHostname("example.com"))
+	asserts.Equal(configA.Certificates[0].Certificate[0], configB.Certificates[0].Certificate[0])
+
+	// all the leaf certificates share a key pair
+	asserts.Equal(configA.Certificates[0].PrivateKey, configC.Certificates[0].PrivateKey)
+}
+
+func TestMitmHandler_MimicUpstreamCert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello mimic"))
+	}))
+	defer srv.Close()
+
+	mitm := NewMitmHandler()
+	mitm.MimicUpstreamCert = true
+	mitm.Transport().TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxySrv := httptest.NewServer(mitm)
+	defer proxySrv.Close()
+
+	var peerCert *x509.Certificate
+	client := newMitmTestClient(proxySrv.URL)
+	client.Transport.(*http.Transport).TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		peerCert = state.PeerCertificates[0]
+		return nil
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	upstream := srv.Certificate()
+	asserts := assert.New(t)
+	asserts.Equal("hello mimic", string(body))
+	asserts.Equal(upstream.Subject.String(), peerCert.Subject.String())
+	asserts.Equal(upstream.DNSNames, peerCert.DNSNames)
+	asserts.Equal(len(upstream.IPAddresses), len(peerCert.IPAddresses))
+	asserts.True(upstream.NotAfter.Equal(peerCert.NotAfter))
+	asserts.Equal(upstream.KeyUsage, peerCert.KeyUsage)
+
+	// signed by our CA
+	ca, _ := x509.ParseCertificate(cert.DefaultCertificate.Certificate[0])
+	asserts.NoError(peerCert.CheckSignatureFrom(ca))
+}
+
+func TestMitmHandler_MimicUpstreamCertFallback(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	var reachable atomic.Bool
+	mitm := NewMitmHandler()
+	mitm.MimicUpstreamCert = true
+	mitm.Transport().DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !reachable.Load() {
+			return nil, fmt.Errorf("unreachable %s", addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	subject := func(config *tls.Config) string {
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.String()
+	}
+
+	asserts := assert.New(t)
+	host := srv.Listener.Addr().String()
+	config, err := mitm.TLSConfigFromCA(host)
+	if !asserts.NoError(err) {
+		return
+	}
+	upstream := srv.Certificate().Subject.String()
+	asserts.NotEqual(upstream, subject(config), "the regular certificate should be issued")
+
+	// the upstream is reachable again, the fallback certificate isn't reused
+	reachable.Store(true)
+	config, err = mitm.TLSConfigFromCA(host)
+	if asserts.NoError(err) {
+		asserts.Equal(upstream, subject(config))
+	}
+}
+
+func TestMitmHandler_MimicUpstreamCertThroughProxy(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello mimic"))
+	}))
+	defer srv.Close()
+
+	socks := newTestSocks5Server(t, NewSocks5Handler())
+	defer socks.Close()
+	cascade := newTestProxyServer(t, NewHttpProxy())
+	defer cascade.Close()
+
+	for name, proxyURL := range map[string]string{
+		"socks5": "socks5://" + socks.Addr().String(),
+		"http":   "http://" + cascade.Addr().String(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			u, _ := url.Parse(proxyURL)
+			mitm := NewMitmHandler()
+			mitm.MimicUpstreamCert = true
+			tr := mitm.Transport()
+			tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			tr.Proxy = http.ProxyURL(u)
+			// only the upstream proxy can be dialed
+			tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if addr != u.Host {
+					return nil, fmt.Errorf("direct connection to %s", addr)
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			}
+			proxySrv := httptest.NewServer(mitm)
+			defer proxySrv.Close()
+
+			var peerCert *x509.Certificate
+			client := newMitmTestClient(proxySrv.URL)
+			client.Transport.(*http.Transport).TLSClientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+				peerCert = state.PeerCertificates[0]
+				return nil
+			}
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			asserts := assert.New(t)
+			asserts.Equal("hello mimic", string(body))
+			asserts.Equal(srv.Certificate().Subject.String(), peerCert.Subject.String(),
+				"the upstream certificate should be fetched through the proxy")
+		})
+	}
+}
+
+// create a client trusting only the certificate of srv
+func newPassthroughTestClient(proxyURL string, srv *httptest.Server, serverName string) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse(proxyURL)
+			},
+			TLSClientConfig: &tls.Config{
+				RootCAs:    pool,
+				ServerName: serverName,
+			},
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func TestMitmHandler_Passthrough(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello passthrough"))
+	}))
+	defer srv.Close()
+
+	mitm := NewMitmHandler()
+	mitm.PassthroughRules = NewPassthroughRules("*.example.com")
+	proxySrv := httptest.NewServer(mitm)
+	defer proxySrv.Close()
+
+	asserts := assert.New(t)
+
+	// The CONNECT host is an IP address, the server name (SNI) matches the rules
+	client := newPassthroughTestClient(proxySrv.URL, srv, "www.example.com")
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	asserts.Equal("hello passthrough", string(body))
+
+	// The host doesn't match, the client rejects the leaf certificate
+	client = newPassthroughTestClient(proxySrv.URL, srv, "example.com")
+	_, err = client.Get(srv.URL)
+	asserts.Error(err)
+
+	// The CONNECT request matches a filter
+	mitm.PassthroughRules.AddFilters(FilterHostIs(srv.Listener.Addr().String()))
+	resp, err = client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	asserts.Equal(200, resp.StatusCode)
+}
+
+func TestMitmHandler_PassthroughHandshakeFailures(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello passthrough"))
+	}))
+	defer srv.Close()
+
+	mitm := NewMitmHandler()
+	mitm.PassthroughRules = NewPassthroughRules()
+	mitm.PassthroughRules.MaxHandshakeFailures = 2
+	proxySrv := httptest.NewServer(mitm)
+	defer proxySrv.Close()
+
+	// The client pins the certificate of the server
+	client := newPassthroughTestClient(proxySrv.URL, srv, "example.com")
+	failures := 0
+	for i := 0; i < 20; i++ {
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		failures++
+		// wait for the proxy to receive the alert
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	asserts := assert.New(t)
+	asserts.Equal(2, failures)
+	asserts.True(mitm.PassthroughRules.MatchHost("example.com"))
+}
+
+func TestMitmHandler_Websocket(t *testing.T) {
+	srv := httptest.NewTLSServer(websocketEchoHandler)
+	defer srv.Close()
+
+	var upgradeURL string
+	mitm := NewMitmHandler()
+	mitm.Transport().TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	mitm.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		if isWebSocketRequest(req) {
+			upgradeURL = req.URL.String()
+		}
+		return ctx.Next(req)
+	})
+	proxySrv := httptest.NewServer(mitm)
+	defer proxySrv.Close()
+
+	clientCertPool := x509.NewCertPool()
+	clientCertPool.AppendCertsFromPEM([]byte(cert.CertPEM))
+	dialer := websocket.Dialer{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse(proxySrv.URL)
+		},
+		TLSClientConfig: &tls.Config{RootCAs: clientCertPool},
+	}
+
+	// Convert https://127.0.0.1 to wss://127.0.0.1
+	endPoint := "wss" + strings.TrimPrefix(srv.URL, "https") + "/echo"
+	client, _, err := dialer.Dial(endPoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(srv.URL+"/echo", upgradeURL, "the middlewares should see the decrypted upgrade request")
+	for i := 0; i < 3; i++ {
+		asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte("hello mitm")))
+		_, p, err := client.ReadMessage()
+		asserts.NoError(err)
+		asserts.Equal("hello mitm", string(p))
+	}
+}
+
+// create a test server with a connection-bound authentication like NTLM,
+// the challenge response must be sent on the connection of the negotiation.
+func newTestNTLMServer() *httptest.Server {
+	var (
+		mu       sync.Mutex
+		authConn string
+	)
+	return httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.Header.Get("Authorization") {
+		case "NTLM negotiate":
+			authConn = req.RemoteAddr
+			rw.Header().Set("WWW-Authenticate", "NTLM challenge")
+			rw.WriteHeader(http.StatusUnauthorized)
+		case "NTLM authenticate":
+			if req.RemoteAddr != authConn {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = rw.Write([]byte("authenticated"))
+		default:
+			rw.Header().Set("WWW-Authenticate", "NTLM")
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+}
+
+func TestMitmHandler_UpstreamPinning(t *testing.T) {
+	srv := newTestNTLMServer()
+	defer srv.Close()
+
+	asserts := assert.New(t)
+	for _, mode := range []PinMode{PinNever, PinAuth} {
+		mitm := NewMitmHandler()
+		// Each request uses a new upstream connection, unless the session is pinned
+		mitm.Transport().DisableKeepAlives = true
+		mitm.UpstreamPinning = mode
+		proxySrv := httptest.NewServer(mitm)
+
+		client := newMitmTestClient(proxySrv.URL)
+		var statusCode int
+		for _, auth := range []string{"", "NTLM negotiate", "NTLM authenticate"} {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			statusCode = resp.StatusCode
+		}
+		proxySrv.Close()
+
+		stats := mitm.UpstreamStats()
+		asserts.Equal(int64(3), stats.Requests)
+		if mode == PinNever {
+			asserts.Equal(http.StatusUnauthorized, statusCode)
+			asserts.Equal(int64(0), stats.PinnedSessions)
+			asserts.Equal(int64(0), stats.ReusedConns)
+		} else {
+			// The first session is closed by the "Connection: close" of the upstream
+			asserts.Equal(http.StatusOK, statusCode)
+			asserts.Equal(int64(2), stats.PinnedSessions)
+			asserts.Equal(int64(1), stats.ReusedConns)
+			asserts.InDelta(1.0/3, stats.ReuseRate(), 0.001)
+		}
+	}
+}
+
+func TestMitmHandler_RequestTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello world"))
+	}))
+	defer srv.Close()
+
+	var state *tls.ConnectionState
+	mitm := NewMitmHandler()
+	mitm.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		if req.Method != http.MethodConnect {
+			state = req.TLS
+		}
+		return ctx.Next(req)
+	})
+	proxySrv := httptest.NewServer(mitm)
+	defer proxySrv.Close()
+
+	resp, err := newMitmTestClient(proxySrv.URL).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The middlewares see the TLS session of the decrypted client connection
+	asserts := assert.New(t)
+	if asserts.NotNil(state) {
+		asserts.True(state.HandshakeComplete)
+		asserts.NotZero(state.Version)
+	}
+}
@@ -0,0 +1,139 @@
+package mps
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// PinMode decides when the decrypted requests of a client TLS session
+// are pinned to a dedicated upstream connection
+type PinMode int
+
+const (
+	// PinNever sends all the requests through the shared Transport pool
+	PinNever PinMode = iota
+	// PinAuth pins the session when a connection-bound authentication
+	// (NTLM, Negotiate/Kerberos) is used, as it authenticates the connection instead of the request
+	PinAuth
+	// PinAlways pins every session
+	PinAlways
+)
+
+// UpstreamStats counts the upstream connections used by the decrypted requests
+type UpstreamStats struct {
+	// Requests is the number of requests that got an upstream connection
+	Requests int64
+	// ReusedConns is the number of requests sent on a reused connection
+	ReusedConns int64
+	// PinnedSessions is the number of client TLS sessions pinned to a dedicated connection
+	PinnedSessions int64
+}
+
+// ReuseRate returns the ratio of the requests sent on a reused connection
+func (s UpstreamStats) ReuseRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.ReusedConns) / float64(s.Requests)
+}
+
+type upstreamStats struct {
+	requests       atomic.Int64
+	reusedConns    atomic.Int64
+	pinnedSessions atomic.Int64
+}
+
+// mitmSession is the state of a decrypted client TLS session
+type mitmSession struct {
+	mitm  *MitmHandler
+	trace *httptrace.ClientTrace
+
+	mu sync.Mutex
+	// transport is the dedicated Transport of the pinned session, nil if not pinned
+	transport *http.Transport
+}
+
+func newMitmSession(mitm *MitmHandler) *mitmSession {
+	s := &mitmSession{mitm: mitm}
+	s.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mitm.stats.requests.Add(1)
+			if info.Reused {
+				mitm.stats.reusedConns.Add(1)
+			}
+		},
+	}
+	if mitm.UpstreamPinning == PinAlways {
+		s.pin()
+	}
+	return s
+}
+
+// withRequest returns the request traced for the metrics and its Context.
+// The Context uses the dedicated Transport if the session is pinned.
+func (s *mitmSession) withRequest(req *http.Request) (*http.Request, *Context) {
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), s.trace))
+	ctx := s.mitm.Ctx.WithRequest(req)
+
+	// The NTLM and Negotiate handshakes must be sent on the same connection
+	if s.mitm.UpstreamPinning == PinAuth && isConnectionAuth(req.Header.Values("Authorization")) {
+		s.pin()
+	}
+	s.mu.Lock()
+	if s.transport != nil {
+		ctx.Transport = s.transport
+	}
+	s.mu.Unlock()
+	return req, ctx
+}
+
+// observe pins the session if the upstream asks for a connection-bound authentication
+func (s *mitmSession) observe(resp *http.Response) {
+	if s.mitm.UpstreamPinning == PinAuth && resp != nil && isConnectionAuth(resp.Header.Values("Www-Authenticate")) {
+		s.pin()
+	}
+}
+
+// pin the session to a dedicated Transport holding a single connection per host
+func (s *mitmSession) pin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transport != nil {
+		return
+	}
+	tr := s.mitm.Transport()
+	if tr == nil {
+		tr = DefaultTransport
+	}
+	s.transport = tr.Clone()
+	s.transport.DisableKeepAlives = false
+	s.transport.MaxConnsPerHost = 1
+	s.transport.MaxIdleConnsPerHost = 1
+	s.mitm.stats.pinnedSessions.Add(1)
+}
+
+// close releases the dedicated connection when the client session ends
+func (s *mitmSession) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+		releaseSocksTransports(s.transport)
+		originalDstTransports.release(s.transport)
+	}
+}
+
+// isConnectionAuth reports whether the authorization or challenge headers use
+// a connection-bound authentication scheme
+func isConnectionAuth(values []string) bool {
+	for _, v := range values {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if strings.EqualFold(scheme, "NTLM") || strings.EqualFold(scheme, "Negotiate") {
+			return true
+		}
+	}
+	return false
+}
@@ -2,10 +2,29 @@ package mps
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
 var (
-	// global random numbers for MPS. Go v1.20
-	mpsRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	// global random numbers for MPS, safe for concurrent use. Go v1.20
+	mpsRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
 )
+
+// lockedSource is a rand.Source safe for concurrent use
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package mps
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// originalDst returns the destination address of a connection
+// redirected by iptables (REDIRECT or DNAT)
+func originalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original destination requires a TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		addr    string
+		sockErr error
+		isIPv4  = tcpConn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	)
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// The sockaddr_in fits in the ipv6_mreq structure
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			ip := net.IP(mreq.Multiaddr[4:8])
+			addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+			return
+		}
+
+		// The sockaddr_in6 fits in the ip6_mtuinfo structure
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+		ip := net.IP(info.Addr.Addr[:])
+		addr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	})
+	if err != nil {
+		return "", err
+	}
+	return addr, sockErr
+}
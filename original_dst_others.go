@@ -0,0 +1,14 @@
+//go:build !linux
+
+package mps
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst returns the destination address of a redirected connection,
+// it is only supported on linux.
+func originalDst(conn net.Conn) (string, error) {
+	return "", errors.New("original destination is not supported on this platform")
+}
@@ -0,0 +1,170 @@
+package mps
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHandshakeFailureTTL is the default duration the handshake failures of a host are remembered
+const DefaultHandshakeFailureTTL = time.Hour
+
+// maxHandshakeFailureHosts is the number of hosts above which the expired failures are swept
+const maxHandshakeFailureHosts = 1024
+
+// PassthroughRules decides which CONNECT requests the MitmHandler doesn't decrypt.
+// The matching connections are tunneled as-is, like the TunnelHandler does,
+// e.g. for the certificate-pinned apps or the sites that must not be inspected.
+type PassthroughRules struct {
+	// Hosts are the host names or glob patterns (e.g. "*.example.com") to pass through.
+	// They are matched against the CONNECT host and the server name (SNI) of the client.
+	Hosts []string
+
+	// Filters are matched against the CONNECT request
+	Filters []Filter
+
+	// MaxHandshakeFailures passes through a host automatically after its clients
+	// rejected the leaf certificate MaxHandshakeFailures times in a row. Zero disables it.
+	MaxHandshakeFailures int
+
+	// HandshakeFailureTTL is the duration the handshake failures of a host are remembered
+	// after the last one, so that a host is decrypted again once it expires.
+	// If zero, DefaultHandshakeFailureTTL is used.
+	HandshakeFailureTTL time.Duration
+
+	mu       sync.RWMutex
+	failures map[string]handshakeFailures
+}
+
+type handshakeFailures struct {
+	count int
+	last  time.Time
+}
+
+// NewPassthroughRules Create a PassthroughRules with hosts
+func NewPassthroughRules(hosts ...string) *PassthroughRules {
+	return &PassthroughRules{
+		Hosts:    hosts,
+		failures: make(map[string]handshakeFailures),
+	}
+}
+
+// AddHosts adds host names or glob patterns
+func (r *PassthroughRules) AddHosts(hosts ...string) {
+	r.mu.Lock()
+	r.Hosts = append(r.Hosts, hosts...)
+	r.mu.Unlock()
+}
+
+// AddFilters adds filters matched against the CONNECT request
+func (r *PassthroughRules) AddFilters(filters ...Filter) {
+	r.mu.Lock()
+	r.Filters = append(r.Filters, filters...)
+	r.mu.Unlock()
+}
+
+// Match reports whether the CONNECT request must be passed through
+func (r *PassthroughRules) Match(req *http.Request) bool {
+	if r.MatchHost(stripPort(req.URL.Host)) {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, filter := range r.Filters {
+		if filter.Match(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchHost reports whether the host must be passed through
+func (r *PassthroughRules) MatchHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.MaxHandshakeFailures > 0 {
+		if f, ok := r.failures[host]; ok && !r.expired(f) && f.count >= r.MaxHandshakeFailures {
+			return true
+		}
+	}
+	for _, pattern := range r.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host {
+			return true
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HandshakeFailed records that a client rejected the leaf certificate of host
+func (r *PassthroughRules) HandshakeFailed(host string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures == nil {
+		r.failures = make(map[string]handshakeFailures)
+	}
+	f := r.failures[host]
+	if r.expired(f) {
+		f.count = 0
+	}
+	f.count++
+	f.last = time.Now()
+	r.failures[host] = f
+
+	if len(r.failures) > maxHandshakeFailureHosts {
+		for h, f := range r.failures {
+			if r.expired(f) {
+				delete(r.failures, h)
+			}
+		}
+	}
+}
+
+// HandshakeSucceeded resets the handshake failures of host
+func (r *PassthroughRules) HandshakeSucceeded(host string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.mu.RLock()
+	_, ok := r.failures[host]
+	r.mu.RUnlock()
+	if ok {
+		r.mu.Lock()
+		delete(r.failures, host)
+		r.mu.Unlock()
+	}
+}
+
+// ResetHandshakeFailures forgets the handshake failures of all the hosts
+func (r *PassthroughRules) ResetHandshakeFailures() {
+	r.mu.Lock()
+	r.failures = make(map[string]handshakeFailures)
+	r.mu.Unlock()
+}
+
+// expired reports whether the handshake failures are too old to be counted
+func (r *PassthroughRules) expired(f handshakeFailures) bool {
+	ttl := r.HandshakeFailureTTL
+	if ttl <= 0 {
+		ttl = DefaultHandshakeFailureTTL
+	}
+	return time.Since(f.last) > ttl
+}
+
+// isRemoteAlert reports whether the TLS handshake failed with an alert sent by the peer,
+// e.g. a client that doesn't trust the leaf certificate
+func isRemoteAlert(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "remote error"
+}
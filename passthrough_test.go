@@ -0,0 +1,61 @@
+package mps
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/telanflow/mps/cert"
+)
+
+func TestPassthroughRules_HandshakeFailureTTL(t *testing.T) {
+	rules := NewPassthroughRules()
+	rules.MaxHandshakeFailures = 2
+	rules.HandshakeFailureTTL = 50 * time.Millisecond
+
+	asserts := assert.New(t)
+	rules.HandshakeFailed("example.com")
+	asserts.False(rules.MatchHost("example.com"))
+	rules.HandshakeFailed("Example.com.")
+	asserts.True(rules.MatchHost("example.com"))
+
+	// the failures expire, the host is decrypted again
+	time.Sleep(100 * time.Millisecond)
+	asserts.False(rules.MatchHost("example.com"))
+	rules.HandshakeFailed("example.com")
+	asserts.False(rules.MatchHost("example.com"), "the expired failures should not be counted")
+	rules.HandshakeFailed("example.com")
+	asserts.True(rules.MatchHost("example.com"))
+
+	rules.ResetHandshakeFailures()
+	asserts.False(rules.MatchHost("example.com"))
+
+	rules.HandshakeFailed("example.com")
+	rules.HandshakeFailed("example.com")
+	rules.HandshakeSucceeded("example.com")
+	asserts.False(rules.MatchHost("example.com"))
+}
+
+func TestIsRemoteAlert(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	// the client doesn't trust the certificate of the server and sends an alert
+	go func() {
+		_ = tls.Client(clientConn, &tls.Config{ServerName: "example.com"}).Handshake()
+		_ = clientConn.Close()
+	}()
+	err := tls.Server(serverConn, &tls.Config{
+		Certificates: []tls.Certificate{cert.DefaultCertificate},
+	}).Handshake()
+
+	asserts := assert.New(t)
+	asserts.Error(err)
+	asserts.True(isRemoteAlert(err), "%v", err)
+	asserts.False(isRemoteAlert(errors.New("remote error: tls: bad certificate")))
+	asserts.False(isRemoteAlert(&net.OpError{Op: "read", Err: errors.New("EOF")}))
+}
@@ -0,0 +1,401 @@
+package mps
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS protocol version 4 and 4a
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+	socks4Granted    = 0x5a
+)
+
+// dialFunc is the signature of http.Transport.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// maxSocksTransports is the number of Transports derived for the SOCKS upstream proxies kept in the cache
+const maxSocksTransports = 64
+
+// socksTransports caches the http.Transport derived for each SOCKS upstream proxy
+var socksTransports = newTransportCache(maxSocksTransports)
+
+type socksTransportKey struct {
+	transport *http.Transport
+	proxy     string
+}
+
+// transportCache holds the most recently used Transports derived from the Transports of the Context.
+// The idle connections of the evicted Transports are closed.
+// A Transport replaced on the Context is evicted once it is no longer used,
+// a Transport must not be modified once it has been used, as required by net/http.
+type transportCache struct {
+	max int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[interface{}]*list.Element
+}
+
+type transportCacheItem struct {
+	key       interface{}
+	base      *http.Transport
+	transport *http.Transport
+}
+
+func newTransportCache(max int) *transportCache {
+	return &transportCache{
+		max:   max,
+		lru:   list.New(),
+		items: make(map[interface{}]*list.Element),
+	}
+}
+
+// get returns the cached Transport of the key, or stores the one derived from base
+func (c *transportCache) get(key interface{}, base *http.Transport, derive func() *http.Transport) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*transportCacheItem).transport
+	}
+	tr := derive()
+	c.items[key] = c.lru.PushFront(&transportCacheItem{key: key, base: base, transport: tr})
+	for c.lru.Len() > c.max {
+		c.remove(c.lru.Back())
+	}
+	return tr
+}
+
+// release removes the Transports derived from base
+func (c *transportCache) release(base *http.Transport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.items {
+		if el.Value.(*transportCacheItem).base == base {
+			c.remove(el)
+		}
+	}
+}
+
+// len returns the number of cached Transports
+func (c *transportCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *transportCache) remove(el *list.Element) {
+	item := el.Value.(*transportCacheItem)
+	c.lru.Remove(el)
+	delete(c.items, item.key)
+	item.transport.CloseIdleConnections()
+}
+
+// isSocksProxy reports whether the upstream proxy URL is a SOCKS proxy
+func isSocksProxy(u *url.URL) bool {
+	switch u.Scheme {
+	case "socks5", "socks5h", "socks4", "socks4a":
+		return true
+	}
+	return false
+}
+
+// dialSocks connects to addr through the SOCKS upstream proxy u.
+// The connection to the SOCKS server is made with dial.
+func dialSocks(ctx context.Context, dial dialFunc, u *url.URL, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", hostAndPort(u.Host))
+	if err != nil {
+		return nil, err
+	}
+
+	stop := watchHandshake(ctx, conn)
+	switch u.Scheme {
+	case "socks4", "socks4a":
+		err = socks4Connect(ctx, conn, u, addr)
+	default:
+		err = socks5Connect(ctx, conn, u, addr)
+	}
+	if err = stop(err); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// watchHandshake aborts the handshake on conn when ctx is done.
+// The returned function ends the watch, it clears the deadline of conn
+// and returns the error of the context if the handshake was aborted.
+func watchHandshake(ctx context.Context, conn net.Conn) func(err error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// unblock the pending reads and writes
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func(err error) error {
+		close(done)
+		<-exited
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// the deadline of conn may expire before the context
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return context.DeadlineExceeded
+			}
+			return err
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return nil
+	}
+}
+
+// socks5Connect sends the SOCKS5 CONNECT command, RFC 1928.
+// The host is resolved locally with the socks5 scheme, by the server with socks5h.
+func socks5Connect(ctx context.Context, conn net.Conn, u *url.URL, addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "socks5" && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return err
+		}
+		host = ips[0].String()
+	}
+
+	// VER NMETHODS METHODS
+	methods := []byte{socks5Version, 1, socks5AuthNone}
+	if u.User != nil {
+		methods = []byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword}
+	}
+	if _, err = conn.Write(methods); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return Socks5HandshakeErr
+	}
+
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if u.User == nil {
+			return Socks5AuthErr
+		}
+		// username/password authentication, RFC 1929
+		username := u.User.Username()
+		password, _ := u.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return Socks5AuthErr
+		}
+		auth := []byte{socks5PasswordVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err = conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return Socks5AuthErr
+		}
+	default:
+		return Socks5AuthErr
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := bytes.NewBuffer([]byte{socks5Version, socks5CmdConnect, 0x00})
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			request.WriteByte(socks5AddrIPv4)
+			request.Write(ip4)
+		} else {
+			request.WriteByte(socks5AddrIPv6)
+			request.Write(ip.To16())
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("socks5: host name too long: %s", host)
+		}
+		request.Write([]byte{socks5AddrDomain, byte(len(host))})
+		request.WriteString(host)
+	}
+	_ = binary.Write(request, binary.BigEndian, port)
+	if _, err = conn.Write(request.Bytes()); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT
+	head := make([]byte, 3)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != socks5Succeeded {
+		return fmt.Errorf("socks5: connect %s failed with reply %d", addr, head[1])
+	}
+	_, err = readSocks5Addr(conn)
+	return err
+}
+
+// socks4Connect sends the SOCKS4 or SOCKS4a CONNECT command
+func socks4Connect(ctx context.Context, conn net.Conn, u *url.URL, addr string) error {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	// VN CD DSTPORT DSTIP USERID NULL [HOST NULL]
+	request := bytes.NewBuffer([]byte{socks4Version, socks4CmdConnect})
+	_ = binary.Write(request, binary.BigEndian, port)
+
+	ip := net.ParseIP(host).To4()
+	if ip == nil && u.Scheme == "socks4" {
+		// SOCKS4 only accepts IPv4 addresses, the host must be resolved locally
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+		if err != nil {
+			return err
+		}
+		ip = ips[0].To4()
+	}
+	if ip != nil {
+		request.Write(ip)
+	} else {
+		// SOCKS4a: 0.0.0.x tells the server to resolve the host
+		request.Write([]byte{0, 0, 0, 1})
+	}
+	if u.User != nil {
+		request.WriteString(u.User.Username())
+	}
+	request.WriteByte(0x00)
+	if ip == nil {
+		request.WriteString(host)
+		request.WriteByte(0x00)
+	}
+	if _, err = conn.Write(request.Bytes()); err != nil {
+		return err
+	}
+
+	// VN CD DSTPORT DSTIP
+	reply := make([]byte, 8)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks4Granted {
+		return fmt.Errorf("socks4: connect %s failed with reply %d", addr, reply[1])
+	}
+	return nil
+}
+
+// socksTransport returns a http.Transport that dials through the SOCKS upstream proxy u.
+// The derived Transport is cached, so that its connections can be reused.
+func socksTransport(tr *http.Transport, u *url.URL) *http.Transport {
+	key := socksTransportKey{transport: tr, proxy: u.String()}
+	return socksTransports.get(key, tr, func() *http.Transport {
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		derived := tr.Clone()
+		derived.Proxy = nil
+		derived.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSocks(ctx, dial, u, addr)
+		}
+		return derived
+	})
+}
+
+// connectCascadeProxy opens a tunnel to addr through the HTTP upstream proxy u,
+// conn is closed if it fails. The handshake is aborted when ctx is done.
+func connectCascadeProxy(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	stop := watchHandshake(ctx, conn)
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, stop(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err = stop(err); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy: connect %s failed with status %s", addr, resp.Status)
+	}
+	return &peekedConn{Conn: conn, r: br}, nil
+}
+
+// dialProxy connects to addr through the upstream proxy u, or directly if u is nil
+func dialProxy(ctx context.Context, dial dialFunc, u *url.URL, addr string) (net.Conn, error) {
+	if u == nil {
+		return dial(ctx, "tcp", addr)
+	}
+	if isSocksProxy(u) {
+		return dialSocks(ctx, dial, u, addr)
+	}
+	conn, err := dial(ctx, "tcp", hostAndPort(u.Host))
+	if err != nil {
+		return nil, err
+	}
+	return connectCascadeProxy(ctx, conn, u, addr)
+}
+
+// releaseSocksTransports removes the Transports derived from tr from the cache
+func releaseSocksTransports(tr *http.Transport) {
+	socksTransports.release(tr)
+}
+
+func splitHostPort(addr string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+	return host, uint16(portNum), nil
+}
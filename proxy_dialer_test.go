@@ -0,0 +1,262 @@
+package mps
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// create a test SOCKS4a server, it only accepts the userid "mps"
+func newTestSocks4Server(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				head := make([]byte, 8)
+				if _, err := io.ReadFull(conn, head); err != nil {
+					return
+				}
+				readString := func() string {
+					var s []byte
+					b := make([]byte, 1)
+					for {
+						if _, err := io.ReadFull(conn, b); err != nil || b[0] == 0 {
+							return string(s)
+						}
+						s = append(s, b[0])
+					}
+				}
+				userid := readString()
+				host := net.IP(head[4:8]).String()
+				if head[4] == 0 && head[5] == 0 && head[6] == 0 {
+					host = readString()
+				}
+				if userid != "mps" {
+					_, _ = conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				port := binary.BigEndian.Uint16(head[2:4])
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					_, _ = conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+				go func() {
+					_, _ = io.Copy(target, conn)
+				}()
+				_, _ = io.Copy(conn, target)
+			}(conn)
+		}
+	}()
+	return l
+}
+
+func TestTunnelHandler_Socks5Upstream(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	socks := NewSocks5Handler()
+	socks.Authenticate = func(username, password string) bool {
+		return username == "foo" && password == "bar"
+	}
+	l := newTestSocks5Server(t, socks)
+	defer l.Close()
+
+	tunnel := NewTunnelHandler()
+	tunnel.Transport().Proxy = func(r *http.Request) (*url.URL, error) {
+		return url.Parse("socks5://foo:bar@" + l.Addr().String())
+	}
+	tunnelSrv := httptest.NewServer(tunnel)
+	defer tunnelSrv.Close()
+
+	resp, err := HttpGet(srv.URL, func(r *http.Request) (*url.URL, error) {
+		return url.Parse(tunnelSrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("hello world", string(body))
+}
+
+func TestForwardHandler_Socks4aUpstream(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	l := newTestSocks4Server(t)
+	defer l.Close()
+
+	forward := NewForwardHandler()
+	forward.Transport().Proxy = func(r *http.Request) (*url.URL, error) {
+		return url.Parse("socks4a://mps@" + l.Addr().String())
+	}
+	proxySrv := httptest.NewServer(forward)
+	defer proxySrv.Close()
+
+	// The target is addressed by name, it is resolved by the SOCKS4a server
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	resp, err := HttpGet("http://localhost:"+port, func(r *http.Request) (*url.URL, error) {
+		return url.Parse(proxySrv.URL)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("hello world", string(body))
+}
+
+func TestDialSocks_Rejected(t *testing.T) {
+	l := newTestSocks4Server(t)
+	defer l.Close()
+
+	u, _ := url.Parse("socks4a://nobody@" + l.Addr().String())
+	tunnel := NewTunnelHandler()
+	_, err := dialSocks(tunnel.context(), tunnel.dial, u, "localhost:80")
+	assert.Error(t, err)
+}
+
+func TestSocksTransport_Bounded(t *testing.T) {
+	u, _ := url.Parse("socks5://127.0.0.1:1080")
+	first := &http.Transport{}
+	derived := socksTransport(first, u)
+	asserts := assert.New(t)
+	asserts.Same(derived, socksTransport(first, u), "the derived Transport is reused")
+
+	// Every replaced Transport derives a new one, the oldest are evicted
+	for i := 0; i < 2*maxSocksTransports; i++ {
+		socksTransport(&http.Transport{}, u)
+	}
+	asserts.Equal(maxSocksTransports, socksTransports.len())
+	asserts.NotSame(derived, socksTransport(first, u), "the evicted Transport is derived again")
+
+	releaseSocksTransports(first)
+	asserts.Equal(maxSocksTransports-1, socksTransports.len())
+}
+
+func TestDialSocks_Socks5Resolve(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the SOCKS5 server reports the address type of the CONNECT commands and refuses them
+	atyps := make(chan byte, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			methods := make([]byte, 3)
+			head := make([]byte, 4)
+			if _, err = io.ReadFull(conn, methods); err == nil {
+				_, _ = conn.Write([]byte{socks5Version, socks5AuthNone})
+				if _, err = io.ReadFull(conn, head); err == nil {
+					atyps <- head[3]
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		scheme string
+		atyp   byte
+	}{
+		{"socks5h", socks5AddrDomain},
+		{"socks5", 0},
+	}
+	tunnel := NewTunnelHandler()
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			u, _ := url.Parse(tt.scheme + "://" + l.Addr().String())
+			_, err := dialSocks(tunnel.context(), tunnel.dial, u, "localhost:80")
+			assert.Error(t, err)
+			atyp := <-atyps
+			if tt.atyp == socks5AddrDomain {
+				assert.Equal(t, tt.atyp, atyp, "the host should be resolved by the server")
+			} else {
+				assert.Contains(t, []byte{socks5AddrIPv4, socks5AddrIPv6}, atyp, "the host should be resolved locally")
+			}
+		})
+	}
+}
+
+func TestConnectCascadeProxy_Stalled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the upstream proxy accepts the connections and never answers
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		err  error
+	}{
+		{
+			name: "deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 20*time.Millisecond)
+			},
+			err: context.DeadlineExceeded,
+		},
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(20*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+			err: context.Canceled,
+		},
+	}
+	u, _ := url.Parse("http://" + l.Addr().String())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			start := time.Now()
+			_, err := dialProxy(ctx, (&net.Dialer{}).DialContext, u, "example.com:443")
+			assert.ErrorIs(t, err, tt.err)
+			assert.Less(t, time.Since(start), time.Second, "the handshake should stop with the context")
+		})
+	}
+}
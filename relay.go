@@ -0,0 +1,180 @@
+package mps
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relayConns copies the data between a and b in both directions, until both of them are done.
+// When a side has finished sending, the peer is half-closed so that it can still answer.
+// If the peer can't be half-closed, or the copy failed, both connections are closed.
+func relayConns(a, b net.Conn, bufferPool httputil.BufferPool) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		copyHalf(b, a, bufferPool)
+	}()
+	copyHalf(a, b, bufferPool)
+	wg.Wait()
+}
+
+// copyHalf copies src to dst, then closes the write side of dst
+func copyHalf(dst, src net.Conn, bufferPool httputil.BufferPool) {
+	buf := bufferPool.Get()
+	_, err := io.CopyBuffer(dst, src, buf)
+	bufferPool.Put(buf)
+	if err != nil || !closeWrite(dst) {
+		_ = dst.Close()
+		_ = src.Close()
+	}
+}
+
+// closeWrite shuts down the writing side of conn, it reports whether conn supports half-close
+func closeWrite(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite() == nil
+	case connWrapper:
+		return closeWrite(c.NetConn())
+	}
+	return false
+}
+
+// connWrapper is a connection wrapping another one, like tls.Conn
+type connWrapper interface {
+	NetConn() net.Conn
+}
+
+// connWatchdog closes the relayed connections when they have been idle for too long,
+// when they have reached their maximum lifetime, or when the context is done.
+type connWatchdog struct {
+	ctx         context.Context
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	started     time.Time
+	lastActive  atomic.Int64
+	conns       []io.Closer
+	stopped     chan struct{}
+	stopOnce    sync.Once
+}
+
+// newConnWatchdog Create a connWatchdog, zero durations are unlimited
+func newConnWatchdog(ctx context.Context, idleTimeout, maxLifetime time.Duration) *connWatchdog {
+	w := &connWatchdog{
+		ctx:         ctx,
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+		started:     time.Now(),
+		stopped:     make(chan struct{}),
+	}
+	w.lastActive.Store(w.started.UnixNano())
+	return w
+}
+
+// watch registers conn with the watchdog, the returned connection must be used instead of conn
+func (w *connWatchdog) watch(conn net.Conn) net.Conn {
+	w.conns = append(w.conns, conn)
+	if w.idleTimeout <= 0 {
+		return conn
+	}
+	return &activityConn{Conn: conn, lastActive: &w.lastActive}
+}
+
+// start watching the connections, stop must be called when the relay is done
+func (w *connWatchdog) start() {
+	if w.idleTimeout <= 0 && w.maxLifetime <= 0 && w.ctx.Done() == nil {
+		return
+	}
+	go w.run()
+}
+
+func (w *connWatchdog) stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopped)
+	})
+}
+
+func (w *connWatchdog) run() {
+	// Without deadline, only the context is watched
+	var (
+		timer   *time.Timer
+		timeout <-chan time.Time
+	)
+	if d, ok := w.next(); ok {
+		timer = time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-w.stopped:
+			return
+		case <-w.ctx.Done():
+			w.closeConns()
+			return
+		case <-timeout:
+			d, _ := w.next()
+			if d <= 0 {
+				w.closeConns()
+				return
+			}
+			timer.Reset(d)
+		}
+	}
+}
+
+// next returns the duration until the earliest deadline, ok is false without deadline
+func (w *connWatchdog) next() (d time.Duration, ok bool) {
+	now := time.Now()
+	if w.maxLifetime > 0 {
+		d, ok = w.started.Add(w.maxLifetime).Sub(now), true
+	}
+	if w.idleTimeout > 0 {
+		idle := time.Unix(0, w.lastActive.Load()).Add(w.idleTimeout).Sub(now)
+		if !ok || idle < d {
+			d = idle
+		}
+		ok = true
+	}
+	return
+}
+
+func (w *connWatchdog) closeConns() {
+	for _, conn := range w.conns {
+		_ = conn.Close()
+	}
+}
+
+// activityConn records the time of its last read or write
+type activityConn struct {
+	net.Conn
+	lastActive *atomic.Int64
+}
+
+func (c *activityConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+func (c *activityConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+// NetConn returns the underlying connection
+func (c *activityConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,135 @@
+package mps
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// writeResponse writes the resp to the client.
+// The response body is streamed to the client as it arrives and flushed
+// through http.Flusher when its length is unknown, unless the Context asks
+// for a buffered response.
+// The returned error means that the response has been partially written to the client.
+func writeResponse(rw http.ResponseWriter, resp *http.Response, ctx *Context, bufferPool httputil.BufferPool) error {
+	if ctx.shouldBuffer(resp) {
+		return writeBufferedResponse(rw, resp, ctx, bufferPool)
+	}
+
+	copyHeaders(rw.Header(), resp.Header, ctx.KeepDestinationHeaders)
+	if resp.ContentLength < 0 {
+		// The length is unknown, let the http.ResponseWriter chunk the body
+		rw.Header().Del("Content-Length")
+	}
+
+	// Announce the trailers, they are sent after the body
+	announcedTrailers := len(resp.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, announcedTrailers)
+		for k := range resp.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		rw.Header().Set("Trailer", strings.Join(trailerKeys, ", "))
+	}
+
+	rw.WriteHeader(resp.StatusCode)
+
+	buf := bufferPool.Get()
+	_, err := copyResponseBody(rw, resp.Body, buf, flushImmediately(resp))
+	bufferPool.Put(buf)
+	if err != nil {
+		return err
+	}
+
+	// The trailers are only available when the body has been read to EOF
+	if len(resp.Trailer) == announcedTrailers {
+		copyHeaders(rw.Header(), resp.Trailer, true)
+	} else {
+		for k, vs := range resp.Trailer {
+			k = http.TrailerPrefix + k
+			for _, v := range vs {
+				rw.Header().Add(k, v)
+			}
+		}
+	}
+	return nil
+}
+
+// writeBufferedResponse reads the whole response body and reset the Content-Length
+// before it is written to the client.
+func writeBufferedResponse(rw http.ResponseWriter, resp *http.Response, ctx *Context, bufferPool httputil.BufferPool) error {
+	var (
+		// Body buffer
+		buffer = new(bytes.Buffer)
+		// Body size
+		bufferSize int64
+	)
+
+	buf := bufferPool.Get()
+	bufferSize, err := io.CopyBuffer(buffer, resp.Body, buf)
+	bufferPool.Put(buf)
+	if err != nil {
+		http.Error(rw, err.Error(), 502)
+		return nil
+	}
+
+	resp.ContentLength = bufferSize
+	resp.Header.Set("Content-Length", strconv.Itoa(int(bufferSize)))
+	copyHeaders(rw.Header(), resp.Header, ctx.KeepDestinationHeaders)
+	rw.WriteHeader(resp.StatusCode)
+	_, err = buffer.WriteTo(rw)
+	return err
+}
+
+// copyResponseBody copies from src to dst using the provided buffer.
+// If flush is true, dst is flushed after every write so that the client receives
+// the bytes as they arrive.
+func copyResponseBody(dst io.Writer, src io.Reader, buf []byte, flush bool) (written int64, err error) {
+	flusher, ok := dst.(http.Flusher)
+	if !ok {
+		flush = false
+	}
+	for {
+		nr, rerr := src.Read(buf)
+		if nr > 0 {
+			nw, werr := dst.Write(buf[:nr])
+			if nw > 0 {
+				written += int64(nw)
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nr != nw {
+				return written, io.ErrShortWrite
+			}
+			if flush {
+				flusher.Flush()
+			}
+		}
+		if rerr != nil {
+			if rerr != io.EOF {
+				err = rerr
+				// the client receives the part of the body read so far
+				if ok {
+					flusher.Flush()
+				}
+			}
+			return
+		}
+	}
+}
+
+// flushImmediately reports whether every write of the response body should be flushed.
+// Server-Sent Events and responses of unknown length (chunked, long-polling)
+// must reach the client without waiting for the buffer to fill up.
+func flushImmediately(resp *http.Response) bool {
+	if resp.ContentLength < 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
@@ -1,11 +1,9 @@
 package mps
 
 import (
-	"bytes"
-	"io"
+	"errors"
 	"net/http"
 	"net/http/httputil"
-	"strconv"
 
 	"github.com/telanflow/mps/pool"
 )
@@ -29,32 +27,22 @@ func (reverse *ReverseHandler) ServeHTTP(rw http.ResponseWriter, req *http.Reque
 	// Copying a Context preserves the Transport, Middleware
 	ctx := reverse.Ctx.WithRequest(req)
 	resp, err := ctx.Next(req)
+	if errors.Is(err, ConnectionResetErr) {
+		resetClient(rw)
+		return
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), 502)
 		return
 	}
 	defer resp.Body.Close()
 
-	var (
-		// Body buffer
-		buffer = new(bytes.Buffer)
-		// Body size
-		bufferSize int64
-	)
-
-	buf := reverse.buffer().Get()
-	bufferSize, err = io.CopyBuffer(buffer, resp.Body, buf)
-	reverse.buffer().Put(buf)
+	err = writeResponse(rw, resp, ctx, reverse.buffer())
 	if err != nil {
-		http.Error(rw, err.Error(), 502)
-		return
+		// The response has been partially written, abort the connection
+		// so that the client does not mistake it for a complete response.
+		panic(http.ErrAbortHandler)
 	}
-
-	resp.ContentLength = bufferSize
-	resp.Header.Set("Content-Length", strconv.Itoa(int(bufferSize)))
-	copyHeaders(rw.Header(), resp.Header, reverse.Ctx.KeepDestinationHeaders)
-	rw.WriteHeader(resp.StatusCode)
-	_, err = buffer.WriteTo(rw)
 }
 
 // Use registers an Middleware to proxy
@@ -2,11 +2,14 @@ package mps
 
 import (
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,3 +39,25 @@ func TestNewReverseHandler(t *testing.T) {
 	asserts.Equal(bodySize, contentLength, "Content-Length should be equal "+strconv.Itoa(bodySize))
 	asserts.Equal(int64(bodySize), resp.ContentLength)
 }
+
+func TestReverseHandler_ConnectionReset(t *testing.T) {
+	reverseHandler := NewReverseHandler()
+	reverseHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		return nil, ConnectionResetErr
+	})
+	proxySrv := httptest.NewServer(reverseHandler)
+	defer proxySrv.Close()
+
+	conn, err := net.Dial("tcp", proxySrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req, _ := http.NewRequest(http.MethodGet, proxySrv.URL+"/", nil)
+	_ = req.Write(conn)
+
+	// The connection is reset instead of answering 502
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+}
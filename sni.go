@@ -0,0 +1,118 @@
+package mps
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// TLS record type of the handshake messages
+	tlsRecordHandshake = 0x16
+	// TLS handshake type of the ClientHello message
+	tlsClientHello = 0x01
+	// TLS extension type of the server name indication
+	tlsExtensionServerName = 0x0000
+	// maximum length of a TLS record
+	tlsMaxRecordLen = 16384
+)
+
+// the ClientHello can't be parsed
+var errInvalidClientHello = errors.New("invalid TLS ClientHello")
+
+// isTLSHandshake reports whether the next bytes of r are a TLS handshake record
+func isTLSHandshake(r *bufio.Reader) bool {
+	b, err := r.Peek(1)
+	return err == nil && b[0] == tlsRecordHandshake
+}
+
+// peekSNI returns the server name indication of the TLS ClientHello at the start of r,
+// without consuming any byte. The size of r must be at least 5+tlsMaxRecordLen.
+// It returns an empty string if the client has not sent a server name.
+func peekSNI(r *bufio.Reader) (string, error) {
+	// record: type(1) version(2) length(2)
+	header, err := r.Peek(5)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != tlsRecordHandshake {
+		return "", errInvalidClientHello
+	}
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	if length > tlsMaxRecordLen {
+		return "", errInvalidClientHello
+	}
+	record, err := r.Peek(5 + length)
+	if err != nil {
+		return "", err
+	}
+	return parseSNI(record[5:])
+}
+
+// parseSNI returns the server name of the ClientHello handshake message
+func parseSNI(msg []byte) (string, error) {
+	// handshake: type(1) length(3) version(2) random(32)
+	if len(msg) < 38 || msg[0] != tlsClientHello {
+		return "", errInvalidClientHello
+	}
+	msg = msg[38:]
+
+	// session id, cipher suites, compression methods
+	for _, lengthSize := range []int{1, 2, 1} {
+		if len(msg) < lengthSize {
+			return "", errInvalidClientHello
+		}
+		n := int(msg[0])
+		if lengthSize == 2 {
+			n = int(binary.BigEndian.Uint16(msg))
+		}
+		if len(msg) < lengthSize+n {
+			return "", errInvalidClientHello
+		}
+		msg = msg[lengthSize+n:]
+	}
+
+	// extensions
+	if len(msg) < 2 {
+		// no extensions
+		return "", nil
+	}
+	n := int(binary.BigEndian.Uint16(msg))
+	msg = msg[2:]
+	if len(msg) < n {
+		// The ClientHello spans several records, only the first is available
+		n = len(msg)
+	}
+	msg = msg[:n]
+	for len(msg) >= 4 {
+		extType := binary.BigEndian.Uint16(msg)
+		extLen := int(binary.BigEndian.Uint16(msg[2:]))
+		if len(msg) < 4+extLen {
+			return "", errInvalidClientHello
+		}
+		ext := msg[4 : 4+extLen]
+		msg = msg[4+extLen:]
+		if extType != tlsExtensionServerName {
+			continue
+		}
+
+		// server name list: length(2) [type(1) length(2) name]
+		if len(ext) < 2 {
+			return "", errInvalidClientHello
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+			if len(ext) < 3+nameLen {
+				return "", errInvalidClientHello
+			}
+			if nameType == 0 {
+				// host_name
+				return string(ext[3 : 3+nameLen]), nil
+			}
+			ext = ext[3+nameLen:]
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,479 @@
+package mps
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/telanflow/mps/pool"
+)
+
+// SOCKS protocol version 5, RFC 1928
+const (
+	socks5Version = 0x05
+
+	// authentication methods
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	// username/password authentication version, RFC 1929
+	socks5PasswordVersion = 0x01
+
+	// commands
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	// address types
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	// replies
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5NotAllowed          = 0x02
+	socks5HostUnreachable     = 0x04
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+)
+
+var (
+	// socks5 handshake is invalid
+	Socks5HandshakeErr = errors.New("socks5: invalid handshake")
+	// socks5 authentication failed
+	Socks5AuthErr = errors.New("socks5: authentication failed")
+)
+
+// Socks5Handler The SOCKS5 proxy type.
+// CONNECT requests are converted into HTTP CONNECT requests,
+// so that they pass through the Context middlewares and the ConnectHandler
+// (TunnelHandler or MitmHandler) the same way as for an HTTP proxy client.
+type Socks5Handler struct {
+	Ctx        *Context
+	BufferPool httputil.BufferPool
+
+	// ConnectHandler handles the CONNECT command, use the TunnelHandler by default
+	ConnectHandler http.Handler
+
+	// Authenticate validates the username/password of the client (RFC 1929).
+	// When it is nil, clients can connect without authentication,
+	// and the credentials sent by the clients are forwarded to the middlewares
+	// in the Proxy-Authorization header.
+	Authenticate func(username, password string) bool
+
+	// HandshakeTimeout is the maximum duration of the SOCKS negotiation
+	HandshakeTimeout time.Duration
+}
+
+// NewSocks5Handler Create a SOCKS5 handler
+func NewSocks5Handler() *Socks5Handler {
+	return NewSocks5HandlerWithContext(NewContext())
+}
+
+// NewSocks5HandlerWithContext Create a SOCKS5 handler with Context
+func NewSocks5HandlerWithContext(ctx *Context) *Socks5Handler {
+	return &Socks5Handler{
+		Ctx:              ctx,
+		BufferPool:       pool.DefaultBuffer,
+		ConnectHandler:   NewTunnelHandlerWithContext(ctx),
+		HandshakeTimeout: 30 * time.Second,
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls Serve
+func (s *Socks5Handler) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts incoming SOCKS5 connections on the listener l
+func (s *Socks5Handler) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single SOCKS5 client connection
+func (s *Socks5Handler) ServeConn(conn net.Conn) {
+	if s.HandshakeTimeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+	}
+
+	username, password, err := s.negotiate(conn)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	head := make([]byte, 3)
+	if _, err = io.ReadFull(conn, head); err != nil || head[0] != socks5Version {
+		_ = conn.Close()
+		return
+	}
+	addr, err := readSocks5Addr(conn)
+	if err != nil {
+		if errors.Is(err, errSocks5AddrType) {
+			_ = writeSocks5Reply(conn, socks5AddrTypeUnsupported, nil)
+		}
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	req := s.newRequest(conn, addr, username, password)
+	switch head[1] {
+	case socks5CmdConnect:
+		s.connect(conn, req)
+	case socks5CmdUDPAssociate:
+		s.udpAssociate(conn, req)
+	default:
+		_ = writeSocks5Reply(conn, socks5CmdNotSupported, nil)
+		_ = conn.Close()
+	}
+}
+
+// negotiate the authentication method
+func (s *Socks5Handler) negotiate(conn net.Conn) (username, password string, err error) {
+	// VER NMETHODS METHODS
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if head[0] != socks5Version || head[1] == 0 {
+		err = Socks5HandshakeErr
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	method := byte(socks5AuthNoAcceptable)
+	if s.Authenticate == nil && bytes.IndexByte(methods, socks5AuthNone) != -1 {
+		method = socks5AuthNone
+	} else if bytes.IndexByte(methods, socks5AuthPassword) != -1 {
+		method = socks5AuthPassword
+	}
+	if _, err = conn.Write([]byte{socks5Version, method}); err != nil {
+		return
+	}
+
+	switch method {
+	case socks5AuthNone:
+		return
+	case socks5AuthPassword:
+		return s.authenticate(conn)
+	}
+	err = Socks5AuthErr
+	return
+}
+
+// authenticate the client with username/password, RFC 1929
+func (s *Socks5Handler) authenticate(conn net.Conn) (username, password string, err error) {
+	// VER ULEN UNAME PLEN PASSWD
+	head := make([]byte, 2)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if head[0] != socks5PasswordVersion {
+		err = Socks5HandshakeErr
+		return
+	}
+	uname := make([]byte, head[1])
+	if _, err = io.ReadFull(conn, uname); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, head[:1]); err != nil {
+		return
+	}
+	passwd := make([]byte, head[0])
+	if _, err = io.ReadFull(conn, passwd); err != nil {
+		return
+	}
+	username, password = string(uname), string(passwd)
+
+	if s.Authenticate != nil && !s.Authenticate(username, password) {
+		_, _ = conn.Write([]byte{socks5PasswordVersion, 0x01})
+		err = Socks5AuthErr
+		return
+	}
+	_, err = conn.Write([]byte{socks5PasswordVersion, 0x00})
+	return
+}
+
+// newRequest synthesizes a CONNECT request for the destination address
+func (s *Socks5Handler) newRequest(conn net.Conn, addr, username, password string) *http.Request {
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+	}
+	if username != "" || password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	return req.WithContext(s.context())
+}
+
+// connect hands the CONNECT request over to the ConnectHandler
+func (s *Socks5Handler) connect(conn net.Conn, req *http.Request) {
+	rw := newConnectResponseWriter(conn, socks5Reply)
+	s.connectHandler().ServeHTTP(rw, req)
+	if rw.hijacked {
+		// The connection is owned by the ConnectHandler
+		return
+	}
+	if !rw.replied() {
+		_ = writeSocks5Reply(conn, socks5GeneralFailure, nil)
+	}
+	_ = conn.Close()
+}
+
+// udpAssociate relays the UDP datagrams of the client until the control connection is closed
+func (s *Socks5Handler) udpAssociate(conn net.Conn, req *http.Request) {
+	defer conn.Close()
+
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5GeneralFailure, nil)
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(host)})
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5GeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	if err = writeSocks5Reply(conn, socks5Succeeded, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	go s.relayUDP(relay, conn, req)
+
+	// The association terminates when the TCP connection terminates
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+func (s *Socks5Handler) relayUDP(relay *net.UDPConn, conn net.Conn, req *http.Request) {
+	var (
+		clientIP   net.IP
+		clientAddr *net.UDPAddr
+		// middlewares decision and resolved address for each destination
+		allowed = make(map[string]bool)
+		targets = make(map[string]*net.UDPAddr)
+		// the destinations the client has sent to
+		peers = make(map[string]bool)
+	)
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if clientIP.Equal(from.IP) && (clientAddr == nil || clientAddr.Port == from.Port) {
+			clientAddr = from
+
+			// RSV FRAG ATYP DST.ADDR DST.PORT DATA
+			if n < 4 || buf[2] != 0 {
+				// fragmentation is not supported, drop the datagram
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			addr, err := readSocks5Addr(r)
+			if err != nil {
+				continue
+			}
+			payload := buf[n-r.Len() : n]
+
+			ok, exists := allowed[addr]
+			if !exists {
+				ok = s.allowUDP(req, addr)
+				allowed[addr] = ok
+			}
+			if !ok {
+				continue
+			}
+			target, exists := targets[addr]
+			if !exists {
+				target, err = net.ResolveUDPAddr("udp", addr)
+				if err != nil {
+					continue
+				}
+				targets[addr] = target
+			}
+			peers[target.String()] = true
+			_, _ = relay.WriteToUDP(payload, target)
+			continue
+		}
+
+		// Only the replies of the destinations are relayed back to the client
+		if clientAddr == nil || !peers[from.String()] {
+			continue
+		}
+		packet := bytes.NewBuffer(make([]byte, 0, n+22))
+		packet.Write([]byte{0, 0, 0})
+		writeSocks5Addr(packet, from)
+		packet.Write(buf[:n])
+		_, _ = relay.WriteToUDP(packet.Bytes(), clientAddr)
+	}
+}
+
+// allowUDP executes the middlewares for a UDP destination
+func (s *Socks5Handler) allowUDP(associate *http.Request, addr string) bool {
+	req := associate.Clone(associate.Context())
+	req.URL = &url.URL{Scheme: "udp", Host: addr}
+	req.Host = addr
+	req.RequestURI = addr
+
+	ctx := s.Ctx.WithRequest(req)
+	resp, err := ctx.Next(req)
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	return errors.Is(err, MethodNotSupportErr)
+}
+
+// get the ConnectHandler
+func (s *Socks5Handler) connectHandler() http.Handler {
+	if s.ConnectHandler != nil {
+		return s.ConnectHandler
+	}
+	return NewTunnelHandlerWithContext(s.Ctx)
+}
+
+// get a context.Context
+func (s *Socks5Handler) context() context.Context {
+	if s.Ctx.Context != nil {
+		return s.Ctx.Context
+	}
+	return context.Background()
+}
+
+// socks5Reply writes the SOCKS5 reply matching the HTTP status code of the ConnectHandler
+func socks5Reply(conn net.Conn, statusCode int) error {
+	code := byte(socks5GeneralFailure)
+	switch {
+	case statusCode >= 200 && statusCode <= 299:
+		code = socks5Succeeded
+	case statusCode == http.StatusProxyAuthRequired, statusCode == http.StatusForbidden, statusCode == http.StatusUnauthorized:
+		code = socks5NotAllowed
+	case statusCode == http.StatusBadGateway, statusCode == http.StatusGatewayTimeout:
+		code = socks5HostUnreachable
+	}
+	return writeSocks5Reply(conn, code, nil)
+}
+
+var errSocks5AddrType = errors.New("socks5: address type not supported")
+
+// readSocks5Addr reads ATYP DST.ADDR DST.PORT and returns "host:port"
+func readSocks5Addr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return "", err
+		}
+		domain := make([]byte, atyp[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errSocks5AddrType
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSocks5Addr writes ATYP BND.ADDR BND.PORT
+func writeSocks5Addr(w *bytes.Buffer, addr net.Addr) {
+	var (
+		ip   net.IP
+		port int
+	)
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		w.WriteByte(socks5AddrIPv4)
+		w.Write(ip4)
+	} else if ip16 := ip.To16(); ip16 != nil {
+		w.WriteByte(socks5AddrIPv6)
+		w.Write(ip16)
+	} else {
+		w.WriteByte(socks5AddrIPv4)
+		w.Write(net.IPv4zero.To4())
+	}
+	_ = binary.Write(w, binary.BigEndian, uint16(port))
+}
+
+// writeSocks5Reply writes VER REP RSV ATYP BND.ADDR BND.PORT
+func writeSocks5Reply(w io.Writer, code byte, bind net.Addr) error {
+	reply := bytes.NewBuffer([]byte{socks5Version, code, 0x00})
+	writeSocks5Addr(reply, bind)
+	_, err := w.Write(reply.Bytes())
+	return err
+}
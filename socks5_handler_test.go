@@ -0,0 +1,219 @@
+package mps
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// create a test SOCKS5 server
+func newTestSocks5Server(t *testing.T, handler *Socks5Handler) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = handler.Serve(l)
+	}()
+	return l
+}
+
+// socks5Handshake performs the SOCKS5 negotiation and sends the command request.
+// It returns the reply code and the bind address.
+func socks5Handshake(conn net.Conn, cmd byte, addr, username, password string) (byte, string, error) {
+	if username != "" {
+		_, _ = conn.Write([]byte{socks5Version, 1, socks5AuthPassword})
+	} else {
+		_, _ = conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return 0, "", err
+	}
+	if method[1] == socks5AuthPassword {
+		auth := []byte{socks5PasswordVersion, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		_, _ = conn.Write(auth)
+		status := make([]byte, 2)
+		if _, err := io.ReadFull(conn, status); err != nil {
+			return 0, "", err
+		}
+		if status[1] != 0 {
+			return socks5NotAllowed, "", nil
+		}
+	}
+
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	request := bytes.NewBuffer([]byte{socks5Version, cmd, 0x00, socks5AddrDomain, byte(len(host))})
+	request.WriteString(host)
+	_ = binary.Write(request, binary.BigEndian, uint16(portNum))
+	_, _ = conn.Write(request.Bytes())
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return 0, "", err
+	}
+	bind, err := readSocks5Addr(conn)
+	return reply[1], bind, err
+}
+
+func TestSocks5Handler_Connect(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	handler := NewSocks5Handler()
+	l := newTestSocks5Server(t, handler)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	code, _, err := socks5Handshake(conn, socks5CmdConnect, srv.Listener.Addr().String(), "", "")
+	asserts.NoError(err)
+	asserts.Equal(byte(socks5Succeeded), code)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	_ = req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("hello world", string(body))
+}
+
+func TestSocks5Handler_Middleware(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	handler := NewSocks5Handler()
+	handler.Ctx.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		user, pass, _ := (&http.Request{Header: http.Header{
+			"Authorization": req.Header["Proxy-Authorization"],
+		}}).BasicAuth()
+		if user != "foo" || pass != "bar" {
+			return &http.Response{
+				StatusCode: http.StatusProxyAuthRequired,
+				Header:     make(http.Header),
+				Body:       http.NoBody,
+			}, nil
+		}
+		return ctx.Next(req)
+	})
+	l := newTestSocks5Server(t, handler)
+	defer l.Close()
+
+	asserts := assert.New(t)
+	for _, c := range []struct {
+		username, password string
+		code               byte
+	}{
+		{"foo", "bar", socks5Succeeded},
+		{"foo", "baz", socks5NotAllowed},
+	} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _, err := socks5Handshake(conn, socks5CmdConnect, srv.Listener.Addr().String(), c.username, c.password)
+		asserts.NoError(err)
+		asserts.Equal(c.code, code)
+		_ = conn.Close()
+	}
+}
+
+func TestSocks5Handler_Authenticate(t *testing.T) {
+	handler := NewSocks5Handler()
+	handler.Authenticate = func(username, password string) bool {
+		return username == "foo" && password == "bar"
+	}
+	l := newTestSocks5Server(t, handler)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The client without credentials is rejected
+	_, _ = conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	method := make([]byte, 2)
+	_, err = io.ReadFull(conn, method)
+
+	asserts := assert.New(t)
+	asserts.NoError(err)
+	asserts.Equal(byte(socks5AuthNoAcceptable), method[1])
+}
+
+func TestSocks5Handler_UDPAssociate(t *testing.T) {
+	// UDP echo server
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	handler := NewSocks5Handler()
+	l := newTestSocks5Server(t, handler)
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	code, bind, err := socks5Handshake(conn, socks5CmdUDPAssociate, "0.0.0.0:0", "", "")
+	asserts.NoError(err)
+	asserts.Equal(byte(socks5Succeeded), code)
+
+	client, err := net.Dial("udp", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	packet := bytes.NewBuffer([]byte{0, 0, 0})
+	writeSocks5Addr(packet, echo.LocalAddr())
+	packet.WriteString("hello")
+	_, _ = client.Write(packet.Bytes())
+
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	asserts.NoError(err)
+
+	r := bytes.NewReader(buf[3:n])
+	from, err := readSocks5Addr(r)
+	asserts.NoError(err)
+	asserts.Equal(echo.LocalAddr().String(), from)
+	asserts.Equal("hello", string(buf[n-r.Len():n]))
+}
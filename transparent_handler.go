@@ -0,0 +1,316 @@
+package mps
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/telanflow/mps/pool"
+)
+
+// TransparentHandler The transparent proxy type.
+// It serves the connections redirected by iptables (REDIRECT or DNAT) from the
+// clients that are not proxy-aware. The original destination is recovered with
+// SO_ORIGINAL_DST, and the connection is dispatched with a synthesized request,
+// so that all the middlewares still apply:
+//   - TLS connections are converted into a CONNECT request to the server name (SNI)
+//     and handed over to the ConnectHandler (TunnelHandler or MitmHandler).
+//   - HTTP requests are converted into absolute-form requests to the Host
+//     and handed over to the HttpHandler.
+//
+// The server name and the Host are chosen by the client, they are only used by the
+// Filters, the MitmHandler certificates and the Host header. The upstream connections
+// are always made to the original destination, so that the clients can't reach
+// the hosts the redirection rules don't allow.
+type TransparentHandler struct {
+	Ctx        *Context
+	BufferPool httputil.BufferPool
+
+	// ConnectHandler handles the TLS connections, use the TunnelHandler by default
+	ConnectHandler http.Handler
+
+	// HttpHandler handles the HTTP requests, use the ForwardHandler by default
+	HttpHandler http.Handler
+
+	// OriginalDst returns the original destination "ip:port" of the connection.
+	// Use SO_ORIGINAL_DST by default, which is only supported on linux.
+	OriginalDst func(conn net.Conn) (string, error)
+
+	// PeekTimeout is the maximum duration to wait for the first bytes of the client
+	PeekTimeout time.Duration
+}
+
+// NewTransparentHandler Create a transparent handler
+func NewTransparentHandler() *TransparentHandler {
+	return NewTransparentHandlerWithContext(NewContext())
+}
+
+// NewTransparentHandlerWithContext Create a transparent handler with Context
+func NewTransparentHandlerWithContext(ctx *Context) *TransparentHandler {
+	return &TransparentHandler{
+		Ctx:            ctx,
+		BufferPool:     pool.DefaultBuffer,
+		ConnectHandler: NewTunnelHandlerWithContext(ctx),
+		HttpHandler:    NewForwardHandlerWithContext(ctx),
+		OriginalDst:    originalDst,
+		PeekTimeout:    30 * time.Second,
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls Serve
+func (t *TransparentHandler) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return t.Serve(l)
+}
+
+// Serve accepts incoming redirected connections on the listener l
+func (t *TransparentHandler) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go t.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single redirected connection
+func (t *TransparentHandler) ServeConn(conn net.Conn) {
+	dst, err := t.originalDst(conn)
+	if err != nil || dst == conn.LocalAddr().String() {
+		// The connection was not redirected, it would loop back to the proxy
+		_ = conn.Close()
+		return
+	}
+	dstHost, dstPort, err := net.SplitHostPort(dst)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	if t.PeekTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(t.PeekTimeout))
+	}
+	r := bufio.NewReaderSize(conn, 5+tlsMaxRecordLen)
+	if !isTLSHandshake(r) {
+		_ = conn.SetReadDeadline(time.Time{})
+		t.serveHTTP(&peekedConn{Conn: conn, r: r}, dst)
+		return
+	}
+
+	// Use the server name for the CONNECT request, so that the filters and
+	// MitmHandler certificate match the host the client wants to reach.
+	host := dstHost
+	if sni, err := peekSNI(r); err == nil && sni != "" {
+		host = sni
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	addr := net.JoinHostPort(host, dstPort)
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+	}
+	req = req.WithContext(context.WithValue(t.context(), originalDstKey{}, dst))
+
+	clientConn := &peekedConn{Conn: conn, r: r}
+	rw := newConnectResponseWriter(clientConn, transparentReply)
+	t.connectHandler().ServeHTTP(rw, req)
+	if !rw.hijacked {
+		_ = conn.Close()
+	}
+}
+
+// serveHTTP serves the HTTP requests of the connection
+func (t *TransparentHandler) serveHTTP(conn net.Conn, dst string) {
+	handler := t.httpHandler()
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// convert the origin-form request to an absolute-form request
+			req.URL.Scheme = "http"
+			req.URL.Host = req.Host
+			if req.URL.Host == "" {
+				req.URL.Host = dst
+			}
+			req = req.WithContext(context.WithValue(req.Context(), originalDstKey{}, dst))
+			handler.ServeHTTP(rw, req)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return t.context()
+		},
+	}
+	_ = srv.Serve(newSingleConnListener(conn))
+}
+
+// get the original destination of the connection
+func (t *TransparentHandler) originalDst(conn net.Conn) (string, error) {
+	if t.OriginalDst != nil {
+		return t.OriginalDst(conn)
+	}
+	return originalDst(conn)
+}
+
+// get the ConnectHandler
+func (t *TransparentHandler) connectHandler() http.Handler {
+	if t.ConnectHandler != nil {
+		return t.ConnectHandler
+	}
+	return NewTunnelHandlerWithContext(t.Ctx)
+}
+
+// get the HttpHandler
+func (t *TransparentHandler) httpHandler() http.Handler {
+	if t.HttpHandler != nil {
+		return t.HttpHandler
+	}
+	return NewForwardHandlerWithContext(t.Ctx)
+}
+
+// get a context.Context
+func (t *TransparentHandler) context() context.Context {
+	if t.Ctx.Context != nil {
+		return t.Ctx.Context
+	}
+	return context.Background()
+}
+
+// originalDstKey is the request context key of the original destination of a transparent connection
+type originalDstKey struct{}
+
+// originalDstOf returns the original destination the request must be connected to
+func originalDstOf(req *http.Request) (string, bool) {
+	dst, ok := req.Context().Value(originalDstKey{}).(string)
+	return dst, ok && dst != ""
+}
+
+// inheritOriginalDst carries the original destination of parent over to req,
+// e.g. to the requests decrypted from a transparent connection
+func inheritOriginalDst(req, parent *http.Request) *http.Request {
+	if dst, ok := originalDstOf(parent); ok {
+		return req.WithContext(context.WithValue(req.Context(), originalDstKey{}, dst))
+	}
+	return req
+}
+
+// maxOriginalDstTransports is the number of Transports dialing original destinations kept in the cache
+const maxOriginalDstTransports = 256
+
+// originalDstTransports caches the http.Transport derived for each original destination
+var originalDstTransports = newTransportCache(maxOriginalDstTransports)
+
+type originalDstTransportKey struct {
+	transport *http.Transport
+	proxy     string
+	dst       string
+}
+
+// originalDstTransport returns a http.Transport that connects to dst whatever the URL of the request,
+// through the upstream proxy u if any. The URL host is still used for the TLS server name.
+func originalDstTransport(tr *http.Transport, u *url.URL, dst string) *http.Transport {
+	key := originalDstTransportKey{transport: tr, dst: dst}
+	if u != nil {
+		key.proxy = u.String()
+	}
+	return originalDstTransports.get(key, tr, func() *http.Transport {
+		dial := tr.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		derived := tr.Clone()
+		derived.Proxy = nil
+		derived.DialTLSContext = nil
+		derived.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			switch {
+			case u == nil:
+				return dial(ctx, network, dst)
+			case isSocksProxy(u):
+				return dialSocks(ctx, dial, u, dst)
+			default:
+				conn, err := dial(ctx, "tcp", hostAndPort(u.Host))
+				if err != nil {
+					return nil, err
+				}
+				return connectCascadeProxy(ctx, conn, u, dst)
+			}
+		}
+		return derived
+	})
+}
+
+// transparentReply the client doesn't know it talks to a proxy,
+// the tunnel response is dropped and the connection is closed if the tunnel failed.
+func transparentReply(conn net.Conn, statusCode int) error {
+	if statusCode < 200 || statusCode > 299 {
+		return conn.Close()
+	}
+	return nil
+}
+
+// peekedConn is a net.Conn whose first bytes have been peeked with a bufio.Reader
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NetConn returns the underlying connection
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// singleConnListener is a net.Listener that accepts a single connection.
+// The next calls to Accept fail, which stops http.Server.Serve
+// without closing the accepted connection.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,190 @@
+package mps
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// create a test transparent server, every connection is redirected to dst
+func newTestTransparentServer(t *testing.T, handler *TransparentHandler, dst string) net.Listener {
+	handler.OriginalDst = func(conn net.Conn) (string, error) {
+		return dst, nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = handler.Serve(l)
+	}()
+	return l
+}
+
+func TestTransparentHandler_HTTP(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	var requestURL string
+	handler := NewTransparentHandler()
+	handler.Ctx.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		requestURL = req.URL.String()
+		return ctx.Next(req)
+	})
+	l := newTestTransparentServer(t, handler, srv.Listener.Addr().String())
+	defer l.Close()
+
+	// The client is not proxy-aware, it sends an origin-form request
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/path", nil)
+	_ = req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("hello world", string(body))
+	asserts.Equal(srv.URL+"/path", requestURL)
+}
+
+func TestTransparentHandler_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("hello tls"))
+	}))
+	defer srv.Close()
+
+	var connectHost string
+	handler := NewTransparentHandler()
+	handler.Ctx.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		connectHost = req.URL.Host
+		return ctx.Next(req)
+	})
+	l := newTestTransparentServer(t, handler, srv.Listener.Addr().String())
+	defer l.Close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "localhost",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, "https://localhost/", nil)
+	_ = req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	asserts := assert.New(t)
+	asserts.Equal("hello tls", string(body))
+	asserts.Equal("localhost:"+port, connectHost, "the CONNECT request should use the SNI")
+}
+
+func TestTransparentHandler_SpoofedSNI(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("original destination"))
+	}))
+	defer srv.Close()
+
+	for name, connectHandler := range map[string]func(ctx *Context) http.Handler{
+		"tunnel": func(ctx *Context) http.Handler { return NewTunnelHandlerWithContext(ctx) },
+		"mitm":   func(ctx *Context) http.Handler { return NewMitmHandlerWithContext(ctx) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var connectHost string
+			handler := NewTransparentHandler()
+			handler.Ctx.Transport.Proxy = nil
+			handler.Ctx.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+				connectHost = req.URL.Host
+				return ctx.Next(req)
+			})
+			handler.ConnectHandler = connectHandler(handler.Ctx)
+			l := newTestTransparentServer(t, handler, srv.Listener.Addr().String())
+			defer l.Close()
+
+			// The server name is chosen by the client, it must not change the destination
+			conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+				ServerName:         "spoofed.invalid",
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, "https://spoofed.invalid/", nil)
+			_ = req.Write(conn)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+			asserts := assert.New(t)
+			asserts.Equal(200, resp.StatusCode)
+			asserts.Equal("original destination", string(body))
+			asserts.Equal("spoofed.invalid:"+port, connectHost, "the filters should still see the SNI")
+		})
+	}
+}
+
+func TestTransparentHandler_SpoofedHost(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	var requestHost string
+	handler := NewTransparentHandler()
+	handler.Ctx.Transport.Proxy = nil
+	handler.Ctx.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		requestHost = req.URL.Host
+		return ctx.Next(req)
+	})
+	l := newTestTransparentServer(t, handler, srv.Listener.Addr().String())
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The Host is chosen by the client, it must not change the destination
+	req, _ := http.NewRequest(http.MethodGet, "http://spoofed.invalid:8080/path", nil)
+	_ = req.Write(conn)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(200, resp.StatusCode)
+	asserts.Equal("hello world", string(body))
+	asserts.Equal("spoofed.invalid:8080", requestHost)
+}
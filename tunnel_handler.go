@@ -1,7 +1,9 @@
 package mps
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -24,6 +26,14 @@ type TunnelHandler struct {
 	Ctx           *Context
 	BufferPool    httputil.BufferPool
 	ConnContainer pool.ConnContainer
+
+	// IdleTimeout closes the tunnel when no data has been sent in either direction for this duration.
+	// If zero, there is no timeout.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes the tunnel when it has been open for this duration.
+	// If zero, there is no limit.
+	MaxLifetime time.Duration
 }
 
 // NewTunnelHandler Create a tunnel handler
@@ -47,82 +57,148 @@ func (tunnel *TunnelHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request
 	// execution middleware
 	ctx := tunnel.Ctx.WithRequest(req)
 	resp, err := ctx.Next(req)
-	if err != nil && err != MethodNotSupportErr {
+	if errors.Is(err, ConnectionResetErr) {
+		resetClient(rw)
+		return
+	}
+	if !errors.Is(err, MethodNotSupportErr) {
+		// The middleware responded to the CONNECT request, e.g. authentication failed
 		if resp != nil {
+			defer resp.Body.Close()
 			copyHeaders(rw.Header(), resp.Header, tunnel.Ctx.KeepDestinationHeaders)
 			rw.WriteHeader(resp.StatusCode)
 			buf := tunnel.buffer().Get()
 			_, err = io.CopyBuffer(rw, resp.Body, buf)
 			tunnel.buffer().Put(buf)
+		} else if err != nil {
+			http.Error(rw, err.Error(), 502)
 		}
 		return
 	}
 
+	limits := tunnel.Ctx.BandwidthLimiter.limits(tunnel.context(), req)
+	if limits.exhausted() {
+		http.Error(rw, BandwidthQuotaExceededErr.Error(), http.StatusTooManyRequests)
+		return
+	}
+
 	// hijacker connection
 	proxyClient, err := hijacker(rw)
 	if err != nil {
 		http.Error(rw, err.Error(), 502)
 		return
 	}
+	proxyClient = tunnel.Ctx.trackConn(proxyClient, ConnTunnel)
+
+	tunnel.transmit(limits.conn(proxyClient), req, false)
+}
+
+// transmit connects the client to the target of the CONNECT request.
+// If established, the client was already told that the tunnel is ready,
+// e.g. by the MitmHandler passing through the connection.
+func (tunnel *TunnelHandler) transmit(proxyClient net.Conn, req *http.Request, established bool) {
+	defer proxyClient.Close()
+
+	connError := func() {
+		if established {
+			// too late for an error response
+			_ = proxyClient.Close()
+			return
+		}
+		ConnError(proxyClient)
+	}
 
 	var (
+		err            error
 		u              *url.URL = nil
 		targetConn     net.Conn = nil
 		targetAddr              = hostAndPort(req.URL.Host)
 		isCascadeProxy          = false
+		isSocks                 = false
 	)
 	if tunnel.Ctx.Transport != nil && tunnel.Ctx.Transport.Proxy != nil {
 		u, err = tunnel.Ctx.Transport.Proxy(req)
 		if err != nil {
-			ConnError(proxyClient)
+			connError()
 			return
 		}
-		if u != nil {
+	}
+	if dst, ok := originalDstOf(req); ok {
+		// A transparent connection goes to its original destination, whatever the server name
+		req = req.Clone(req.Context())
+		req.URL.Host = dst
+		req.Host = dst
+		targetAddr = dst
+	}
+	if u != nil {
+		if isSocksProxy(u) {
+			isSocks = true
+		} else {
 			// connect addr eg. "localhost:80"
 			targetAddr = hostAndPort(u.Host)
 			isCascadeProxy = true
 		}
 	}
 
-	// connect to targetAddr
-	targetConn, err = tunnel.connContainer().Get(targetAddr)
-	if err != nil {
-		targetConn, err = tunnel.ConnectDial("tcp", targetAddr)
+	if isSocks {
+		// connect to targetAddr through the SOCKS proxy
+		targetConn, err = dialSocks(tunnel.context(), tunnel.dial, u, targetAddr)
 		if err != nil {
-			ConnError(proxyClient)
+			connError()
 			return
 		}
+	} else {
+		// connect to targetAddr
+		targetConn, err = tunnel.connContainer().Get(targetAddr)
+		if err != nil {
+			targetConn, err = tunnel.ConnectDial("tcp", targetAddr)
+			if err != nil {
+				connError()
+				return
+			}
+		} else {
+			// clear the idle timeout of the pool
+			_ = targetConn.SetDeadline(time.Time{})
+		}
 	}
 
-	// If the ConnContainer is exists,
-	// When io.CopyBuffer is complete,
-	// put the idle connection into the ConnContainer so can reuse it next time
-	defer func() {
-		err := tunnel.connContainer().Put(targetConn)
+	// The tunneled connection carries the state of the client protocol (e.g. a TLS session),
+	// it can't be reused by another tunnel and is closed when the copy is complete.
+	defer targetConn.Close()
+	// A forced shutdown closes both sides of the tunnel
+	trackedOf(proxyClient).attach(targetConn)
+
+	upstream := targetConn
+	switch {
+	case isCascadeProxy && established:
+		// The client won't read the response of the cascade proxy
+		_ = req.Write(targetConn)
+		br := bufio.NewReader(targetConn)
+		resp, err := http.ReadResponse(br, req)
 		if err != nil {
-			// put conn fail, conn must be closed
-			_ = targetConn.Close()
+			return
 		}
-	}()
-
-	// The cascade proxy needs to forward the request
-	if isCascadeProxy {
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return
+		}
+		upstream = &peekedConn{Conn: targetConn, r: br}
+	case isCascadeProxy:
 		// The cascade proxy needs to send it as-is
 		_ = req.Write(targetConn)
-	} else {
+	case !established:
 		// Tell client that the tunnel is ready
 		_, _ = proxyClient.Write(HttpTunnelOk)
 	}
 
-	go func() {
-		buf := tunnel.buffer().Get()
-		_, _ = io.CopyBuffer(targetConn, proxyClient, buf)
-		tunnel.buffer().Put(buf)
-		_ = proxyClient.Close()
-	}()
-	buf := tunnel.buffer().Get()
-	_, _ = io.CopyBuffer(proxyClient, targetConn, buf)
-	tunnel.buffer().Put(buf)
+	// The tunnel is also closed when the Context is canceled
+	watchdog := newConnWatchdog(tunnel.context(), tunnel.IdleTimeout, tunnel.MaxLifetime)
+	proxyClient = watchdog.watch(proxyClient)
+	upstream = watchdog.watch(upstream)
+	watchdog.start()
+	defer watchdog.stop()
+
+	relayConns(proxyClient, upstream, tunnel.buffer())
 }
 
 // Use registers an Middleware to proxy
@@ -152,6 +228,11 @@ func (tunnel *TunnelHandler) ConnectDial(network, addr string) (net.Conn, error)
 	return net.DialTimeout(network, addr, 30*time.Second)
 }
 
+// dial implements dialFunc with ConnectDial
+func (tunnel *TunnelHandler) dial(_ context.Context, network, addr string) (net.Conn, error) {
+	return tunnel.ConnectDial(network, addr)
+}
+
 // Transport get http.Transport instance
 func (tunnel *TunnelHandler) Transport() *http.Transport {
 	return tunnel.Ctx.Transport
@@ -192,3 +273,29 @@ func ConnError(w net.Conn) {
 	_, _ = w.Write(HttpTunnelFail)
 	_ = w.Close()
 }
+
+// resetConn closes the connection with a TCP RST
+func resetConn(conn net.Conn) {
+	inner := conn
+	for {
+		if tcpConn, ok := inner.(*net.TCPConn); ok {
+			_ = tcpConn.SetLinger(0)
+			break
+		}
+		wrapper, ok := inner.(connWrapper)
+		if !ok {
+			break
+		}
+		inner = wrapper.NetConn()
+	}
+	_ = conn.Close()
+}
+
+// resetClient resets the client connection of rw, the HTTP/2 streams are aborted
+func resetClient(rw http.ResponseWriter) {
+	conn, err := hijacker(rw)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	resetConn(conn)
+}
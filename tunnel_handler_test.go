@@ -1,10 +1,16 @@
 package mps
 
 import (
+	"bufio"
+	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -31,3 +37,132 @@ func TestNewTunnelHandler(t *testing.T) {
 	asserts := assert.New(t)
 	asserts.Equal(resp.StatusCode, 200)
 }
+
+// create a tunnel server with handler, and open a tunnel to target
+func newTestTunnel(t *testing.T, handler *TunnelHandler, target string) (*httptest.Server, net.Conn, *bufio.Reader) {
+	tunnelSrv := httptest.NewServer(handler)
+	conn, br := connectTunnel(t, tunnelSrv.Listener.Addr().String(), target)
+	return tunnelSrv, conn, br
+}
+
+// expectClosed checks that the tunnel is closed within timeout
+func expectClosed(t *testing.T, br *bufio.Reader, conn net.Conn, timeout time.Duration) {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF, "the tunnel should be closed")
+}
+
+func TestTunnelHandler_IdleTimeout(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	tunnel := NewTunnelHandler()
+	tunnel.IdleTimeout = 200 * time.Millisecond
+	tunnelSrv, conn, br := newTestTunnel(t, tunnel, echoSrv.Addr().String())
+	defer tunnelSrv.Close()
+	defer conn.Close()
+
+	// The activity keeps the tunnel open beyond the idle timeout
+	asserts := assert.New(t)
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		reply, err := echo(conn, br, "ping")
+		asserts.NoError(err)
+		asserts.Equal("ping", reply)
+	}
+
+	expectClosed(t, br, conn, time.Second)
+}
+
+func TestTunnelHandler_MaxLifetime(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	tunnel := NewTunnelHandler()
+	tunnel.MaxLifetime = 200 * time.Millisecond
+	tunnelSrv, conn, br := newTestTunnel(t, tunnel, echoSrv.Addr().String())
+	defer tunnelSrv.Close()
+	defer conn.Close()
+
+	reply, err := echo(conn, br, "ping")
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", reply)
+
+	expectClosed(t, br, conn, time.Second)
+}
+
+func TestTunnelHandler_ContextCanceled(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel := NewTunnelHandler()
+	tunnel.Ctx.Context = ctx
+	tunnelSrv, conn, br := newTestTunnel(t, tunnel, echoSrv.Addr().String())
+	defer tunnelSrv.Close()
+	defer conn.Close()
+
+	reply, err := echo(conn, br, "ping")
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", reply)
+
+	cancel()
+	expectClosed(t, br, conn, time.Second)
+}
+
+func TestTunnelHandler_HalfClose(t *testing.T) {
+	// The server answers once the client has finished sending
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("received "), data...))
+	}()
+
+	tunnelSrv, conn, br := newTestTunnel(t, NewTunnelHandler(), l.Addr().String())
+	defer tunnelSrv.Close()
+	defer conn.Close()
+
+	_, _ = conn.Write([]byte("request"))
+	_ = conn.(*net.TCPConn).CloseWrite()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := io.ReadAll(br)
+	assert.NoError(t, err)
+	assert.Equal(t, "received request", string(reply))
+}
+
+func TestTunnelHandler_ConnectionReset(t *testing.T) {
+	echoSrv := newTestEchoServer(t)
+	defer echoSrv.Close()
+
+	tunnel := NewTunnelHandler()
+	tunnel.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		return nil, ConnectionResetErr
+	})
+	tunnelSrv := httptest.NewServer(tunnel)
+	defer tunnelSrv.Close()
+
+	conn, err := net.Dial("tcp", tunnelSrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	target := echoSrv.Addr().String()
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+target, nil)
+	req.Host = target
+	_ = req.Write(conn)
+
+	// The connection is reset instead of answering 502
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, syscall.ECONNRESET)
+}
@@ -0,0 +1,180 @@
+package mps
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	websocketDeflateExtension = "permessage-deflate"
+
+	// maximum LZ77 window of the flate package
+	websocketMaxWindowBits = 15
+	websocketMaxWindowSize = 1 << websocketMaxWindowBits
+)
+
+// The compressed payload of a message is terminated with an empty final stored block,
+// so that the flate.Reader returns io.EOF at the end of the message.
+// The 0x00 0x00 0xff 0xff tail is removed by the sender, RFC 7692 section 7.2.1.
+var websocketDeflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// websocketDeflateParams are the permessage-deflate parameters negotiated in the handshake, RFC 7692
+type websocketDeflateParams struct {
+	serverNoContextTakeover bool
+	clientNoContextTakeover bool
+	serverMaxWindowBits     int
+	clientMaxWindowBits     int
+}
+
+// parseWebsocketDeflate parses the permessage-deflate extension accepted by the server
+func parseWebsocketDeflate(header http.Header) (*websocketDeflateParams, bool) {
+	for _, ext := range parseWebsocketExtensions(header) {
+		if ext[0] != websocketDeflateExtension {
+			continue
+		}
+		params := &websocketDeflateParams{
+			serverMaxWindowBits: websocketMaxWindowBits,
+			clientMaxWindowBits: websocketMaxWindowBits,
+		}
+		for _, param := range ext[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			value = strings.Trim(value, `"`)
+			switch name {
+			case "server_no_context_takeover":
+				params.serverNoContextTakeover = true
+			case "client_no_context_takeover":
+				params.clientNoContextTakeover = true
+			case "server_max_window_bits":
+				if bits, err := strconv.Atoi(value); err == nil {
+					params.serverMaxWindowBits = bits
+				}
+			case "client_max_window_bits":
+				if bits, err := strconv.Atoi(value); err == nil {
+					params.clientMaxWindowBits = bits
+				}
+			}
+		}
+		return params, true
+	}
+	return nil, false
+}
+
+// parseWebsocketExtensions returns the extensions of the Sec-WebSocket-Extensions headers,
+// each of them is the extension name followed by its parameters.
+func parseWebsocketExtensions(header http.Header) [][]string {
+	var extensions [][]string
+	for _, v := range header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			var tokens []string
+			for _, token := range strings.Split(ext, ";") {
+				token = strings.TrimSpace(token)
+				if token != "" {
+					tokens = append(tokens, strings.ReplaceAll(token, " ", ""))
+				}
+			}
+			if len(tokens) > 0 {
+				extensions = append(extensions, tokens)
+			}
+		}
+	}
+	return extensions
+}
+
+// filterWebsocketExtensions only keeps the permessage-deflate offers of the client,
+// the other extensions can't be decoded by the hooks.
+func filterWebsocketExtensions(header http.Header) {
+	var offers []string
+	for _, ext := range parseWebsocketExtensions(header) {
+		if ext[0] == websocketDeflateExtension {
+			offers = append(offers, strings.Join(ext, "; "))
+		}
+	}
+	header.Del("Sec-WebSocket-Extensions")
+	if len(offers) > 0 {
+		header.Set("Sec-WebSocket-Extensions", strings.Join(offers, ", "))
+	}
+}
+
+// websocketInflater decompresses the messages sent in one direction
+type websocketInflater struct {
+	noContextTakeover bool
+	r                 io.ReadCloser
+	// history is the sliding window of the previous messages, used with context takeover
+	history []byte
+}
+
+// inflate decompresses the payload of a message, the output is limited to maxSize bytes
+func (i *websocketInflater) inflate(payload []byte, maxSize int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(websocketDeflateTail))
+	var dict []byte
+	if !i.noContextTakeover {
+		dict = i.history
+	}
+	if i.r == nil {
+		i.r = flate.NewReaderDict(src, dict)
+	} else if err := i.r.(flate.Resetter).Reset(src, dict); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(io.LimitReader(i.r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, WebsocketFrameTooLargeErr
+	}
+
+	if !i.noContextTakeover {
+		i.history = append(i.history, data...)
+		if len(i.history) > websocketMaxWindowSize {
+			i.history = append(i.history[:0], i.history[len(i.history)-websocketMaxWindowSize:]...)
+		}
+	}
+	return data, nil
+}
+
+// websocketDeflater compresses the messages sent in one direction
+type websocketDeflater struct {
+	noContextTakeover bool
+	w                 *flate.Writer
+	buf               bytes.Buffer
+}
+
+// newWebsocketDeflater returns nil if the receiver's window is smaller than the flate window,
+// the messages are then sent uncompressed.
+func newWebsocketDeflater(noContextTakeover bool, maxWindowBits int) *websocketDeflater {
+	if maxWindowBits < websocketMaxWindowBits {
+		return nil
+	}
+	return &websocketDeflater{noContextTakeover: noContextTakeover}
+}
+
+// deflate compresses the payload of a message
+func (d *websocketDeflater) deflate(data []byte) ([]byte, error) {
+	d.buf.Reset()
+	if d.w == nil {
+		w, err := flate.NewWriter(&d.buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		d.w = w
+	} else if d.noContextTakeover {
+		d.w.Reset(&d.buf)
+	}
+
+	if _, err := d.w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	// remove the 0x00 0x00 0xff 0xff tail of the sync flush
+	out := d.buf.Bytes()
+	out = out[:len(out)-4]
+	return append([]byte(nil), out...), nil
+}
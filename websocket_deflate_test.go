@@ -0,0 +1,65 @@
+package mps
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseWebsocketDeflate(t *testing.T) {
+	header := make(http.Header)
+	header.Set("Sec-WebSocket-Extensions", `permessage-deflate; server_no_context_takeover; client_max_window_bits="10"`)
+	params, ok := parseWebsocketDeflate(header)
+
+	asserts := assert.New(t)
+	asserts.True(ok)
+	asserts.True(params.serverNoContextTakeover)
+	asserts.False(params.clientNoContextTakeover)
+	asserts.Equal(15, params.serverMaxWindowBits)
+	asserts.Equal(10, params.clientMaxWindowBits)
+
+	header.Set("Sec-WebSocket-Extensions", "x-webkit-deflate-frame, permessage-deflate; client_max_window_bits")
+	filterWebsocketExtensions(header)
+	asserts.Equal("permessage-deflate; client_max_window_bits", header.Get("Sec-WebSocket-Extensions"))
+
+	header.Set("Sec-WebSocket-Extensions", "x-webkit-deflate-frame")
+	filterWebsocketExtensions(header)
+	asserts.Empty(header.Values("Sec-WebSocket-Extensions"))
+}
+
+func TestWebsocketDeflate_ContextTakeover(t *testing.T) {
+	asserts := assert.New(t)
+	message := []byte(strings.Repeat("context takeover ", 100))
+
+	for _, noContextTakeover := range []bool{false, true} {
+		deflater := newWebsocketDeflater(noContextTakeover, 15)
+		inflater := &websocketInflater{noContextTakeover: noContextTakeover}
+
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			payload, err := deflater.deflate(message)
+			asserts.NoError(err)
+			sizes = append(sizes, len(payload))
+
+			data, err := inflater.inflate(payload, 1<<20)
+			asserts.NoError(err)
+			asserts.Equal(message, data)
+		}
+		if noContextTakeover {
+			asserts.Equal(sizes[0], sizes[1])
+		} else {
+			// The next messages refer to the previous ones
+			asserts.Less(sizes[1], sizes[0])
+		}
+	}
+
+	// The receiver's window is too small for the flate package
+	asserts.Nil(newWebsocketDeflater(false, 10))
+
+	// The output is limited
+	payload, _ := newWebsocketDeflater(true, 15).deflate(message)
+	_, err := (&websocketInflater{}).inflate(payload, 100)
+	asserts.ErrorIs(err, WebsocketFrameTooLargeErr)
+}
@@ -0,0 +1,162 @@
+package mps
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The websocket opcodes, RFC 6455 section 5.2
+const (
+	websocketOpContinuation = 0x0
+	websocketOpText         = 0x1
+	websocketOpBinary       = 0x2
+	websocketOpClose        = 0x8
+	websocketOpPing         = 0x9
+	websocketOpPong         = 0xa
+)
+
+// The websocket message types, same as the opcodes of the data frames
+const (
+	WebsocketTextMessage   = websocketOpText
+	WebsocketBinaryMessage = websocketOpBinary
+)
+
+const (
+	websocketFinBit  = 0x80
+	websocketRsv1Bit = 0x40
+	websocketRsvBits = 0x70
+	websocketMaskBit = 0x80
+
+	// maximum payload length of the control frames
+	websocketMaxControlPayload = 125
+)
+
+var (
+	// WebsocketFrameTooLargeErr the frame or message exceeds the maximum size
+	WebsocketFrameTooLargeErr = errors.New("websocket: frame too large")
+	// websocket protocol violation
+	errWebsocketProtocol = errors.New("websocket: protocol error")
+)
+
+// websocketFrame is a websocket frame, the payload is unmasked
+type websocketFrame struct {
+	fin     bool
+	rsv     byte // RSV1, RSV2 and RSV3 bits
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+// isControl reports whether the frame is a control frame (close, ping or pong)
+func (f *websocketFrame) isControl() bool {
+	return f.opcode&0x8 != 0
+}
+
+// readWebsocketFrame reads a frame from r and unmasks its payload.
+// maxPayload limits the payload length, zero means no limit.
+func readWebsocketFrame(r io.Reader, maxPayload int64) (*websocketFrame, error) {
+	var head [14]byte
+	if _, err := io.ReadFull(r, head[:2]); err != nil {
+		return nil, err
+	}
+
+	f := &websocketFrame{
+		fin:    head[0]&websocketFinBit != 0,
+		rsv:    head[0] & websocketRsvBits,
+		opcode: head[0] & 0x0f,
+		masked: head[1]&websocketMaskBit != 0,
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(r, head[:2]); err != nil {
+			return nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(head[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, head[:8]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint64(head[:8])
+		if n > 1<<63-1 {
+			return nil, errWebsocketProtocol
+		}
+		length = int64(n)
+	}
+	if f.isControl() && (length > websocketMaxControlPayload || !f.fin) {
+		return nil, errWebsocketProtocol
+	}
+	if maxPayload > 0 && length > maxPayload {
+		return nil, WebsocketFrameTooLargeErr
+	}
+
+	var mask [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskWebsocketPayload(mask, f.payload)
+	}
+	return f, nil
+}
+
+// writeWebsocketFrame writes the frame to w.
+// The payload is masked with a random key if masked, the frames sent to the server must be masked.
+func writeWebsocketFrame(w io.Writer, f *websocketFrame, masked bool) error {
+	b0 := f.opcode | f.rsv
+	if f.fin {
+		b0 |= websocketFinBit
+	}
+
+	length := len(f.payload)
+	buf := make([]byte, 0, 14+length)
+	buf = append(buf, b0)
+
+	var b1 byte
+	if masked {
+		b1 = websocketMaskBit
+	}
+	switch {
+	case length <= 125:
+		buf = append(buf, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if masked {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		start := len(buf)
+		buf = append(buf, f.payload...)
+		maskWebsocketPayload(mask, buf[start:])
+	} else {
+		buf = append(buf, f.payload...)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// maskWebsocketPayload masks or unmasks the payload in place
+func maskWebsocketPayload(mask [4]byte, payload []byte) {
+	for i := range payload {
+		payload[i] ^= mask[i&3]
+	}
+}
@@ -0,0 +1,53 @@
+package mps
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebsocketFrame(t *testing.T) {
+	asserts := assert.New(t)
+	for _, length := range []int{0, 125, 126, 0xffff, 0x10000} {
+		for _, masked := range []bool{false, true} {
+			payload := bytes.Repeat([]byte{'a'}, length)
+			var buf bytes.Buffer
+			err := writeWebsocketFrame(&buf, &websocketFrame{
+				fin:     true,
+				opcode:  websocketOpBinary,
+				payload: payload,
+			}, masked)
+			asserts.NoError(err)
+
+			f, err := readWebsocketFrame(&buf, 0)
+			asserts.NoError(err)
+			asserts.True(f.fin)
+			asserts.Equal(byte(websocketOpBinary), f.opcode)
+			asserts.Equal(masked, f.masked)
+			asserts.Equal(payload, f.payload)
+			asserts.Equal(0, buf.Len())
+		}
+	}
+}
+
+func TestWebsocketFrame_Invalid(t *testing.T) {
+	asserts := assert.New(t)
+
+	// The control frames can't be fragmented
+	var buf bytes.Buffer
+	_ = writeWebsocketFrame(&buf, &websocketFrame{opcode: websocketOpPing}, false)
+	_, err := readWebsocketFrame(&buf, 0)
+	asserts.ErrorIs(err, errWebsocketProtocol)
+
+	// The payload of the control frames is at most 125 bytes
+	buf.Reset()
+	_ = writeWebsocketFrame(&buf, &websocketFrame{fin: true, opcode: websocketOpPing, payload: make([]byte, 126)}, false)
+	_, err = readWebsocketFrame(&buf, 0)
+	asserts.ErrorIs(err, errWebsocketProtocol)
+
+	buf.Reset()
+	_ = writeWebsocketFrame(&buf, &websocketFrame{fin: true, opcode: websocketOpText, payload: make([]byte, 1024)}, false)
+	_, err = readWebsocketFrame(&buf, 1000)
+	asserts.ErrorIs(err, WebsocketFrameTooLargeErr)
+}
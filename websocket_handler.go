@@ -3,6 +3,8 @@ package mps
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -18,6 +20,23 @@ import (
 type WebsocketHandler struct {
 	Ctx        *Context
 	BufferPool httputil.BufferPool
+
+	// Hooks inspect, modify, drop or inject the messages.
+	// Without hooks, the frames are relayed as raw bytes.
+	Hooks []WebsocketHook
+
+	// MaxMessageSize is the maximum size of a message passed to the hooks,
+	// the connection is closed if a message is larger.
+	// If zero, DefaultWebsocketMaxMessageSize is used.
+	MaxMessageSize int64
+
+	// IdleTimeout closes the connection when no data has been sent in either direction for this duration.
+	// If zero, there is no timeout.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes the connection when it has been open for this duration.
+	// If zero, there is no limit.
+	MaxLifetime time.Duration
 }
 
 // NewWebsocketHandler Create a websocket handler
@@ -43,34 +62,74 @@ func (ws *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	// execution middleware
+	ctx := ws.Ctx.WithRequest(req)
+	resp, err := ctx.Next(req)
+	if errors.Is(err, ConnectionResetErr) {
+		resetClient(rw)
+		return
+	}
+	if !errors.Is(err, RequestWebsocketUpgradeErr) {
+		// The middleware responded to the upgrade request, e.g. authentication failed
+		if resp != nil {
+			defer resp.Body.Close()
+			copyHeaders(rw.Header(), resp.Header, ws.Ctx.KeepDestinationHeaders)
+			rw.WriteHeader(resp.StatusCode)
+			buf := ws.buffer().Get()
+			_, err = io.CopyBuffer(rw, resp.Body, buf)
+			ws.buffer().Put(buf)
+		} else if err != nil {
+			http.Error(rw, err.Error(), 502)
+		}
+		return
+	}
+	// The middleware may have rewritten the request, e.g. for a reverse proxy
+	if ctx.Request != nil {
+		req = ctx.Request
+	}
+
+	limits := ws.Ctx.BandwidthLimiter.limits(ws.context(), req)
+	if limits.exhausted() {
+		http.Error(rw, BandwidthQuotaExceededErr.Error(), http.StatusTooManyRequests)
+		return
+	}
+
 	// hijacker connection
 	clientConn, err := hijacker(rw)
 	if err != nil {
 		http.Error(rw, err.Error(), 502)
 		return
 	}
+	clientConn = ws.Ctx.trackConn(clientConn, ConnWebsocket)
+	ws.serveConn(limits.conn(clientConn), req)
+}
 
-	var (
-		u          *url.URL
-		targetAddr = hostAndPort(req.URL.Host)
-	)
-	if ws.Ctx.Transport != nil && ws.Ctx.Transport.Proxy != nil {
-		u, err = ws.Ctx.Transport.Proxy(req)
-		if err != nil {
-			ConnError(clientConn)
-			return
-		}
-		if u != nil {
-			// connect addr eg. "localhost:443"
-			targetAddr = hostAndPort(u.Host)
-		}
-	}
+// serveConn performs the handshake of the upgrade request with the websocket server,
+// and relays the frames between the client and the server. The middlewares have already
+// handled req, clientConn is closed when done.
+func (ws *WebsocketHandler) serveConn(clientConn net.Conn, req *http.Request) {
+	defer clientConn.Close()
 
-	targetConn, err := ws.ConnectDial("tcp", targetAddr)
+	targetConn, err := ws.connectTarget(req)
 	if err != nil {
+		ConnError(clientConn)
 		return
 	}
 	defer targetConn.Close()
+	trackedOf(clientConn).attach(targetConn)
+
+	// The proxy headers are meant for this proxy, not for the websocket server.
+	// Connection is kept, it carries the upgrade.
+	if !ws.Ctx.KeepProxyHeaders {
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authenticate")
+		req.Header.Del("Proxy-Authorization")
+	}
+
+	// The hooks can only decode the permessage-deflate extension
+	if len(ws.Hooks) > 0 {
+		filterWebsocketExtensions(req.Header)
+	}
 
 	// Perform handshake
 	// write handshake request to target
@@ -88,20 +147,135 @@ func (ws *WebsocketHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 
 	// Proxy handshake back to client
 	err = resp.Write(clientConn)
-	if err != nil {
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
 		return
 	}
 
-	// Proxy ws connection
-	go func() {
-		buf := ws.buffer().Get()
-		_, _ = io.CopyBuffer(targetConn, clientConn, buf)
-		ws.buffer().Put(buf)
-		_ = clientConn.Close()
-	}()
-	buf := ws.buffer().Get()
-	_, _ = io.CopyBuffer(clientConn, targetConn, buf)
-	ws.buffer().Put(buf)
+	ws.relay(clientConn, &peekedConn{Conn: targetConn, r: targetReader}, req, resp)
+}
+
+// relay the frames between the client and the websocket server
+func (ws *WebsocketHandler) relay(clientConn, targetConn net.Conn, req *http.Request, resp *http.Response) {
+	// The connection is also closed when the Context is canceled
+	watchdog := newConnWatchdog(ws.context(), ws.IdleTimeout, ws.MaxLifetime)
+	clientConn = watchdog.watch(clientConn)
+	targetConn = watchdog.watch(targetConn)
+	watchdog.start()
+	defer watchdog.stop()
+
+	if len(ws.Hooks) > 0 {
+		conn := newWebsocketConn(req, clientConn, targetConn)
+		conn.deflate, _ = parseWebsocketDeflate(resp.Header)
+		go func() {
+			_ = ws.relayMessages(conn, WebsocketClientToServer)
+			_ = conn.Close()
+		}()
+		_ = ws.relayMessages(conn, WebsocketServerToClient)
+		_ = conn.Close()
+		return
+	}
+
+	relayConns(clientConn, targetConn, ws.buffer())
+}
+
+// connectTarget connects to the websocket server of the request,
+// through the upstream proxy if any. The connection is secured for the wss/https requests.
+func (ws *WebsocketHandler) connectTarget(req *http.Request) (net.Conn, error) {
+	var (
+		err        error
+		u          *url.URL
+		targetConn net.Conn
+		host       = req.URL.Host
+		secure     = isSecureWebsocket(req)
+		isCascade  = false
+	)
+	if host == "" {
+		host = req.Host
+	}
+	targetAddr := hostAndPort(host)
+	if secure && !hasPort.MatchString(host) {
+		targetAddr = host + ":443"
+	}
+	if dst, ok := originalDstOf(req); ok {
+		// A transparent connection goes to its original destination, whatever the Host
+		targetAddr = dst
+	}
+
+	if ws.Ctx.Transport != nil && ws.Ctx.Transport.Proxy != nil {
+		u, err = ws.Ctx.Transport.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case u != nil && isSocksProxy(u):
+		// connect to targetAddr through the SOCKS proxy
+		targetConn, err = dialSocks(ws.context(), ws.dial, u, targetAddr)
+	case u != nil:
+		// connect addr eg. "localhost:443"
+		targetConn, err = ws.ConnectDial("tcp", hostAndPort(u.Host))
+		isCascade = true
+	default:
+		targetConn, err = ws.ConnectDial("tcp", targetAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !secure {
+		// The plain requests are sent as-is to the cascade proxy
+		return targetConn, nil
+	}
+
+	// The cascade proxy opens a tunnel to the secure websocket server
+	if isCascade {
+		if targetConn, err = connectCascadeProxy(ws.context(), targetConn, u, targetAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	var config *tls.Config
+	if ws.Ctx.Transport != nil {
+		config = ws.Ctx.Transport.TLSClientConfig
+	}
+	config = cloneTLSConfig(config)
+	if config.ServerName == "" {
+		config.ServerName = stripPort(host)
+	}
+	// The websocket handshake is HTTP/1.1 only
+	config.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(targetConn, config)
+	if err = tlsConn.HandshakeContext(ws.context()); err != nil {
+		_ = targetConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Use registers an Middleware to proxy
+func (ws *WebsocketHandler) Use(middleware ...Middleware) {
+	ws.Ctx.Use(middleware...)
+}
+
+// UseFunc registers an MiddlewareFunc to proxy
+func (ws *WebsocketHandler) UseFunc(fus ...MiddlewareFunc) {
+	ws.Ctx.UseFunc(fus...)
+}
+
+// UseHook registers WebsocketHooks
+func (ws *WebsocketHandler) UseHook(hooks ...WebsocketHook) {
+	ws.Hooks = append(ws.Hooks, hooks...)
+}
+
+// UseHookFunc registers WebsocketHookFuncs
+func (ws *WebsocketHandler) UseHookFunc(fns ...WebsocketHookFunc) {
+	for _, fn := range fns {
+		ws.Hooks = append(ws.Hooks, fn)
+	}
+}
+
+// OnRequest filter requests through Filters
+func (ws *WebsocketHandler) OnRequest(filters ...Filter) *ReqFilterGroup {
+	return &ReqFilterGroup{ctx: ws.Ctx, filters: filters}
 }
 
 func (ws *WebsocketHandler) ConnectDial(network, addr string) (net.Conn, error) {
@@ -111,6 +285,11 @@ func (ws *WebsocketHandler) ConnectDial(network, addr string) (net.Conn, error)
 	return net.DialTimeout(network, addr, 30*time.Second)
 }
 
+// dial implements dialFunc with ConnectDial
+func (ws *WebsocketHandler) dial(_ context.Context, network, addr string) (net.Conn, error) {
+	return ws.ConnectDial(network, addr)
+}
+
 // Transport get http.Transport instance
 func (ws *WebsocketHandler) Transport() *http.Transport {
 	return ws.Ctx.Transport
@@ -132,6 +311,17 @@ func (ws *WebsocketHandler) buffer() httputil.BufferPool {
 	return pool.DefaultBuffer
 }
 
+// isSecureWebsocket reports whether the websocket server uses TLS
+func isSecureWebsocket(req *http.Request) bool {
+	switch req.URL.Scheme {
+	case "https", "wss":
+		return true
+	case "":
+		return req.TLS != nil
+	}
+	return false
+}
+
 // isWebSocketRequest to upgrade to a Websocket request
 func isWebSocketRequest(req *http.Request) bool {
 	return headerContains(req.Header, "Connection", "upgrade") &&
@@ -1,37 +1,48 @@
 package mps
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
 )
 
 var upgrader = websocket.Upgrader{}
 
-// create a test websocket server
-func newTestWebsocketServer() *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		c, err := upgrader.Upgrade(rw, req, nil)
+// echo the websocket messages
+var websocketEchoHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	c, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	for {
+		mt, message, err := c.ReadMessage()
 		if err != nil {
-			return
+			break
 		}
-		defer c.Close()
-		for {
-			mt, message, err := c.ReadMessage()
-			if err != nil {
-				break
-			}
-			err = c.WriteMessage(mt, message)
-			if err != nil {
-				break
-			}
+		err = c.WriteMessage(mt, message)
+		if err != nil {
+			break
 		}
-	}))
+	}
+})
+
+// create a test websocket server
+func newTestWebsocketServer() *httptest.Server {
+	return httptest.NewServer(websocketEchoHandler)
 }
 
 func TestNewWebsocketHandler(t *testing.T) {
@@ -78,3 +89,294 @@ func TestNewWebsocketHandler(t *testing.T) {
 		}
 	}
 }
+
+// send a websocket handshake for target through the proxy at proxyAddr,
+// the request is in absolute-form like a proxy-aware client sends it.
+func websocketHandshake(t *testing.T, proxyAddr, target string, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err = req.WriteProxy(conn); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// send a text message and read the echoed message
+func websocketEcho(t *testing.T, conn net.Conn, br *bufio.Reader, message string) string {
+	// FIN + text frame, masked payload
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(message))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(message); i++ {
+		frame = append(frame, message[i]^mask[i%4])
+	}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(br, head); err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return string(payload)
+}
+
+func TestHttpProxy_Websocket(t *testing.T) {
+	var originHeader http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		originHeader = req.Header.Clone()
+		websocketEchoHandler(rw, req)
+	}))
+	defer srv.Close()
+
+	var requestURL string
+	proxy := NewHttpProxy()
+	proxy.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		requestURL = req.URL.String()
+		return ctx.Next(req)
+	})
+	proxySrv := httptest.NewServer(proxy)
+	defer proxySrv.Close()
+
+	conn, br, resp := websocketHandshake(t, proxySrv.Listener.Addr().String(), srv.URL+"/echo", http.Header{
+		"Proxy-Authorization": []string{"Basic Zm9vOmJhcg=="},
+		"Proxy-Connection":    []string{"keep-alive"},
+	})
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	asserts.Equal(srv.URL+"/echo", requestURL, "the middlewares should see the upgrade request")
+	asserts.Equal("hello", websocketEcho(t, conn, br, "hello"))
+	asserts.Empty(originHeader.Get("Proxy-Authorization"), "the proxy credentials must not reach the origin")
+	asserts.Empty(originHeader.Get("Proxy-Connection"))
+}
+
+func TestWebsocketHandler_Middleware(t *testing.T) {
+	srv := newTestWebsocketServer()
+	defer srv.Close()
+
+	wsHandler := NewWebsocketHandler()
+	wsHandler.UseFunc(func(req *http.Request, ctx *Context) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusProxyAuthRequired,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+		}, nil
+	})
+	proxySrv := httptest.NewServer(wsHandler)
+	defer proxySrv.Close()
+
+	conn, _, resp := websocketHandshake(t, proxySrv.Listener.Addr().String(), srv.URL, nil)
+	defer conn.Close()
+	assert.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+}
+
+func TestWebsocketHandler_Secure(t *testing.T) {
+	srv := httptest.NewTLSServer(websocketEchoHandler)
+	defer srv.Close()
+
+	wsHandler := NewWebsocketHandler()
+	wsHandler.Transport().TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxySrv := httptest.NewServer(wsHandler)
+	defer proxySrv.Close()
+
+	// Convert https://127.0.0.1 to wss://127.0.0.1
+	endPoint := "wss" + strings.TrimPrefix(srv.URL, "https")
+	conn, br, resp := websocketHandshake(t, proxySrv.Listener.Addr().String(), endPoint, nil)
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	asserts.Equal("hello wss", websocketEcho(t, conn, br, "hello wss"))
+}
+
+func TestWebsocketHandler_Hooks(t *testing.T) {
+	srv := newTestWebsocketServer()
+	defer srv.Close()
+
+	var (
+		mu    sync.Mutex
+		sizes []int
+	)
+	wsHandler := NewWebsocketHandler()
+	wsHandler.Transport().Proxy = func(request *http.Request) (*url.URL, error) {
+		return url.Parse(srv.URL)
+	}
+	wsHandler.UseHookFunc(func(msg *WebsocketMessage, conn *WebsocketConn) (*WebsocketMessage, error) {
+		mu.Lock()
+		if msg.Direction == WebsocketClientToServer {
+			sizes = append(sizes, len(msg.Data))
+		}
+		mu.Unlock()
+
+		switch {
+		case msg.Direction == WebsocketServerToClient:
+			return msg, nil
+		case string(msg.Data) == "drop":
+			return nil, nil
+		case string(msg.Data) == "inject":
+			err := conn.Inject(WebsocketServerToClient, WebsocketTextMessage, []byte("injected"))
+			return msg, err
+		}
+		msg.Data = bytes.ToUpper(msg.Data)
+		return msg, nil
+	})
+	proxySrv := httptest.NewServer(wsHandler)
+	defer proxySrv.Close()
+
+	// A small write buffer fragments the large messages
+	dialer := websocket.Dialer{
+		WriteBufferSize: 1024,
+	}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(proxySrv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	asserts := assert.New(t)
+	readMessage := func() string {
+		_, p, err := client.ReadMessage()
+		asserts.NoError(err)
+		return string(p)
+	}
+
+	// modify
+	asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte("hello")))
+	asserts.Equal("HELLO", readMessage())
+
+	// drop, the next message is echoed
+	asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte("drop")))
+	asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte("next")))
+	asserts.Equal("NEXT", readMessage())
+
+	// inject
+	asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte("inject")))
+	asserts.Equal("injected", readMessage())
+	asserts.Equal("inject", readMessage())
+
+	// The fragments are reassembled into one message
+	large := strings.Repeat("a", 100*1024)
+	asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte(large)))
+	asserts.Equal(strings.ToUpper(large), readMessage())
+
+	// The control frames are relayed
+	pong := make(chan string, 1)
+	client.SetPongHandler(func(appData string) error {
+		pong <- appData
+		return nil
+	})
+	asserts.NoError(client.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)))
+	asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte("after ping")))
+	asserts.Equal("AFTER PING", readMessage())
+	asserts.Equal("ping", <-pong)
+
+	mu.Lock()
+	defer mu.Unlock()
+	asserts.Equal([]int{5, 4, 4, 6, len(large), 10}, sizes)
+}
+
+func TestWebsocketHandler_Deflate(t *testing.T) {
+	compressUpgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c, err := compressUpgrader.Upgrade(rw, req, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, message, err := c.ReadMessage()
+			if err != nil {
+				break
+			}
+			if err = c.WriteMessage(mt, append([]byte("echo "), message...)); err != nil {
+				break
+			}
+		}
+	}))
+	defer srv.Close()
+
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+	wsHandler := NewWebsocketHandler()
+	wsHandler.Transport().Proxy = func(request *http.Request) (*url.URL, error) {
+		return url.Parse(srv.URL)
+	}
+	wsHandler.UseHookFunc(func(msg *WebsocketMessage, conn *WebsocketConn) (*WebsocketMessage, error) {
+		mu.Lock()
+		messages = append(messages, string(msg.Data))
+		mu.Unlock()
+		if msg.Direction == WebsocketClientToServer {
+			msg.Data = bytes.ToUpper(msg.Data)
+		}
+		return msg, nil
+	})
+	proxySrv := httptest.NewServer(wsHandler)
+	defer proxySrv.Close()
+
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+	}
+	client, resp, err := dialer.Dial("ws"+strings.TrimPrefix(proxySrv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	asserts := assert.New(t)
+	asserts.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	for _, text := range []string{"hello", strings.Repeat("compressible ", 1000), "world"} {
+		asserts.NoError(client.WriteMessage(websocket.TextMessage, []byte(text)))
+		_, p, err := client.ReadMessage()
+		asserts.NoError(err)
+		asserts.Equal("echo "+strings.ToUpper(text), string(p))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	asserts.Equal("hello", messages[0], "the hooks should see the decompressed messages")
+	asserts.Equal("echo HELLO", messages[1])
+}
+
+func TestWebsocketHandler_IdleTimeout(t *testing.T) {
+	srv := newTestWebsocketServer()
+	defer srv.Close()
+
+	ws := NewWebsocketHandler()
+	ws.IdleTimeout = 200 * time.Millisecond
+	proxySrv := httptest.NewServer(ws)
+	defer proxySrv.Close()
+
+	conn, br, resp := websocketHandshake(t, proxySrv.Listener.Addr().String(), srv.URL+"/echo", nil)
+	defer conn.Close()
+
+	asserts := assert.New(t)
+	asserts.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	asserts.Equal("hello", websocketEcho(t, conn, br, "hello"))
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := br.ReadByte()
+	asserts.ErrorIs(err, io.EOF, "the idle connection should be closed")
+}
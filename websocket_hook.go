@@ -0,0 +1,224 @@
+package mps
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// WebsocketDirection is the direction of a websocket message
+type WebsocketDirection int
+
+const (
+	// WebsocketClientToServer the message is sent by the client
+	WebsocketClientToServer WebsocketDirection = iota
+	// WebsocketServerToClient the message is sent by the server
+	WebsocketServerToClient
+)
+
+// DefaultWebsocketMaxMessageSize is the default maximum size of the messages passed to the hooks
+const DefaultWebsocketMaxMessageSize = 32 << 20
+
+// WebsocketMessage is a text or binary message, reassembled from its fragments
+type WebsocketMessage struct {
+	// Direction of the message
+	Direction WebsocketDirection
+
+	// Type is WebsocketTextMessage or WebsocketBinaryMessage
+	Type int
+
+	// Data is the payload of the message
+	Data []byte
+}
+
+// WebsocketHook will "tamper" with the websocket messages relayed by the WebsocketHandler
+type WebsocketHook interface {
+	// HandleMessage is called for each text or binary message, the hooks are called in order.
+	// It returns the message to forward, which may be modified or replaced.
+	// Returning nil drops the message, and the next hooks are not called.
+	// Returning an error closes the websocket connection.
+	HandleMessage(msg *WebsocketMessage, conn *WebsocketConn) (*WebsocketMessage, error)
+}
+
+// WebsocketHookFunc A wrapper that would convert a function to a WebsocketHook interface type
+type WebsocketHookFunc func(msg *WebsocketMessage, conn *WebsocketConn) (*WebsocketMessage, error)
+
+// HandleMessage WebsocketHook.HandleMessage(msg, conn) <=> WebsocketHookFunc(msg, conn)
+func (f WebsocketHookFunc) HandleMessage(msg *WebsocketMessage, conn *WebsocketConn) (*WebsocketMessage, error) {
+	return f(msg, conn)
+}
+
+// WebsocketConn is a websocket connection relayed by the WebsocketHandler
+type WebsocketConn struct {
+	// Request is the upgrade request
+	Request *http.Request
+
+	clientConn net.Conn
+	targetConn net.Conn
+	// deflate is the negotiated permessage-deflate extension, nil if the messages are not compressed
+	deflate   *websocketDeflateParams
+	clientMu  sync.Mutex
+	targetMu  sync.Mutex
+	closeOnce sync.Once
+}
+
+func newWebsocketConn(req *http.Request, clientConn, targetConn net.Conn) *WebsocketConn {
+	return &WebsocketConn{
+		Request:    req,
+		clientConn: clientConn,
+		targetConn: targetConn,
+	}
+}
+
+// Inject sends a message in the direction, e.g. WebsocketServerToClient sends it to the client.
+// It is safe to call Inject concurrently with the relay.
+func (c *WebsocketConn) Inject(direction WebsocketDirection, messageType int, data []byte) error {
+	if messageType != WebsocketTextMessage && messageType != WebsocketBinaryMessage {
+		return errors.New("websocket: invalid message type")
+	}
+	return c.writeFrame(direction, &websocketFrame{
+		fin:     true,
+		opcode:  byte(messageType),
+		payload: data,
+	})
+}
+
+// Close closes both sides of the websocket connection
+func (c *WebsocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.clientConn.Close()
+		if err2 := c.targetConn.Close(); err == nil {
+			err = err2
+		}
+	})
+	return err
+}
+
+// writeFrame writes the frame in the direction,
+// the frames sent to the server are masked.
+func (c *WebsocketConn) writeFrame(direction WebsocketDirection, f *websocketFrame) error {
+	if direction == WebsocketClientToServer {
+		c.targetMu.Lock()
+		defer c.targetMu.Unlock()
+		return writeWebsocketFrame(c.targetConn, f, true)
+	}
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+	return writeWebsocketFrame(c.clientConn, f, false)
+}
+
+// relayMessages reads the frames sent in the direction,
+// passes the messages through the hooks and forwards them.
+func (ws *WebsocketHandler) relayMessages(conn *WebsocketConn, direction WebsocketDirection) error {
+	src := conn.clientConn
+	if direction == WebsocketServerToClient {
+		src = conn.targetConn
+	}
+	r := bufio.NewReader(src)
+
+	maxSize := ws.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = DefaultWebsocketMaxMessageSize
+	}
+
+	// The messages are decompressed for the hooks and compressed again with the same parameters
+	var (
+		inflater   *websocketInflater
+		deflater   *websocketDeflater
+		compressed bool
+	)
+	if params := conn.deflate; params != nil {
+		if direction == WebsocketClientToServer {
+			inflater = &websocketInflater{noContextTakeover: params.clientNoContextTakeover}
+			deflater = newWebsocketDeflater(params.clientNoContextTakeover, params.clientMaxWindowBits)
+		} else {
+			inflater = &websocketInflater{noContextTakeover: params.serverNoContextTakeover}
+			deflater = newWebsocketDeflater(params.serverNoContextTakeover, params.serverMaxWindowBits)
+		}
+	}
+
+	var msg *WebsocketMessage
+	for {
+		f, err := readWebsocketFrame(r, maxSize)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.isControl():
+			// The control frames may be interleaved with the fragments of a message
+			if err = conn.writeFrame(direction, f); err != nil {
+				return err
+			}
+			continue
+		case f.rsv != 0 && (f.rsv != websocketRsv1Bit || inflater == nil || f.opcode == websocketOpContinuation):
+			// unknown extension, the frame can't be decoded
+			if err = conn.writeFrame(direction, f); err != nil {
+				return err
+			}
+			continue
+		case f.opcode == websocketOpContinuation:
+			if msg == nil {
+				return errWebsocketProtocol
+			}
+			if int64(len(msg.Data)+len(f.payload)) > maxSize {
+				return WebsocketFrameTooLargeErr
+			}
+			msg.Data = append(msg.Data, f.payload...)
+		case f.opcode == websocketOpText || f.opcode == websocketOpBinary:
+			if msg != nil {
+				return errWebsocketProtocol
+			}
+			msg = &WebsocketMessage{
+				Direction: direction,
+				Type:      int(f.opcode),
+				Data:      f.payload,
+			}
+			// RSV1 is set on the first frame of the compressed messages
+			compressed = f.rsv == websocketRsv1Bit
+		default:
+			return errWebsocketProtocol
+		}
+		if !f.fin {
+			continue
+		}
+
+		// The message is complete
+		out := msg
+		msg = nil
+		if compressed {
+			if out.Data, err = inflater.inflate(out.Data, maxSize); err != nil {
+				return err
+			}
+		}
+		for _, hook := range ws.Hooks {
+			out, err = hook.HandleMessage(out, conn)
+			if err != nil {
+				return err
+			}
+			if out == nil {
+				break
+			}
+		}
+		if out == nil {
+			continue
+		}
+		frame := &websocketFrame{
+			fin:     true,
+			opcode:  byte(out.Type),
+			payload: out.Data,
+		}
+		if compressed && deflater != nil {
+			if frame.payload, err = deflater.deflate(out.Data); err != nil {
+				return err
+			}
+			frame.rsv = websocketRsv1Bit
+		}
+		if err = conn.writeFrame(direction, frame); err != nil {
+			return err
+		}
+	}
+}